@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"os"
+	"time"
+
+	rootcmd "k8xauth/cmd"
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"github.com/spf13/cobra"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Runs credential agent answering target commands over a Unix socket",
+	Long: `Runs credential agent keeping source and target credentials in memory, refreshing
+them in background and answering the eks, gke, aks and other target commands over
+a Unix socket
+
+Target commands use the agent when it is listening on --agentsocket and retrieve
+credentials in process otherwise, so process start-up and SDK initialization is
+not repeated for every Kubernetes client build`,
+	Example: `k8xauth agent --agentsocket /var/run/k8xauth/agent.sock`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		socket, _ := cmd.Flags().GetString("agentsocket")
+		skew, _ := cmd.Flags().GetDuration("cacheskew")
+		refreshInterval, _ := cmd.Flags().GetDuration("refreshinterval")
+		idleTimeout, _ := cmd.Flags().GetDuration("idletimeout")
+
+		options, err := rootcmd.FlagsAuthOptions(cmd.Flags(), "")
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		err = serve(socket, &server{
+			flags:           cmd.Flags(),
+			cache:           cache.NewMemory(skew, auth.SourceIdentity(&options)),
+			skew:            skew,
+			refreshInterval: refreshInterval,
+			idleTimeout:     idleTimeout,
+			entries:         map[string]*entry{},
+		})
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootcmd.RootCmd.AddCommand(agentCmd)
+
+	agentCmd.Flags().Duration("refreshinterval", 30*time.Second, "Interval credentials are refreshed ahead of their expiry in (optional)")
+	agentCmd.Flags().Duration("idletimeout", time.Hour, "Credentials not requested for this long are no longer refreshed (optional)")
+	rootcmd.AddPolicyFlag(agentCmd.Flags())
+}
@@ -0,0 +1,240 @@
+package agent
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/agent"
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+// server keeps credentials of the requested targets in memory and refreshes them in background
+// until they are not requested for the idle timeout.
+type server struct {
+	// flags are the agent command flags, root command persistent flags being used by all requests.
+	flags *pflag.FlagSet
+	// cache holds intermediate credentials shared by the targets, e.g. assumed AWS role credentials.
+	cache *cache.Cache
+	// skew is the period before expiry in which credentials are refreshed on request.
+	skew time.Duration
+	// refreshInterval is the interval of the background refresh.
+	refreshInterval time.Duration
+	// idleTimeout is the period after the last request credentials are no longer refreshed.
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry holds credentials of a target for the flags it was requested with.
+type entry struct {
+	mu       sync.Mutex
+	target   rootcmd.Target
+	flags    *pflag.FlagSet
+	options  auth.Options
+	token    *oauth2.Token
+	lastUsed time.Time
+}
+
+// refresh retrieves the entry credentials if they expire within the period. The policy is checked
+// before the credentials kept in memory are returned.
+func (e *entry) refresh(within time.Duration) (*oauth2.Token, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t, err := e.target.Authorize(e.flags, &e.options)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.token != nil && time.Now().Add(within).Before(e.token.Expiry) {
+		return e.token, nil
+	}
+
+	token, err := t.Token(e.flags, &e.options)
+	if err != nil {
+		return nil, err
+	}
+	e.token = token
+	return token, nil
+}
+
+// token returns the credentials for the request, retrieved with the source identity of the agent.
+func (s *server) token(r agent.Request) (*oauth2.Token, error) {
+	t, ok := rootcmd.LookupTarget(r.Target)
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", r.Target)
+	}
+
+	flags := t.NewFlagSet()
+	if err := t.ParseRequestArgs(flags, r.Args, s.flags); err != nil {
+		return nil, err
+	}
+
+	options, err := rootcmd.FlagsAuthOptions(flags, r.ClusterServer)
+	if err != nil {
+		return nil, err
+	}
+	options.Cache = s.cache
+
+	if !t.Cacheable(flags) {
+		return t.Token(flags, &options)
+	}
+
+	key := s.cache.Key(rootcmd.CacheKeyParts(rootcmd.RootCmd.Name()+" "+t.Name, flags, r.ClusterServer)...)
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{
+			target:  t,
+			flags:   flags,
+			options: options,
+		}
+		s.entries[key] = e
+	}
+	e.lastUsed = time.Now()
+	s.mu.Unlock()
+
+	return e.refresh(s.skew)
+}
+
+// refreshLoop refreshes credentials of the entries ahead of their expiry, so requests don't wait for
+// them, and drops entries not requested for the idle timeout.
+func (s *server) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		entries := make([]*entry, 0, len(s.entries))
+		for key, e := range s.entries {
+			if time.Since(e.lastUsed) > s.idleTimeout {
+				logger.Log.Debug(fmt.Sprintf("Dropping idle %s credentials", e.target.Name))
+				delete(s.entries, key)
+				continue
+			}
+			entries = append(entries, e)
+		}
+		s.mu.Unlock()
+
+		for _, e := range entries {
+			if _, err := e.refresh(s.skew + s.refreshInterval); err != nil {
+				logger.Log.Error(fmt.Sprintf("Couldn't refresh %s credentials: %s", e.target.Name, err.Error()))
+			}
+		}
+	}
+}
+
+// handleToken answers agent token requests.
+func (s *server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var request agent.Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(agent.Response{Error: err.Error()})
+		return
+	}
+
+	token, err := s.token(request)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Couldn't retrieve %s credentials: %s", request.Target, err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(agent.Response{Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(agent.Response{Token: &oauth2.Token{
+		AccessToken: token.AccessToken,
+		Expiry:      token.Expiry,
+	}})
+}
+
+// listen listens on the socket, readable by the current user only. A socket left behind by an agent
+// that didn't shut down is replaced.
+func listen(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create socket directory: %w", err)
+	}
+
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("agent is already listening on %s", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("couldn't remove stale socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serve answers agent requests on the socket until interrupted.
+func serve(socket string, s *server) error {
+	l, err := listen(socket)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(agent.TOKEN_PATH, s.handleToken)
+	mux.HandleFunc(agent.HEALTH_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	srv := &http.Server{Handler: mux}
+
+	go s.refreshLoop(ctx)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Log.Info("Agent listening on " + socket)
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/agent"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/testutil"
+
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// fakeTarget retrieves the tokens of the test target.
+var fakeTarget = &testutil.Target{}
+
+var testTarget = rootcmd.Target{
+	Name:     "agenttest",
+	Flags:    fakeTarget.Flags,
+	Required: []string{"cluster"},
+	Token:    fakeTarget.Token,
+}
+
+func init() {
+	rootcmd.RegisterTarget(&cobra.Command{Use: testTarget.Name}, testTarget)
+}
+
+// setPolicy sets the policy of the process to the policy written to a file.
+func setPolicy(t *testing.T, expression string) {
+	t.Helper()
+	path := testutil.PolicyFile(t, "rules:\n  - name: agent\n    expression: "+expression+"\n")
+
+	fs := pflag.NewFlagSet("agent", pflag.ContinueOnError)
+	rootcmd.AddPolicyFlag(fs)
+	previous := fs.Lookup("policyfile").DefValue
+	t.Cleanup(func() { fs.Set("policyfile", previous) })
+	if err := fs.Set("policyfile", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenPolicy(t *testing.T) {
+	s := &server{
+		flags:   rootcmd.RootCmd.PersistentFlags(),
+		cache:   cache.NewMemory(time.Minute, ""),
+		skew:    time.Minute,
+		entries: map[string]*entry{},
+	}
+	// Requests are served with the source identity of the agent
+	testutil.SetFlags(t, rootcmd.RootCmd.PersistentFlags(), map[string]string{"authsource": "file", "sourcetokenfile": testutil.SourceTokenFile(t, "app")})
+	request := agent.Request{
+		Target: testTarget.Name,
+		Args:   []string{"--cluster=prod"},
+	}
+
+	setPolicy(t, `source.subject == "app"`)
+	if _, err := s.token(request); err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if _, err := s.token(request); err != nil || fakeTarget.Tokens != 1 {
+		t.Fatalf("token = %v, retrieved %d tokens, want token kept in memory", err, fakeTarget.Tokens)
+	}
+
+	// Tokens kept in memory aren't returned once the policy denies them
+	setPolicy(t, `source.subject == "other"`)
+	if _, err := s.token(request); err == nil || !strings.Contains(err.Error(), "denied by policy") {
+		t.Errorf("token error = %v, want policy denial", err)
+	}
+
+	// Requests can't set the policy of the agent
+	request.Args = append(request.Args, "--policyfile=")
+	if _, err := s.token(request); err == nil || !strings.Contains(err.Error(), "policyfile") {
+		t.Errorf("token error = %v, want --policyfile rejected", err)
+	}
+
+	// Requests can't choose the source identity of the agent
+	request.Args = []string{"--cluster=prod", "--authsource=file"}
+	if _, err := s.token(request); err == nil || !strings.Contains(err.Error(), "--authsource") {
+		t.Errorf("token error = %v, want --authsource rejected", err)
+	}
+}
@@ -0,0 +1,224 @@
+package aks
+
+import (
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/logger"
+
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	statictokensource "github.com/trhyo/azidentity-static-source"
+)
+
+const (
+	CREDENTIAL_FEDERATED       = "federated"
+	CREDENTIAL_MANAGEDIDENTITY = "managedidentity"
+	CREDENTIAL_ENVIRONMENT     = "environment"
+	CREDENTIAL_AZURECLI        = "azurecli"
+	CREDENTIAL_DEVICECODE      = "devicecode"
+	// CREDENTIAL_NONE disables all credentials, requests of Azure tokens fail.
+	CREDENTIAL_NONE = "none"
+
+	CREDENTIAL_CHAIN_ENV = "K8XAUTH_AZURE_CREDENTIAL_CHAIN"
+)
+
+var (
+	// SUPPORTED_CREDENTIALS lists credential names that can be used in the credential chain.
+	SUPPORTED_CREDENTIALS = []string{CREDENTIAL_FEDERATED, CREDENTIAL_MANAGEDIDENTITY, CREDENTIAL_ENVIRONMENT, CREDENTIAL_AZURECLI, CREDENTIAL_DEVICECODE}
+	// DEFAULT_CREDENTIAL_CHAIN is the credential chain used when none is configured, only the federated
+	// source identity is used unless other credentials are explicitly allowed.
+	DEFAULT_CREDENTIAL_CHAIN = []string{CREDENTIAL_FEDERATED}
+)
+
+// credentialChainOptions configures the ordered Azure credential chain.
+type credentialChainOptions struct {
+	// chain is the ordered list of credential names tried until one succeeds.
+	chain []string
+	// failClosed stops the chain when the federated credential fails.
+	failClosed bool
+}
+
+// credentialChainFromEnv returns the credential chain configured in K8XAUTH_AZURE_CREDENTIAL_CHAIN
+// environment variable, or nil if it is not set.
+func credentialChainFromEnv() []string {
+	env := os.Getenv(CREDENTIAL_CHAIN_ENV)
+	if env == "" {
+		return nil
+	}
+	var chain []string
+	for _, c := range strings.Split(env, ",") {
+		chain = append(chain, strings.TrimSpace(c))
+	}
+	return chain
+}
+
+// validate checks the chain is not empty and has supported credentials only. A chain of none fails
+// closed, no credential is used.
+func (c credentialChainOptions) validate() error {
+	if len(c.chain) == 0 {
+		return errors.New("Azure credential chain is empty")
+	}
+	if slices.Contains(c.chain, CREDENTIAL_NONE) {
+		if len(c.chain) > 1 {
+			return fmt.Errorf("Azure credential %q can't be combined with other credentials", CREDENTIAL_NONE)
+		}
+		return fmt.Errorf("Azure credentials are disabled by credential chain %q", CREDENTIAL_NONE)
+	}
+	for _, name := range c.chain {
+		if !slices.Contains(SUPPORTED_CREDENTIALS, name) {
+			return fmt.Errorf("unsupported Azure credential %q, supported credentials are %s,%s", name, strings.Join(SUPPORTED_CREDENTIALS, ","), CREDENTIAL_NONE)
+		}
+	}
+	return nil
+}
+
+// namedCredential is an Azure credential identified by its chain name.
+type namedCredential struct {
+	name string
+	cred azcore.TokenCredential
+	// err is set when the credential couldn't be constructed, the attempt is then reported as failed.
+	err error
+}
+
+// chainedCredential tries credentials in order, logging each attempt and the credential that
+// succeeded. Once a credential succeeds it is used for all subsequent token requests.
+type chainedCredential struct {
+	credentials []namedCredential
+	failClosed  bool
+	selected    *namedCredential
+}
+
+// GetToken requests a token from the first credential in the chain that succeeds.
+func (c *chainedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if c.selected != nil {
+		return c.selected.cred.GetToken(ctx, opts)
+	}
+
+	var errs []error
+	for i, nc := range c.credentials {
+		logger.Log.Debug(fmt.Sprintf("Azure credential chain - Trying %s credential", nc.name))
+
+		err := nc.err
+		if err == nil {
+			var token azcore.AccessToken
+			token, err = nc.cred.GetToken(ctx, opts)
+			if err == nil {
+				logger.Log.Debug(fmt.Sprintf("Azure credential chain - Authenticated using %s credential", nc.name))
+				c.selected = &c.credentials[i]
+				return token, nil
+			}
+		}
+
+		logger.Log.Debug(fmt.Sprintf("Azure credential chain - %s credential failed: %s", nc.name, err.Error()))
+		errs = append(errs, fmt.Errorf("%s: %w", nc.name, err))
+
+		if c.failClosed && nc.name == CREDENTIAL_FEDERATED {
+			return azcore.AccessToken{}, fmt.Errorf("federated credential failed and fail closed is set: %w", err)
+		}
+	}
+
+	return azcore.AccessToken{}, fmt.Errorf("no credential in chain succeeded: %w", errors.Join(errs...))
+}
+
+// newFederatedCredential returns Azure credential federated with the source identity token.
+func newFederatedCredential(o *auth.Options, clientID, tenantID string, additionalTenants []string) (azcore.TokenCredential, error) {
+	authSource, err := auth.New(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.PrintSourceToken {
+		authSource.PrettyPrintJWTToken(os.Stdout)
+	}
+
+	identityToken, err := authSource.FederationToken("azure")
+	if err != nil {
+		return nil, err
+	}
+
+	WorkloadIdentityFederationCredentialOptions := statictokensource.WorkloadIdentityFederationCredentialOptions{
+		ClientOptions:              o.AzureClientOptions(),
+		AdditionallyAllowedTenants: additionalTenants,
+		DisableInstanceDiscovery:   o.AzureDisableInstanceDiscovery,
+		TenantID:                   tenantID,
+		ClientID:                   clientID,
+		FederatedToken:             *identityToken,
+	}
+
+	return statictokensource.NewWorkloadIdentityFederationCredential(&WorkloadIdentityFederationCredentialOptions)
+}
+
+// newNamedCredential constructs the credential with the given chain name, allowed to acquire
+// tokens in additional tenants besides its home tenant.
+func newNamedCredential(name string, o *auth.Options, clientID, tenantID string, additionalTenants []string) (azcore.TokenCredential, error) {
+	switch name {
+	case CREDENTIAL_FEDERATED:
+		return newFederatedCredential(o, clientID, tenantID, additionalTenants)
+	case CREDENTIAL_MANAGEDIDENTITY:
+		return azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ClientOptions: o.AzureClientOptions(),
+		})
+	case CREDENTIAL_ENVIRONMENT:
+		// Additionally allowed tenants are set by AZURE_ADDITIONALLY_ALLOWED_TENANTS for the environment credential
+		return azidentity.NewEnvironmentCredential(&azidentity.EnvironmentCredentialOptions{
+			ClientOptions:            o.AzureClientOptions(),
+			DisableInstanceDiscovery: o.AzureDisableInstanceDiscovery,
+		})
+	case CREDENTIAL_AZURECLI:
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{
+			AdditionallyAllowedTenants: additionalTenants,
+			TenantID:                   tenantID,
+		})
+	case CREDENTIAL_DEVICECODE:
+		return azidentity.NewDeviceCodeCredential(&azidentity.DeviceCodeCredentialOptions{
+			ClientOptions:              o.AzureClientOptions(),
+			AdditionallyAllowedTenants: additionalTenants,
+			DisableInstanceDiscovery:   o.AzureDisableInstanceDiscovery,
+			TenantID:                   tenantID,
+			// Standard output is reserved for the ExecCredential
+			UserPrompt: func(ctx context.Context, m azidentity.DeviceCodeMessage) error {
+				_, err := fmt.Fprintln(os.Stderr, m.Message)
+				return err
+			},
+		})
+	default:
+		return nil, fmt.Errorf("unsupported credential %q", name)
+	}
+}
+
+// newTokenCredential returns the configured, ordered Azure credential chain of the application
+// registered in tenantID, requesting tokens in targetTenantID.
+func newTokenCredential(o *auth.Options, clientID, tenantID, targetTenantID string, c credentialChainOptions) (azcore.TokenCredential, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	logger.Log.Debug(fmt.Sprintf("Getting Azure client credentials using chain %s", strings.Join(c.chain, ",")))
+
+	var additionalTenants []string
+	if targetTenantID != tenantID {
+		logger.Log.Debug(fmt.Sprintf("Requesting tokens in tenant %s for application from tenant %s", targetTenantID, tenantID))
+		additionalTenants = []string{targetTenantID}
+	}
+
+	chain := chainedCredential{failClosed: c.failClosed}
+	for _, name := range c.chain {
+		cred, err := newNamedCredential(name, o, clientID, tenantID, additionalTenants)
+		chain.credentials = append(chain.credentials, namedCredential{name: name, cred: cred, err: err})
+	}
+
+	return &tenantCredential{
+		cred:          &chain,
+		authorityHost: authorityHost(o),
+		clientID:      clientID,
+		tenantID:      targetTenantID,
+	}, nil
+}
@@ -1,10 +1,20 @@
 package aks
 
 import (
-	"k8xauth/cmd"
-	"k8xauth/internal/auth"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	rootcmd "k8xauth/cmd"
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -15,32 +25,234 @@ const (
 var aksCmd = &cobra.Command{
 	Use:   "aks",
 	Short: "Fetches Azure AKS cluster credentials",
-	Long: `Fetches Azure AKS cluster credentials from GKE Workload Identity or EKS IRSA
+	Long: `Fetches Azure AKS cluster credentials from GKE Workload Identity, EKS IRSA
+or AKS Workload Identity
 
 This is useful for cases where Kubernetes client is running in GKE or EKS cluster
-and needs to manage external Azure AKS cluster(s)`,
+and needs to manage external Azure AKS cluster(s), or is running in AKS cluster
+and needs to manage AKS cluster(s) through an application in another tenant`,
 	Example: `k8xauth aks --tenantid "12345678-1234-1234-1234-123456789abc" --clientid "12345678-1234-1234-1234-123456789abc"`,
 	Run: func(cmd *cobra.Command, args []string) {
+		rootcmd.WriteCredentials(cmd, aksTarget)
+	},
+}
+
+// aksTarget retrieves AKS cluster credentials
+var aksTarget = rootcmd.Target{
+	Name: "aks",
+	Flags: func(fs *pflag.FlagSet) {
+		fs.StringP("tenantid", "t", "", "Azure Entra Directory tenant ID the application is registered in (required)")
+		fs.StringP("clientid", "c", "", "Azure Managed Principal/App client ID (required)")
+		fs.StringP("serverid", "s", DEFAULT_AAD_SERVER_APPLICATION_ID, "Azure Entra (AAD) server app ID (optional)") // https://azure.github.io/kubelogin/concepts/aks.html
+		fs.Bool("popenabled", false, "Request proof-of-possession (PoP) token, requires provideClusterInfo in exec config unless --pophost is set (optional)")
+		fs.String("pophost", "", "Value of the PoP token u claim, defaults to the cluster host from KUBERNETES_EXEC_INFO (optional)")
+		fs.String("popkeyfile", "", "PEM encoded RSA private key the PoP token is bound to, if not set an ephemeral key is generated (optional)")
+		fs.StringSlice("credentialchain", DEFAULT_CREDENTIAL_CHAIN, "Ordered Azure credential chain [federated|managedidentity|environment|azurecli|devicecode|none], defaults to $K8XAUTH_AZURE_CREDENTIAL_CHAIN if set (optional)")
+		fs.Bool("failclosed", false, "Fail without trying other credentials in the chain when the federated credential fails (optional)")
+		fs.String("targettenantid", "", "Tenant to request tokens in when the multi-tenant application is registered in a different --tenantid (optional)")
+		fs.String("clusterresourceid", "", "Cluster ARM resource ID used to discover the tenant to request tokens in and the cluster by the kubeconfig command (optional)")
+		fs.StringToString("tenantoverrides", map[string]string{}, "Per cluster tenants in the form <API server host>=<tenant ID>, matched against KUBERNETES_EXEC_INFO (optional)")
+	},
+	Required: []string{"tenantid", "clientid"},
+	Token: func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		tenantID, _ := flags.GetString("tenantid")
+		clientID, _ := flags.GetString("clientid")
+		serverID, _ := flags.GetString("serverid")
+		popEnabled, _ := flags.GetBool("popenabled")
+		popHost, _ := flags.GetString("pophost")
+		popKeyFile, _ := flags.GetString("popkeyfile")
+
+		chain := credentialChainFromFlags(flags)
+		tenants := tenantOptionsFromFlags(flags)
+
+		targetTenantID, err := tenants.resolve(context.Background(), o, tenantID)
+		if err != nil {
+			return nil, err
+		}
 
-		tenantID, _ := cmd.Flags().GetString("tenantid")
-		clientID, _ := cmd.Flags().GetString("clientid")
-		serverID, _ := cmd.Flags().GetString("serverid")
+		if popEnabled {
+			return getPoPToken(o, clientID, targetTenantID, serverID, popHost, popKeyFile, chain)
+		}
+
+		return getToken(o, clientID, tenantID, targetTenantID, serverID, chain)
+	},
+	// PoP tokens are signed with a timestamp checked for freshness by the cluster
+	Uncacheable: func(flags *pflag.FlagSet) bool {
+		popEnabled, _ := flags.GetBool("popenabled")
+		return popEnabled
+	},
+	Discover: func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+		tenantID, _ := flags.GetString("tenantid")
+		clientID, _ := flags.GetString("clientid")
+		clusterResourceID, _ := flags.GetString("clusterresourceid")
 
-		options := auth.Options{
-			AuthType:         cmd.Flag("authsource").Value.String(),
-			PrintSourceToken: cmd.Flag("printsourceauthtoken").Value.String() == "true",
+		if clusterResourceID == "" {
+			return nil, errors.New("--clusterresourceid is required to discover the cluster")
 		}
 
-		getCredentials(&options, clientID, tenantID, serverID)
+		chain := credentialChainFromFlags(flags)
+		tenants := tenantOptionsFromFlags(flags)
+
+		targetTenantID, err := tenants.resolve(context.Background(), o, tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		return aksCluster(o, clientID, tenantID, targetTenantID, clusterResourceID, chain)
+	},
+	ListFlags: func(fs *pflag.FlagSet) {
+		fs.StringSlice("subscriptions", []string{}, "Subscription IDs to list clusters in, defaults to all subscriptions accessible to the identity (optional)")
+	},
+	List: func(flags *pflag.FlagSet, o *auth.Options) ([]inventory.Cluster, []error) {
+		tenantID, _ := flags.GetString("tenantid")
+		clientID, _ := flags.GetString("clientid")
+		targetTenantID, _ := flags.GetString("targettenantid")
+		subscriptions, _ := flags.GetStringSlice("subscriptions")
+		concurrency, _ := flags.GetInt("concurrency")
+
+		// Clusters are listed in a single tenant, the cluster resource ID isn't known upfront
+		if targetTenantID == "" {
+			targetTenantID = tenantID
+		}
+
+		return listClusters(o, clientID, tenantID, targetTenantID, subscriptions, credentialChainFromFlags(flags), concurrency)
 	},
 }
 
-func init() {
-	cmd.RootCmd.AddCommand(aksCmd)
+// arcCmd represents the arc command
+var arcCmd = &cobra.Command{
+	Use:   "arc",
+	Short: "Fetches Azure Arc-enabled Kubernetes cluster credentials",
+	Long: `Fetches Azure Arc-enabled Kubernetes cluster credentials from GKE Workload Identity or EKS IRSA
+
+This is useful for cases where Kubernetes client is running in GKE or EKS cluster
+and needs to manage on premise cluster(s) connected through Azure Arc with Entra ID
+authentication, directly or through cluster connect`,
+	Example: `k8xauth arc --tenantid "12345678-1234-1234-1234-123456789abc" --clientid "12345678-1234-1234-1234-123456789abc"
+
+# Print cluster connect server URL
+k8xauth arc --tenantid "12345678-1234-1234-1234-123456789abc" --clientid "12345678-1234-1234-1234-123456789abc" --resourceid "/subscriptions/12345678-1234-1234-1234-123456789abc/resourceGroups/my-rg/providers/Microsoft.Kubernetes/connectedClusters/my-cluster" --printserverurl`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printServerURL, _ := cmd.Flags().GetBool("printserverurl")
+
+		if !printServerURL {
+			rootcmd.WriteCredentials(cmd, arcTarget)
+			return
+		}
+
+		resourceID, _ := cmd.Flags().GetString("resourceid")
+		if resourceID == "" {
+			logger.Log.Error("--resourceid is required with --printserverurl")
+			os.Exit(1)
+		}
+
+		options, err := rootcmd.AuthOptions(cmd)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
 
-	aksCmd.Flags().StringP("tenantid", "t", "", "Azure Entra Directory tenant ID (required)")
-	aksCmd.Flags().StringP("clientid", "c", "", "Azure Managed Principal/App client ID (required)")
-	aksCmd.Flags().StringP("serverid", "s", DEFAULT_AAD_SERVER_APPLICATION_ID, "Azure Entra (AAD) server app ID (optional)") // https://azure.github.io/kubelogin/concepts/aks.html
-	aksCmd.MarkFlagRequired("tenantid")
-	aksCmd.MarkFlagRequired("clientid")
+		// The registered target checks the policy before listClusterUserCredential is called
+		t, _ := rootcmd.LookupTarget(arcTarget.Name)
+		cluster, err := t.Discover(cmd.Flags(), &options)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(cluster.Server)
+	},
+}
+
+// arcTarget retrieves Azure Arc-enabled Kubernetes cluster credentials
+var arcTarget = rootcmd.Target{
+	Name: "arc",
+	Flags: func(fs *pflag.FlagSet) {
+		fs.StringP("tenantid", "t", "", "Azure Entra Directory tenant ID the application is registered in (required)")
+		fs.StringP("clientid", "c", "", "Azure Managed Principal/App client ID (required)")
+		fs.StringP("serverid", "s", DEFAULT_AAD_SERVER_APPLICATION_ID, "Azure Entra (AAD) server app ID (optional)")
+		fs.String("resourceid", "", "Azure Arc connected cluster resource ID, used with --printserverurl, by the kubeconfig command and to discover the tenant to request tokens in (optional)")
+		fs.Bool("printserverurl", false, "Print cluster connect server URL from listClusterUserCredential and exit (optional)")
+		fs.StringSlice("credentialchain", DEFAULT_CREDENTIAL_CHAIN, "Ordered Azure credential chain [federated|managedidentity|environment|azurecli|devicecode|none], defaults to $K8XAUTH_AZURE_CREDENTIAL_CHAIN if set (optional)")
+		fs.Bool("failclosed", false, "Fail without trying other credentials in the chain when the federated credential fails (optional)")
+		fs.String("targettenantid", "", "Tenant to request tokens in when the multi-tenant application is registered in a different --tenantid (optional)")
+		fs.StringToString("tenantoverrides", map[string]string{}, "Per cluster tenants in the form <API server host>=<tenant ID>, matched against KUBERNETES_EXEC_INFO (optional)")
+	},
+	Required: []string{"tenantid", "clientid"},
+	Token: func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		tenantID, _ := flags.GetString("tenantid")
+		clientID, _ := flags.GetString("clientid")
+		serverID, _ := flags.GetString("serverid")
+
+		chain := credentialChainFromFlags(flags)
+		tenants := tenantOptionsFromFlags(flags)
+
+		targetTenantID, err := tenants.resolve(context.Background(), o, tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Arc-enabled clusters with Entra ID authentication use the same server app as AKS
+		return getToken(o, clientID, tenantID, targetTenantID, serverID, chain)
+	},
+	Discover: func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+		tenantID, _ := flags.GetString("tenantid")
+		clientID, _ := flags.GetString("clientid")
+		resourceID, _ := flags.GetString("resourceid")
+
+		if resourceID == "" {
+			return nil, errors.New("--resourceid is required to discover the cluster")
+		}
+
+		chain := credentialChainFromFlags(flags)
+		tenants := tenantOptionsFromFlags(flags)
+
+		targetTenantID, err := tenants.resolve(context.Background(), o, tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		return arcCluster(o, clientID, tenantID, targetTenantID, resourceID, chain)
+	},
+}
+
+// credentialChainFromFlags returns the credential chain options set by command flags, the chain
+// configured in the environment is used when the flag is not set.
+func credentialChainFromFlags(flags *pflag.FlagSet) credentialChainOptions {
+	credentialChain, _ := flags.GetStringSlice("credentialchain")
+	failClosed, _ := flags.GetBool("failclosed")
+
+	if !flags.Changed("credentialchain") {
+		if envChain := credentialChainFromEnv(); envChain != nil {
+			credentialChain = envChain
+		}
+	}
+
+	return credentialChainOptions{
+		chain:      credentialChain,
+		failClosed: failClosed,
+	}
+}
+
+// tenantOptionsFromFlags returns the target tenant options set by command flags.
+func tenantOptionsFromFlags(flags *pflag.FlagSet) tenantOptions {
+	targetTenantID, _ := flags.GetString("targettenantid")
+	clusterResourceID, _ := flags.GetString("clusterresourceid")
+	overrides, _ := flags.GetStringToString("tenantoverrides")
+
+	// arc command discovers tenant from its --resourceid
+	if resourceID, err := flags.GetString("resourceid"); err == nil && clusterResourceID == "" {
+		clusterResourceID = resourceID
+	}
+
+	return tenantOptions{
+		targetTenantID:    targetTenantID,
+		clusterResourceID: clusterResourceID,
+		overrides:         overrides,
+	}
+}
+
+func init() {
+	rootcmd.RegisterTarget(aksCmd, aksTarget)
+	rootcmd.RegisterTarget(arcCmd, arcTarget)
 }
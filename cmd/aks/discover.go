@@ -0,0 +1,195 @@
+package aks
+
+import (
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+// clusterResourceID parses the cluster ARM resource ID, checking it is of the resource type.
+func clusterResourceID(resourceID, resourceType string) (*arm.ResourceID, error) {
+	id, err := arm.ParseResourceID(resourceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster resource ID: %w", err)
+	}
+	if !strings.EqualFold(id.ResourceType.String(), resourceType) {
+		return nil, fmt.Errorf("resource %s is not of %s type", resourceID, resourceType)
+	}
+	return id, nil
+}
+
+// aksCluster returns the API server endpoint and CA of the AKS cluster retrieved using listClusterUserCredential.
+func aksCluster(o *auth.Options, clientID, tenantID, targetTenantID, resourceID string, c credentialChainOptions) (*kubeconfig.Cluster, error) {
+	id, err := clusterResourceID(resourceID, AKS_RESOURCE_TYPE)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newARMClient(o, clientID, tenantID, targetTenantID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := listClusterUserCredential(context.Background(), client, id, AKS_API_VERSION, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeconfig.Cluster{
+		// Same name as az aks get-credentials
+		Name:                     id.Name,
+		Server:                   cluster.Server,
+		CertificateAuthorityData: cluster.CertificateAuthorityData,
+	}, nil
+}
+
+// arcCluster returns the cluster connect proxy server URL of the Azure Arc-enabled cluster retrieved
+// using listClusterUserCredential.
+func arcCluster(o *auth.Options, clientID, tenantID, targetTenantID, resourceID string, c credentialChainOptions) (*kubeconfig.Cluster, error) {
+	id, err := clusterResourceID(resourceID, ARC_RESOURCE_TYPE)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newARMClient(o, clientID, tenantID, targetTenantID, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entra ID authentication through cluster connect, without the client side relay proxy
+	cluster, err := listClusterUserCredential(context.Background(), client, id, ARC_API_VERSION, map[string]any{
+		"authenticationMethod": "AAD",
+		"clientProxy":          false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeconfig.Cluster{
+		Name:                     id.Name,
+		Server:                   cluster.Server,
+		CertificateAuthorityData: cluster.CertificateAuthorityData,
+	}, nil
+}
+
+// armPage is a page of an ARM list operation response.
+type armPage[T any] struct {
+	Value    []T    `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// armList returns all resources of the ARM list operation, following the next page links.
+func armList[T any](ctx context.Context, client *arm.Client, path, apiVersion string) ([]T, error) {
+	var items []T
+
+	reqURL := runtime.JoinPaths(client.Endpoint(), path) + "?api-version=" + apiVersion
+	for reqURL != "" {
+		req, err := runtime.NewRequest(ctx, http.MethodGet, reqURL)
+		if err != nil {
+			return items, err
+		}
+
+		resp, err := client.Pipeline().Do(req)
+		if err != nil {
+			return items, err
+		}
+		if !runtime.HasStatusCode(resp, http.StatusOK) {
+			return items, runtime.NewResponseError(resp)
+		}
+
+		var page armPage[T]
+		if err := runtime.UnmarshalAsJSON(resp, &page); err != nil {
+			return items, err
+		}
+
+		items = append(items, page.Value...)
+		reqURL = page.NextLink
+	}
+
+	return items, nil
+}
+
+// subscription is a subscription of the subscriptions list operation.
+type subscription struct {
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// managedCluster is an AKS cluster of the managedClusters list operation.
+type managedCluster struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Location string            `json:"location"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// listClusters lists AKS clusters of the subscriptions, all subscriptions accessible to the identity
+// if none are set, with the endpoint and CA retrieved using listClusterUserCredential. Subscriptions
+// are listed concurrently.
+func listClusters(o *auth.Options, clientID, tenantID, targetTenantID string, subscriptions []string, c credentialChainOptions, concurrency int) ([]inventory.Cluster, []error) {
+	ctx := context.Background()
+
+	client, err := newARMClient(o, clientID, tenantID, targetTenantID, c)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	if len(subscriptions) == 0 {
+		accessible, err := armList[subscription](ctx, client, "/subscriptions", SUBSCRIPTIONS_API_VERSION)
+		if err != nil {
+			return nil, []error{fmt.Errorf("couldn't list subscriptions: %w", err)}
+		}
+		for _, s := range accessible {
+			subscriptions = append(subscriptions, s.SubscriptionID)
+		}
+		logger.Log.Debug(fmt.Sprintf("Listing AKS clusters in %d accessible subscriptions", len(subscriptions)))
+	}
+
+	return inventory.ForEach(subscriptions, concurrency, func(subscriptionID string) ([]inventory.Cluster, error) {
+		managedClusters, err := armList[managedCluster](ctx, client, "/subscriptions/"+subscriptionID+"/providers/"+AKS_RESOURCE_TYPE, AKS_API_VERSION)
+		if err != nil {
+			return nil, fmt.Errorf("%s: couldn't list AKS clusters: %w", subscriptionID, err)
+		}
+
+		var clusters []inventory.Cluster
+		var errs []error
+		for _, mc := range managedClusters {
+			id, err := arm.ParseResourceID(mc.ID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid cluster resource ID: %w", subscriptionID, err))
+				continue
+			}
+
+			cluster, err := listClusterUserCredential(ctx, client, id, AKS_API_VERSION, nil)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: AKS cluster %s: %w", subscriptionID, mc.Name, err))
+				continue
+			}
+
+			clusters = append(clusters, inventory.Cluster{
+				Name:     mc.Name,
+				Cloud:    inventory.CLOUD_AZURE,
+				ID:       mc.ID,
+				Account:  subscriptionID,
+				Location: mc.Location,
+				Endpoint: cluster.Server,
+				CAData:   cluster.CertificateAuthorityData,
+				Labels:   mc.Tags,
+				Flags: map[string]string{
+					"clusterresourceid": mc.ID,
+				},
+			})
+		}
+
+		return clusters, errors.Join(errs...)
+	})
+}
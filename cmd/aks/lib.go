@@ -2,85 +2,267 @@ package aks
 
 import (
 	auth "k8xauth/internal/auth"
-	"k8xauth/internal/credwriter"
 	"k8xauth/internal/logger"
+	"k8xauth/internal/pop"
 
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 
-	statictokensource "github.com/trhyo/azidentity-static-source"
 	"golang.org/x/oauth2"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-func getCredentials(o *auth.Options, clientID, tenantID, serverID string) {
-	ctx := context.Background()
+const (
+	ARC_API_VERSION   = "2024-01-01"
+	ARC_RESOURCE_TYPE = "Microsoft.Kubernetes/connectedClusters"
+	AKS_API_VERSION   = "2024-05-01"
+	AKS_RESOURCE_TYPE = "Microsoft.ContainerService/managedClusters"
+	AUTHORITY_HOST    = "https://login.microsoftonline.com/"
+)
+
+// authorityHost returns the Microsoft Entra authority host of the configured cloud, the one set in
+// AZURE_AUTHORITY_HOST environment variable or the public cloud one, ending with /.
+func authorityHost(o *auth.Options) string {
+	if o.AzureCloud != nil {
+		return o.AzureCloud.ActiveDirectoryAuthorityHost
+	}
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		return strings.TrimSuffix(host, "/") + "/"
+	}
+	return AUTHORITY_HOST
+}
 
+// sourceIdentityToken returns the source authentication identity token.
+func sourceIdentityToken(o *auth.Options) (*oauth2.Token, error) {
 	authSource, err := auth.New(o)
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
 	if o.PrintSourceToken {
 		authSource.PrettyPrintJWTToken(os.Stdout)
 	}
 
-	identityToken, err := authSource.Token()
+	return authSource.FederationToken("azure")
+}
+
+// getToken returns the access token of the AKS server application.
+func getToken(o *auth.Options, clientID, tenantID, targetTenantID, serverID string, c credentialChainOptions) (*oauth2.Token, error) {
+	ctx := context.Background()
+
+	chainCreds, err := newTokenCredential(o, clientID, tenantID, targetTenantID, c)
 	if err != nil {
-		logger.Log.Debug(err.Error())
-		os.Exit(1)
+		return nil, err
+	}
+
+	aztoken, err := chainCreds.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{serverID + "/.default"}, // https://azure.github.io/kubelogin/concepts/aks.html#azure-kubernetes-service-aad-server
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: aztoken.Token,
+		Expiry:      aztoken.ExpiresOn,
+	}, nil
+}
+
+// getPoPToken returns proof-of-possession (PoP) token of the AKS server application bound to an RSA
+// key and signed for the cluster host, as required by AKS clusters with Azure RBAC PoP enforcement.
+// Credentials of the chain are tried in order, credentials unable to request PoP tokens fail.
+func getPoPToken(o *auth.Options, clientID, targetTenantID, serverID, popHost, popKeyFile string, c credentialChainOptions) (*oauth2.Token, error) {
+	ctx := context.Background()
+
+	if popHost == "" {
+		if o.ClusterServer == "" {
+			return nil, errors.New("couldn't get cluster host for PoP token, exec plugin has to be configured with provideClusterInfo: true unless --pophost is set")
+		}
+		serverURL, err := url.Parse(o.ClusterServer)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse cluster server URL: %w", err)
+		}
+		popHost = serverURL.Host
+	}
+
+	var key *pop.Key
+	var err error
+	if popKeyFile != "" {
+		key, err = pop.LoadKey(popKeyFile)
+	} else {
+		key, err = pop.GenerateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
 	}
 
-	logger.Log.Debug("Getting Azure client credentials")
-	DefaultAzureCredentialOptions := azidentity.DefaultAzureCredentialOptions{
-		TenantID: tenantID,
+	authorityHost := authorityHost(o)
+
+	var errs []error
+	for _, name := range c.chain {
+		logger.Log.Debug(fmt.Sprintf("Azure credential chain - Trying %s credential for PoP token", name))
+
+		token, err := acquirePoPToken(ctx, o, name, authorityHost, clientID, targetTenantID, serverID, &pop.AuthenticationScheme{
+			Host: popHost,
+			Key:  key,
+		})
+		if err == nil {
+			logger.Log.Debug(fmt.Sprintf("Azure credential chain - Authenticated using %s credential", name))
+			return token, nil
+		}
+
+		logger.Log.Debug(fmt.Sprintf("Azure credential chain - %s credential failed: %s", name, err.Error()))
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+
+		if c.failClosed && name == CREDENTIAL_FEDERATED {
+			return nil, fmt.Errorf("federated credential failed and fail closed is set: %w", err)
+		}
 	}
 
-	// Try using default credentials source in case the workload identity federation credential fails
-	defaultCredentials, err := azidentity.NewDefaultAzureCredential(&DefaultAzureCredentialOptions)
+	return nil, fmt.Errorf("no credential in chain succeeded: %w", errors.Join(errs...))
+}
+
+// acquirePoPToken requests the PoP token with the named credential of the chain.
+func acquirePoPToken(ctx context.Context, o *auth.Options, name, authorityHost, clientID, targetTenantID, serverID string, scheme *pop.AuthenticationScheme) (*oauth2.Token, error) {
+	cred, clientID, err := newPoPCredential(o, name, clientID)
 	if err != nil {
-		logger.Log.Debug(fmt.Sprintf("Error getting default Azure credentials: %s", err.Error()))
+		return nil, err
 	}
 
-	WorkloadIdentityFederationCredentialOptions := statictokensource.WorkloadIdentityFederationCredentialOptions{
-		DisableInstanceDiscovery: true,
-		TenantID:                 tenantID,
-		ClientID:                 clientID,
-		FederatedToken:           *identityToken,
+	// Multi-tenant application credential is accepted by the authority of the target tenant
+	client, err := confidential.New(authorityHost+targetTenantID, clientID, cred, confidential.WithInstanceDiscovery(!o.AzureDisableInstanceDiscovery))
+	if err != nil {
+		return nil, err
 	}
 
-	wfiCredentials, err := statictokensource.NewWorkloadIdentityFederationCredential(&WorkloadIdentityFederationCredentialOptions)
+	logger.Log.Debug("Getting Azure PoP token for " + scheme.Host)
+	result, err := client.AcquireTokenByCredential(ctx, []string{serverID + "/.default"}, confidential.WithAuthenticationScheme(scheme))
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, consentError(err, authorityHost, clientID, targetTenantID)
 	}
 
-	chainCreds, err := azidentity.NewChainedTokenCredential([]azcore.TokenCredential{wfiCredentials, defaultCredentials}, nil)
+	return &oauth2.Token{
+		AccessToken: result.AccessToken,
+		Expiry:      result.ExpiresOn,
+	}, nil
+}
+
+// newPoPCredential returns the confidential client credential and client ID of the named credential.
+// PoP tokens are requested by confidential clients only, managed identity, Azure CLI and device code
+// credentials can't request them.
+func newPoPCredential(o *auth.Options, name, clientID string) (confidential.Credential, string, error) {
+	switch name {
+	case CREDENTIAL_FEDERATED:
+		identityToken, err := sourceIdentityToken(o)
+		if err != nil {
+			return confidential.Credential{}, "", err
+		}
+		return confidential.NewCredFromAssertionCallback(func(context.Context, confidential.AssertionRequestOptions) (string, error) {
+			return identityToken.AccessToken, nil
+		}), clientID, nil
+	case CREDENTIAL_ENVIRONMENT:
+		// Service principal of the environment credential, see azidentity.EnvironmentCredential
+		envClientID := os.Getenv("AZURE_CLIENT_ID")
+		if envClientID == "" {
+			return confidential.Credential{}, "", errors.New("AZURE_CLIENT_ID is not set")
+		}
+		if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+			cred, err := confidential.NewCredFromSecret(secret)
+			return cred, envClientID, err
+		}
+		if certPath := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"); certPath != "" {
+			data, err := os.ReadFile(certPath)
+			if err != nil {
+				return confidential.Credential{}, "", fmt.Errorf("couldn't read client certificate: %w", err)
+			}
+			certs, key, err := azidentity.ParseCertificates(data, []byte(os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD")))
+			if err != nil {
+				return confidential.Credential{}, "", err
+			}
+			cred, err := confidential.NewCredFromCert(certs, key)
+			return cred, envClientID, err
+		}
+		return confidential.Credential{}, "", errors.New("PoP tokens require AZURE_CLIENT_SECRET or AZURE_CLIENT_CERTIFICATE_PATH for environment credential")
+	default:
+		return confidential.Credential{}, "", fmt.Errorf("%s credential can't request PoP tokens", name)
+	}
+}
+
+// clusterUserCredential is the listClusterUserCredential response of AKS and Arc-enabled clusters.
+type clusterUserCredential struct {
+	Kubeconfigs []struct {
+		Name  string `json:"name"`
+		Value []byte `json:"value"`
+	} `json:"kubeconfigs"`
+}
+
+// newARMClient returns ARM client authenticating with the credential chain in the target tenant.
+func newARMClient(o *auth.Options, clientID, tenantID, targetTenantID string, c credentialChainOptions) (*arm.Client, error) {
+	chainCreds, err := newTokenCredential(o, clientID, tenantID, targetTenantID, c)
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
-	aztoken, err := chainCreds.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{serverID + "/.default"}, // https://azure.github.io/kubelogin/concepts/aks.html#azure-kubernetes-service-aad-server
+	return arm.NewClient("k8xauth", "v0.0.0", chainCreds, &arm.ClientOptions{
+		ClientOptions: o.AzureClientOptions(),
 	})
+}
+
+// listClusterUserCredential returns the cluster of the kubeconfig retrieved using listClusterUserCredential
+// ARM action of the cluster resource.
+func listClusterUserCredential(ctx context.Context, client *arm.Client, id *arm.ResourceID, apiVersion string, body any) (*clientcmdapi.Cluster, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodPost, runtime.JoinPaths(client.Endpoint(), id.String(), "listClusterUserCredential"))
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
+	q := req.Raw().URL.Query()
+	q.Set("api-version", apiVersion)
+	req.Raw().URL.RawQuery = q.Encode()
 
-	writer := credwriter.ExecCredentialWriter{}
-	err = writer.Write(oauth2.Token{
-		AccessToken: aztoken.Token,
-		Expiry:      aztoken.ExpiresOn,
-	}, os.Stdout)
+	if body != nil {
+		if err := runtime.MarshalAsJSON(req, body); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.Pipeline().Do(req)
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("couldn't list cluster user credential: %w", err)
+	}
+	if !runtime.HasStatusCode(resp, http.StatusOK) {
+		return nil, fmt.Errorf("couldn't list cluster user credential: %w", runtime.NewResponseError(resp))
+	}
+
+	var credential clusterUserCredential
+	if err := runtime.UnmarshalAsJSON(resp, &credential); err != nil {
+		return nil, err
 	}
+
+	for _, k := range credential.Kubeconfigs {
+		kubeconfig, err := clientcmd.Load(k.Value)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse cluster user credential kubeconfig: %w", err)
+		}
+		for _, cluster := range kubeconfig.Clusters {
+			return cluster, nil
+		}
+	}
+
+	return nil, errors.New("no cluster found in cluster user credential")
 }
@@ -0,0 +1,166 @@
+package aks
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+const (
+	IMDS_TOKEN_PATH        = "/metadata/identity/oauth2/token"
+	APP_SERVICE_TOKEN_PATH = "/msi/token"
+	APP_SERVICE_HEADER     = "X-IDENTITY-HEADER"
+)
+
+// managedIdentityToken is the token response of Azure IMDS and App Service managed identity endpoints.
+type managedIdentityToken struct {
+	AccessToken string `json:"access_token"`
+	ClientID    string `json:"client_id"`
+	ExpiresIn   string `json:"expires_in,omitempty"`
+	ExpiresOn   string `json:"expires_on"`
+	NotBefore   string `json:"not_before,omitempty"`
+	Resource    string `json:"resource"`
+	TokenType   string `json:"token_type"`
+}
+
+// managedIdentityError is the error response of Azure managed identity endpoints.
+type managedIdentityError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// aksMetadataCmd represents the serve-metadata aks command
+var aksMetadataCmd = &cobra.Command{
+	Use:   "aks",
+	Short: "Serves Azure IMDS and App Service managed identity token",
+	Long: `Serves Azure IMDS and App Service managed identity tokens of the application federated
+with GKE or EKS Workload Identity or AKS Workload Identity
+
+Azure SDKs use the App Service endpoint with IDENTITY_ENDPOINT environment variable set to
+http://<listen address>/msi/token and IDENTITY_HEADER set to the --authtoken value. The IMDS
+endpoint is served on /metadata/identity/oauth2/token for clients with a configurable IMDS host,
+which have to send the --authtoken value in the X-IDENTITY-HEADER header too when it is set`,
+	Example: `k8xauth serve-metadata aks --tenantid "12345678-1234-1234-1234-123456789abc" --clientid "12345678-1234-1234-1234-123456789abc" --listen "127.0.0.1:8099"`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		tenantID, _ := cmd.Flags().GetString("tenantid")
+		clientID, _ := cmd.Flags().GetString("clientid")
+
+		chain := credentialChainFromFlags(cmd.Flags())
+		tenants := tenantOptionsFromFlags(cmd.Flags())
+
+		options, err := rootcmd.MetadataAuthOptions(cmd)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		targetTenantID, err := tenants.resolve(context.Background(), &options, tenantID)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		token := func(resource string) (*oauth2.Token, error) {
+			// Tokens are checked by the policy as aks target credentials of the resource before the cached
+			// ones are returned
+			if err := aksTarget.CheckPolicy(resourceFlags(cmd.Flags(), resource), &options); err != nil {
+				return nil, err
+			}
+			return cache.Fetch(options.Cache, options.Cache.Key(resource), func() (*oauth2.Token, time.Time, error) {
+				token, err := getToken(&options, clientID, tenantID, targetTenantID, resource, chain)
+				if err != nil {
+					return nil, time.Time{}, err
+				}
+				return token, token.Expiry, nil
+			})
+		}
+
+		writeToken := func(w http.ResponseWriter, r *http.Request, imds bool) {
+			w.Header().Set("Content-Type", "application/json")
+
+			if !rootcmd.MetadataAuthorized(cmd, r, APP_SERVICE_HEADER) {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(managedIdentityError{Error: "unauthorized", ErrorDescription: "invalid identity header"})
+				return
+			}
+
+			resource := r.URL.Query().Get("resource")
+			if resource == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(managedIdentityError{Error: "invalid_request", ErrorDescription: "resource parameter is required"})
+				return
+			}
+
+			t, err := token(resource)
+			if err != nil {
+				logger.Log.Error(fmt.Sprintf("Couldn't retrieve Azure access token: %s", err.Error()))
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(managedIdentityError{Error: "invalid_request", ErrorDescription: err.Error()})
+				return
+			}
+
+			response := managedIdentityToken{
+				AccessToken: t.AccessToken,
+				ClientID:    clientID,
+				ExpiresOn:   strconv.FormatInt(t.Expiry.Unix(), 10),
+				Resource:    resource,
+				TokenType:   "Bearer",
+			}
+			if imds {
+				response.ExpiresIn = strconv.FormatInt(int64(time.Until(t.Expiry).Seconds()), 10)
+				response.NotBefore = strconv.FormatInt(time.Now().Unix(), 10)
+			}
+			json.NewEncoder(w).Encode(response)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(IMDS_TOKEN_PATH, func(w http.ResponseWriter, r *http.Request) {
+			// Metadata header prevents SSRF
+			if r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(managedIdentityError{Error: "invalid_request", ErrorDescription: "Required metadata header not specified"})
+				return
+			}
+			writeToken(w, r, true)
+		})
+		mux.HandleFunc(APP_SERVICE_TOKEN_PATH, func(w http.ResponseWriter, r *http.Request) {
+			writeToken(w, r, false)
+		})
+
+		rootcmd.ServeMetadata(cmd, mux)
+	},
+}
+
+// resourceFlags returns the emulator flags with the requested resource as --serverid, the resource of
+// aks target tokens checked by the policy.
+func resourceFlags(flags *pflag.FlagSet, resource string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(aksTarget.Name, pflag.ContinueOnError)
+	fs.AddFlagSet(flags)
+	fs.String("serverid", resource, "Resource the token is requested for")
+	return fs
+}
+
+func init() {
+	rootcmd.ServeMetadataCmd.AddCommand(aksMetadataCmd)
+
+	aksMetadataCmd.Flags().StringP("tenantid", "t", "", "Azure Entra Directory tenant ID the application is registered in (required)")
+	aksMetadataCmd.Flags().StringP("clientid", "c", "", "Azure Managed Principal/App client ID (required)")
+	aksMetadataCmd.Flags().StringSlice("credentialchain", DEFAULT_CREDENTIAL_CHAIN, "Ordered Azure credential chain [federated|managedidentity|environment|azurecli|devicecode|none], defaults to $K8XAUTH_AZURE_CREDENTIAL_CHAIN if set (optional)")
+	aksMetadataCmd.Flags().Bool("failclosed", false, "Fail without trying other credentials in the chain when the federated credential fails (optional)")
+	aksMetadataCmd.Flags().String("targettenantid", "", "Tenant to request tokens in when the multi-tenant application is registered in a different --tenantid (optional)")
+	aksMetadataCmd.MarkFlagRequired("tenantid")
+	aksMetadataCmd.MarkFlagRequired("clientid")
+}
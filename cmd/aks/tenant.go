@@ -0,0 +1,147 @@
+package aks
+
+import (
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/logger"
+
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	SUBSCRIPTIONS_API_VERSION = "2022-12-01"
+)
+
+var (
+	// authorizationURIRegexp matches the tenant in the WWW-Authenticate header returned by ARM
+	// for unauthenticated requests, e.g. authorization_uri="https://login.windows.net/<tenant>"
+	authorizationURIRegexp = regexp.MustCompile(`authorization_uri="https://[^/"]+/([^/"]+)"`)
+)
+
+// tenantOptions selects the tenant tokens are requested in, when it differs from the
+// home tenant of the (multi-tenant) application the federated credential is set up on.
+type tenantOptions struct {
+	// targetTenantID is the tenant tokens are requested in.
+	targetTenantID string
+	// clusterResourceID is the ARM resource ID of the cluster, used to discover the tenant
+	// the cluster subscription belongs to.
+	clusterResourceID string
+	// overrides maps cluster API server hosts to tenants, matched against the cluster
+	// info provided in KUBERNETES_EXEC_INFO.
+	overrides map[string]string
+}
+
+// resolve returns the tenant tokens are requested in. The explicitly set target tenant takes
+// precedence over the per-cluster override, tenant discovered from the cluster resource ID and
+// finally the home tenant.
+func (t tenantOptions) resolve(ctx context.Context, o *auth.Options, homeTenantID string) (string, error) {
+	if t.targetTenantID != "" {
+		return t.targetTenantID, nil
+	}
+
+	if len(t.overrides) > 0 {
+		if serverURL, err := url.Parse(o.ClusterServer); err == nil && o.ClusterServer != "" {
+			if tenantID, ok := t.overrides[serverURL.Hostname()]; ok {
+				logger.Log.Debug(fmt.Sprintf("Using tenant %s overridden for cluster %s", tenantID, serverURL.Hostname()))
+				return tenantID, nil
+			}
+		}
+	}
+
+	if t.clusterResourceID != "" {
+		tenantID, err := discoverTenant(ctx, o, t.clusterResourceID)
+		if err != nil {
+			return "", fmt.Errorf("couldn't discover tenant of %s: %w", t.clusterResourceID, err)
+		}
+		logger.Log.Debug(fmt.Sprintf("Discovered tenant %s for %s", tenantID, t.clusterResourceID))
+		return tenantID, nil
+	}
+
+	return homeTenantID, nil
+}
+
+// discoverTenant returns the tenant of the subscription the resource belongs to, using the
+// tenant ARM reports in the WWW-Authenticate header of an unauthenticated request.
+func discoverTenant(ctx context.Context, o *auth.Options, resourceID string) (string, error) {
+	id, err := arm.ParseResourceID(resourceID)
+	if err != nil {
+		return "", err
+	}
+	if id.SubscriptionID == "" {
+		return "", errors.New("resource ID has no subscription")
+	}
+
+	armEndpoint := cloud.AzurePublic.Services[cloud.ResourceManager].Endpoint
+	if o.AzureCloud != nil {
+		if c, ok := o.AzureCloud.Services[cloud.ResourceManager]; ok {
+			armEndpoint = c.Endpoint
+		}
+	}
+
+	reqURL := fmt.Sprintf("%s/subscriptions/%s?api-version=%s", strings.TrimSuffix(armEndpoint, "/"), id.SubscriptionID, SUBSCRIPTIONS_API_VERSION)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	m := authorizationURIRegexp.FindStringSubmatch(resp.Header.Get("WWW-Authenticate"))
+	if m == nil {
+		return "", fmt.Errorf("no tenant in ARM response (status %d)", resp.StatusCode)
+	}
+	return m[1], nil
+}
+
+// tenantCredential requests tokens in the target tenant unless the request sets one.
+type tenantCredential struct {
+	cred          azcore.TokenCredential
+	authorityHost string
+	clientID      string
+	tenantID      string
+}
+
+// GetToken requests a token in the target tenant, explaining consent errors.
+func (c *tenantCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if opts.TenantID == "" {
+		opts.TenantID = c.tenantID
+	}
+	token, err := c.cred.GetToken(ctx, opts)
+	if err != nil {
+		return token, consentError(err, c.authorityHost, c.clientID, opts.TenantID)
+	}
+	return token, nil
+}
+
+// consentError wraps Microsoft Entra errors returned when a multi-tenant application is not
+// provisioned or consented in the tenant with instructions on how to grant consent.
+func consentError(err error, authorityHost, clientID, tenantID string) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "AADSTS700016"), strings.Contains(msg, "AADSTS650052"):
+		return fmt.Errorf("application %s is not provisioned in tenant %s, an administrator of the tenant has to grant consent to it (%sadminconsent?client_id=%s): %w",
+			clientID, tenantID, authorityHost+tenantID+"/", clientID, err)
+	case strings.Contains(msg, "AADSTS65001"):
+		return fmt.Errorf("application %s has no consent for the requested resource in tenant %s, an administrator of the tenant has to grant it: %w",
+			clientID, tenantID, err)
+	case strings.Contains(msg, "AADSTS90072"), strings.Contains(msg, "AADSTS50020"):
+		return fmt.Errorf("identity is not allowed to access tenant %s: %w", tenantID, err)
+	}
+	return err
+}
@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	APPSET_PLUGIN_PATH = "/api/v1/getparams.execute"
+	// appsetRetryBackoff is the first backoff of listing again after a failure.
+	appsetRetryBackoff = 10 * time.Second
+)
+
+// AppsetPluginCmd represents the appset-plugin command, with a subcommand for every target listing its clusters.
+var AppsetPluginCmd = &cobra.Command{
+	Use:   "appset-plugin",
+	Short: "Serves ArgoCD ApplicationSet plugin generator of clusters in target cloud accounts",
+	Long: `Serves the ArgoCD ApplicationSet plugin generator protocol, returning a parameter set
+for every cluster listed with the federated credentials in the target cloud API, as the
+discover command lists them. Listed clusters are cached for --ttl, ApplicationSets select
+the clusters with the name, cloud, account, location and labels input parameters`,
+	Example: `k8xauth appset-plugin --tokenfile /var/run/argo/token eks --rolearns "arn:aws:iam::123456789012:role/argocd,arn:aws:iam::210987654321:role/argocd" --regions "us-east-1,eu-west-1"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// appsetPluginRequest is the ApplicationSet plugin generator request.
+type appsetPluginRequest struct {
+	ApplicationSetName string `json:"applicationSetName"`
+	Input              struct {
+		Parameters json.RawMessage `json:"parameters"`
+	} `json:"input"`
+}
+
+// appsetPluginParameters are the input parameters selecting the clusters, empty values match any cluster.
+type appsetPluginParameters struct {
+	Name     string            `json:"name"`
+	Cloud    string            `json:"cloud"`
+	Account  string            `json:"account"`
+	Location string            `json:"location"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// matches reports whether the cluster is selected by the parameters.
+func (p appsetPluginParameters) matches(c inventory.Cluster) bool {
+	return (p.Name == "" || p.Name == c.Name) &&
+		(p.Cloud == "" || p.Cloud == c.Cloud) &&
+		(p.Account == "" || p.Account == c.Account) &&
+		(p.Location == "" || p.Location == c.Location) &&
+		c.Matches(p.Labels)
+}
+
+// appsetPluginResponse is the ApplicationSet plugin generator response.
+type appsetPluginResponse struct {
+	Output struct {
+		Parameters []appsetPluginParameterSet `json:"parameters"`
+	} `json:"output"`
+}
+
+// appsetPluginParameterSet is the parameter set of a cluster, config being the ArgoCD cluster Secret config.
+type appsetPluginParameterSet struct {
+	Name     string            `json:"name"`
+	Cloud    string            `json:"cloud"`
+	ID       string            `json:"id"`
+	Account  string            `json:"account"`
+	Location string            `json:"location"`
+	Server   string            `json:"server"`
+	CAData   string            `json:"caData"`
+	Labels   map[string]string `json:"labels"`
+	Args     []string          `json:"args"`
+	Config   string            `json:"config"`
+}
+
+// appsetClusters are the clusters listed by the target, listed again when they are older than the TTL.
+// When listing fails, clusters listed before are kept along with the clusters listed successfully, so
+// that ArgoCD doesn't prune the Applications of clusters missing from a partial result, and listing is
+// retried after a backoff.
+type appsetClusters struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	clusters []inventory.Cluster
+	// listed is the time of the last complete listing.
+	listed time.Time
+	// lastAttempt is the time of the last listing, failures the number of failed listings since the
+	// last complete one and err their last error.
+	lastAttempt time.Time
+	failures    int
+	err         error
+	list        func() ([]inventory.Cluster, []error)
+}
+
+// interval returns the time until clusters are listed again, doubling the retry backoff with every
+// failure up to the TTL.
+func (a *appsetClusters) interval() time.Duration {
+	if a.failures == 0 {
+		return a.ttl
+	}
+	backoff := appsetRetryBackoff << min(a.failures-1, 16)
+	return min(backoff, a.ttl)
+}
+
+func (a *appsetClusters) get() ([]inventory.Cluster, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.lastAttempt.IsZero() && time.Since(a.lastAttempt) < a.interval() {
+		if a.listed.IsZero() {
+			return nil, a.err
+		}
+		return a.clusters, nil
+	}
+
+	a.lastAttempt = time.Now()
+	clusters, errs := a.list()
+	if len(errs) == 0 {
+		logger.Log.Debug(fmt.Sprintf("Listed %d clusters", len(clusters)))
+		a.clusters = clusters
+		a.listed = a.lastAttempt
+		a.failures = 0
+		a.err = nil
+		return a.clusters, nil
+	}
+
+	a.failures++
+	a.err = errors.Join(errs...)
+	// Partial result of the first listing would prune Applications of the clusters missing from it
+	if a.listed.IsZero() {
+		return nil, a.err
+	}
+
+	a.clusters = mergeClusters(clusters, a.clusters)
+	logger.Log.Error(fmt.Sprintf("Couldn't list all clusters, serving %d clusters listed now and %s ago, retrying in %s: %s",
+		len(clusters), time.Since(a.listed).Round(time.Second), a.interval(), a.err.Error()))
+	return a.clusters, nil
+}
+
+// mergeClusters returns the listed clusters and the previously listed ones missing from them.
+func mergeClusters(listed, previous []inventory.Cluster) []inventory.Cluster {
+	merged := slices.Clone(listed)
+	ids := map[string]bool{}
+	for _, c := range listed {
+		ids[c.Cloud+"/"+c.ID] = true
+	}
+	for _, c := range previous {
+		if !ids[c.Cloud+"/"+c.ID] {
+			merged = append(merged, c)
+		}
+	}
+	inventory.Sort(merged)
+	return merged
+}
+
+// readAppsetPluginToken returns the token of the file, read on every request so a rotated token is used.
+func readAppsetPluginToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read plugin token: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("plugin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// appsetPluginParameterSets returns the parameter sets of the clusters selected by the parameters.
+func appsetPluginParameterSets(clusters []inventory.Cluster, params appsetPluginParameters, command string) ([]appsetPluginParameterSet, error) {
+	sets := []appsetPluginParameterSet{}
+	for _, c := range clusters {
+		if !params.matches(c) {
+			continue
+		}
+
+		config, err := json.Marshal(argocdClusterConfig{
+			ExecProviderConfig: argocdExecProviderConfig{
+				Command:     command,
+				Args:        c.Args,
+				APIVersion:  kubeconfig.EXEC_API_VERSION,
+				InstallHint: EXEC_INSTALL_HINT,
+			},
+			TLSClientConfig: argocdTLSClientConfig{
+				CAData: c.CAData,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		labels := c.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+
+		sets = append(sets, appsetPluginParameterSet{
+			Name:     c.Name,
+			Cloud:    c.Cloud,
+			ID:       c.ID,
+			Account:  c.Account,
+			Location: c.Location,
+			Server:   c.Endpoint,
+			CAData:   base64.StdEncoding.EncodeToString(c.CAData),
+			Labels:   labels,
+			Args:     c.Args,
+			Config:   string(config),
+		})
+	}
+	return sets, nil
+}
+
+// appsetPluginHandler returns the handler of the plugin generator requests authenticated with the token
+// of the file.
+func appsetPluginHandler(tokenFile string, clusters *appsetClusters, command string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+APPSET_PLUGIN_PATH, func(w http.ResponseWriter, r *http.Request) {
+		token, err := readAppsetPluginToken(tokenFile)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			http.Error(w, "couldn't read plugin token", http.StatusInternalServerError)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r.Header.Get("Authorization"))), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req appsetPluginRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		var params appsetPluginParameters
+		if len(req.Input.Parameters) > 0 && string(req.Input.Parameters) != "null" {
+			// Unknown parameters are rejected rather than ignored, a misspelled one would select all clusters
+			dec := json.NewDecoder(bytes.NewReader(req.Input.Parameters))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&params); err != nil {
+				http.Error(w, fmt.Sprintf("invalid input parameters: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+
+		listed, err := clusters.get()
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Couldn't list clusters for ApplicationSet %s: %s", req.ApplicationSetName, err.Error()))
+			http.Error(w, "couldn't list clusters", http.StatusInternalServerError)
+			return
+		}
+
+		var resp appsetPluginResponse
+		resp.Output.Parameters, err = appsetPluginParameterSets(listed, params, command)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			http.Error(w, "couldn't render parameters", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Log.Debug(fmt.Sprintf("Returning %d clusters to ApplicationSet %s", len(resp.Output.Parameters), req.ApplicationSetName))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
+
+// runAppsetPlugin serves the ApplicationSet plugin generator of the clusters listed by the target until interrupted.
+func runAppsetPlugin(cmd *cobra.Command, t Target) {
+	listen, _ := cmd.Flags().GetString("listen")
+	tokenFile, _ := cmd.Flags().GetString("tokenfile")
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	filter, _ := cmd.Flags().GetStringToString("filter")
+	command, _ := cmd.Flags().GetString("execcommand")
+
+	if _, err := readAppsetPluginToken(tokenFile); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	clusters := &appsetClusters{
+		ttl: ttl,
+		list: func() ([]inventory.Cluster, []error) {
+			listed, errs := t.List(cmd.Flags(), &options)
+
+			var clusters []inventory.Cluster
+			for _, c := range listed {
+				if !c.Matches(filter) {
+					continue
+				}
+				c.Args = execArgs(cmd.Flags(), t, c.Flags)
+				clusters = append(clusters, c)
+			}
+			inventory.Sort(clusters)
+
+			return clusters, errs
+		},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Log.Info(fmt.Sprintf("Serving ApplicationSet plugin generator of %s clusters on %s", t.Name, listen))
+	if err := serveHTTP(ctx, listen, appsetPluginHandler(tokenFile, clusters, command)); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(AppsetPluginCmd)
+	addListRunner(AppsetPluginCmd, runAppsetPlugin)
+
+	AppsetPluginCmd.PersistentFlags().String("listen", ":4355", "Address the plugin listens on (optional)")
+	AppsetPluginCmd.PersistentFlags().String("tokenfile", "", "File with the token ArgoCD authenticates with, the plugin ConfigMap token, read on every request (required)")
+	AppsetPluginCmd.PersistentFlags().Duration("ttl", 5*time.Minute, "Time listed clusters are cached for (optional)")
+	AppsetPluginCmd.PersistentFlags().StringToString("filter", map[string]string{}, "Only list clusters with the tag or label in the form key=value, * matches any value, may be repeated (optional)")
+	AppsetPluginCmd.PersistentFlags().Int("concurrency", 8, "Number of accounts, projects, subscriptions and locations listed at once (optional)")
+	AppsetPluginCmd.PersistentFlags().String("execcommand", EXEC_COMMAND, "Command of the exec provider in the cluster config parameter (optional)")
+	AddPolicyFlag(AppsetPluginCmd.PersistentFlags())
+	AppsetPluginCmd.MarkPersistentFlagRequired("tokenfile")
+}
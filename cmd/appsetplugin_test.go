@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"k8xauth/internal/inventory"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClusterList returns the clusters and errors set, counting calls.
+type fakeClusterList struct {
+	clusters []inventory.Cluster
+	errs     []error
+	calls    int
+}
+
+func (l *fakeClusterList) list() ([]inventory.Cluster, []error) {
+	l.calls++
+	return l.clusters, l.errs
+}
+
+var appsetTestClusters = []inventory.Cluster{
+	{Name: "prod-eu", Cloud: "aws", ID: "arn:aws:eks:eu-west-1:111111111111:cluster/prod-eu", Account: "111111111111", Location: "eu-west-1", Labels: map[string]string{"env": "prod"}, Args: []string{"eks", "--cluster", "prod-eu"}},
+	{Name: "dev-us", Cloud: "aws", ID: "arn:aws:eks:us-east-1:222222222222:cluster/dev-us", Account: "222222222222", Location: "us-east-1", Labels: map[string]string{"env": "dev"}, Args: []string{"eks", "--cluster", "dev-us"}},
+	{Name: "prod-gke", Cloud: "gcp", ID: "projects/p/locations/europe-west1/clusters/prod-gke", Account: "p", Location: "europe-west1", Labels: map[string]string{"env": "prod"}, Args: []string{"gke"}},
+}
+
+// appsetTestServer serves the plugin of the listed clusters with the token written to a file.
+func appsetTestServer(t *testing.T, l *fakeClusterList) (*httptest.Server, string) {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := &appsetClusters{ttl: time.Hour, list: l.list}
+	server := httptest.NewServer(appsetPluginHandler(tokenFile, clusters, EXEC_COMMAND))
+	t.Cleanup(server.Close)
+	return server, tokenFile
+}
+
+// appsetRequest posts the plugin request with the input parameters, returning the response status and
+// the names of the returned clusters.
+func appsetRequest(t *testing.T, server *httptest.Server, token, parameters string) (int, []string) {
+	t.Helper()
+	body := []byte(`{"applicationSetName":"clusters","input":{"parameters":` + parameters + `}}`)
+	req, err := http.NewRequest(http.MethodPost, server.URL+APPSET_PLUGIN_PATH, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	var r appsetPluginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range r.Output.Parameters {
+		names = append(names, p.Name)
+	}
+	return resp.StatusCode, names
+}
+
+func TestAppsetPluginAuth(t *testing.T) {
+	server, tokenFile := appsetTestServer(t, &fakeClusterList{clusters: appsetTestClusters})
+
+	for _, token := range []string{"", "wrong-token", "secret-token-suffix"} {
+		if status, _ := appsetRequest(t, server, token, "{}"); status != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want %d", token, status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := appsetRequest(t, server, "secret-token", "{}"); status != http.StatusOK {
+		t.Errorf("valid token: status = %d, want %d", status, http.StatusOK)
+	}
+
+	// Rotated token is used without restart
+	if err := os.WriteFile(tokenFile, []byte("rotated-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := appsetRequest(t, server, "secret-token", "{}"); status != http.StatusUnauthorized {
+		t.Errorf("previous token: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := appsetRequest(t, server, "rotated-token", "{}"); status != http.StatusOK {
+		t.Errorf("rotated token: status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestAppsetPluginParameters(t *testing.T) {
+	server, _ := appsetTestServer(t, &fakeClusterList{clusters: appsetTestClusters})
+
+	tests := []struct {
+		parameters string
+		want       []string
+		wantStatus int
+	}{
+		{parameters: "null", want: []string{"prod-eu", "dev-us", "prod-gke"}},
+		{parameters: "{}", want: []string{"prod-eu", "dev-us", "prod-gke"}},
+		{parameters: `{"cloud":"aws"}`, want: []string{"prod-eu", "dev-us"}},
+		{parameters: `{"labels":{"env":"prod"}}`, want: []string{"prod-eu", "prod-gke"}},
+		{parameters: `{"cloud":"aws","location":"us-east-1"}`, want: []string{"dev-us"}},
+		{parameters: `{"account":"111111111111","labels":{"env":"*"}}`, want: []string{"prod-eu"}},
+		{parameters: `{"name":"missing"}`, want: []string{}},
+		// Misspelled parameters would select all clusters
+		{parameters: `{"clod":"aws"}`, wantStatus: http.StatusBadRequest},
+		{parameters: `{"labels":"env=prod"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if tt.wantStatus == 0 {
+			tt.wantStatus = http.StatusOK
+		}
+		status, names := appsetRequest(t, server, "secret-token", tt.parameters)
+		if status != tt.wantStatus {
+			t.Errorf("parameters %s: status = %d, want %d", tt.parameters, status, tt.wantStatus)
+			continue
+		}
+		if status == http.StatusOK && !slices.Equal(names, tt.want) {
+			t.Errorf("parameters %s: clusters = %v, want %v", tt.parameters, names, tt.want)
+		}
+	}
+}
+
+func TestAppsetClustersStaleOnError(t *testing.T) {
+	l := &fakeClusterList{errs: []error{errors.New("access denied")}}
+	clusters := &appsetClusters{ttl: time.Hour, list: l.list}
+
+	// Nothing is served before the first complete listing, failures are retried after the backoff
+	if _, err := clusters.get(); err == nil {
+		t.Fatal("first listing failure not returned")
+	}
+	if _, err := clusters.get(); err == nil || l.calls != 1 {
+		t.Fatalf("listed %d times within backoff, error %v, want 1 listing and its error", l.calls, err)
+	}
+
+	clusters.lastAttempt = time.Now().Add(-appsetRetryBackoff)
+	l.clusters, l.errs = appsetTestClusters, nil
+	got, err := clusters.get()
+	if err != nil || len(got) != len(appsetTestClusters) {
+		t.Fatalf("get = %d clusters, %v, want %d clusters", len(got), err, len(appsetTestClusters))
+	}
+
+	// Partial listing keeps clusters missing from it and updates the listed ones
+	clusters.lastAttempt = time.Time{}
+	updated := appsetTestClusters[0]
+	updated.Endpoint = "https://updated"
+	l.clusters, l.errs = []inventory.Cluster{updated}, []error{errors.New("account 222222222222: throttled")}
+	got, err = clusters.get()
+	if err != nil || len(got) != len(appsetTestClusters) {
+		t.Fatalf("get after partial failure = %d clusters, %v, want %d clusters", len(got), err, len(appsetTestClusters))
+	}
+	for _, c := range got {
+		if c.Name == updated.Name && c.Endpoint != updated.Endpoint {
+			t.Errorf("cluster %s endpoint = %q, want listed %q", c.Name, c.Endpoint, updated.Endpoint)
+		}
+	}
+
+	// Failed listing is retried after the backoff, not on every request
+	calls := l.calls
+	clusters.get()
+	if l.calls != calls {
+		t.Errorf("listed again within backoff")
+	}
+	if clusters.interval() != appsetRetryBackoff {
+		t.Errorf("retry interval = %s, want %s", clusters.interval(), appsetRetryBackoff)
+	}
+	clusters.failures = 20
+	if clusters.interval() != clusters.ttl {
+		t.Errorf("retry interval after many failures = %s, want TTL %s", clusters.interval(), clusters.ttl)
+	}
+}
+
+func TestAppsetPluginListingFailure(t *testing.T) {
+	server, _ := appsetTestServer(t, &fakeClusterList{errs: []error{errors.New("access denied")}})
+
+	if status, _ := appsetRequest(t, server, "secret-token", "{}"); status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	applycorev1 "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ARGOCD_SECRET_TYPE_LABEL = "argocd.argoproj.io/secret-type"
+	ARGOCD_SECRET_TYPE       = "cluster"
+	ARGOCD_FIELD_MANAGER     = "k8xauth"
+)
+
+var (
+	// secretNameInvalidRegexp matches runs of characters not allowed in Secret names
+	secretNameInvalidRegexp = regexp.MustCompile(`[^a-z0-9.-]+`)
+)
+
+// ArgocdCmd represents the argocd command
+var ArgocdCmd = &cobra.Command{
+	Use:   "argocd",
+	Short: "Generates ArgoCD configuration of target clusters",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// ArgocdClusterSecretCmd represents the argocd cluster-secret command, with a subcommand for every
+// target discovering its clusters.
+var ArgocdClusterSecretCmd = &cobra.Command{
+	Use:   "cluster-secret",
+	Short: "Renders ArgoCD cluster Secret of a cluster discovered from the target cloud API",
+	Long: `Retrieves the API server endpoint and CA of the cluster from the target cloud API
+with the federated credentials and renders an ArgoCD cluster Secret whose exec provider
+runs k8xauth with the target parameters. The Secret is written to standard output or
+applied to the current cluster with server-side apply`,
+	Example: `k8xauth argocd cluster-secret --project "platform" eks --rolearn "arn:aws:iam::123456789012:role/argocd" --cluster "my-cluster-name" --stsregion "us-east-2"
+
+# Apply the Secret to the cluster of the current kubeconfig context
+k8xauth argocd cluster-secret --apply eks --rolearn "arn:aws:iam::123456789012:role/argocd" --cluster "my-cluster-name"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// argocdClusterConfig is the config of an ArgoCD cluster Secret.
+type argocdClusterConfig struct {
+	ExecProviderConfig argocdExecProviderConfig `json:"execProviderConfig"`
+	TLSClientConfig    argocdTLSClientConfig    `json:"tlsClientConfig"`
+}
+
+// argocdExecProviderConfig is the exec credential plugin of an ArgoCD cluster.
+type argocdExecProviderConfig struct {
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	APIVersion  string   `json:"apiVersion"`
+	InstallHint string   `json:"installHint"`
+}
+
+// argocdTLSClientConfig is the TLS configuration of an ArgoCD cluster.
+type argocdTLSClientConfig struct {
+	Insecure bool   `json:"insecure"`
+	CAData   []byte `json:"caData,omitempty"`
+}
+
+// secretName returns the name made a valid Secret name.
+func secretName(name string) string {
+	name = secretNameInvalidRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, ".-")
+}
+
+// argocdClusterSecret returns the ArgoCD cluster Secret of the cluster authenticating with the target.
+func argocdClusterSecret(flags *pflag.FlagSet, t Target, cluster *kubeconfig.Cluster) (*corev1.Secret, error) {
+	name, _ := flags.GetString("name")
+	secret, _ := flags.GetString("secretname")
+	namespace, _ := flags.GetString("namespace")
+	labels, _ := flags.GetStringToString("labels")
+	annotations, _ := flags.GetStringToString("annotations")
+	project, _ := flags.GetString("project")
+	namespaces, _ := flags.GetStringSlice("namespaces")
+	clusterResources, _ := flags.GetBool("clusterresources")
+	command, _ := flags.GetString("execcommand")
+
+	if name == "" {
+		name = cluster.Name
+	}
+	if secret == "" {
+		secret = secretName(name)
+	}
+
+	config, err := json.MarshalIndent(argocdClusterConfig{
+		ExecProviderConfig: argocdExecProviderConfig{
+			Command:     command,
+			Args:        execArgs(flags, t, nil),
+			APIVersion:  kubeconfig.EXEC_API_VERSION,
+			InstallHint: EXEC_INSTALL_HINT,
+		},
+		TLSClientConfig: argocdTLSClientConfig{
+			CAData: cluster.CertificateAuthorityData,
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	secretLabels := map[string]string{}
+	for k, v := range labels {
+		secretLabels[k] = v
+	}
+	secretLabels[ARGOCD_SECRET_TYPE_LABEL] = ARGOCD_SECRET_TYPE
+
+	stringData := map[string]string{
+		"name":   name,
+		"server": cluster.Server,
+		"config": string(config),
+	}
+	if project != "" {
+		stringData["project"] = project
+	}
+	if len(namespaces) > 0 {
+		stringData["namespaces"] = strings.Join(namespaces, ",")
+		stringData["clusterResources"] = fmt.Sprint(clusterResources)
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret,
+			Namespace:   namespace,
+			Labels:      secretLabels,
+			Annotations: annotations,
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: stringData,
+	}, nil
+}
+
+// applySecret applies the Secret with server-side apply to the cluster of the kubeconfig context.
+func applySecret(flags *pflag.FlagSet, secret *corev1.Secret) error {
+	kubeconfigPath, _ := flags.GetString("kubeconfig")
+	kubeContext, _ := flags.GetString("context")
+	force, _ := flags.GetBool("force")
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfigPath
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+		CurrentContext: kubeContext,
+	}).ClientConfig()
+	if err != nil {
+		return fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	// Applied as data, stringData is write-only and not tracked by server-side apply
+	data := make(map[string][]byte, len(secret.StringData))
+	for k, v := range secret.StringData {
+		data[k] = []byte(v)
+	}
+
+	apply := applycorev1.Secret(secret.Name, secret.Namespace).
+		WithLabels(secret.Labels).
+		WithAnnotations(secret.Annotations).
+		WithType(secret.Type).
+		WithData(data)
+
+	_, err = client.CoreV1().Secrets(secret.Namespace).Apply(context.Background(), apply, metav1.ApplyOptions{
+		FieldManager: ARGOCD_FIELD_MANAGER,
+		Force:        force,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't apply Secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+
+	return nil
+}
+
+// runArgocdClusterSecret renders, or applies, the ArgoCD cluster Secret of the cluster discovered by the target.
+func runArgocdClusterSecret(cmd *cobra.Command, t Target) {
+	output, _ := cmd.Flags().GetString("output")
+	apply, _ := cmd.Flags().GetBool("apply")
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	cluster, err := t.Discover(cmd.Flags(), &options)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Couldn't discover %s cluster: %s", t.Name, err.Error()))
+		os.Exit(1)
+	}
+
+	secret, err := argocdClusterSecret(cmd.Flags(), t, cluster)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if apply {
+		if err := applySecret(cmd.Flags(), secret); err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		logger.Log.Info(fmt.Sprintf("Secret %s/%s of cluster %s applied", secret.Namespace, secret.Name, cluster.Server))
+		return
+	}
+
+	var data []byte
+	switch output {
+	case "yaml":
+		data, err = yaml.Marshal(secret)
+	case "json":
+		data, err = json.MarshalIndent(secret, "", "  ")
+		data = append(data, '\n')
+	default:
+		err = fmt.Errorf("unsupported output %q, supported outputs are yaml and json", output)
+	}
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(data)
+}
+
+func init() {
+	RootCmd.AddCommand(ArgocdCmd)
+	ArgocdCmd.AddCommand(ArgocdClusterSecretCmd)
+	addDiscoveryRunner(ArgocdClusterSecretCmd, runArgocdClusterSecret)
+
+	ArgocdClusterSecretCmd.PersistentFlags().String("name", "", "ArgoCD cluster name, defaults to the cloud cluster identifier (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("secretname", "", "Name of the Secret, defaults to --name made a valid Secret name (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("namespace", "argocd", "Namespace of the Secret, the ArgoCD namespace (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().StringToString("labels", map[string]string{}, "Additional labels of the Secret in the form key=value (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().StringToString("annotations", map[string]string{}, "Annotations of the Secret in the form key=value (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("project", "", "ArgoCD project the cluster is scoped to (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().StringSlice("namespaces", []string{}, "Namespaces ArgoCD manages in the cluster, all if not set (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().Bool("clusterresources", false, "Allow ArgoCD to manage cluster-scoped resources when --namespaces is set (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("execcommand", EXEC_COMMAND, "Command of the exec provider (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().StringP("output", "o", "yaml", "Output format of the Secret [yaml|json] (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().Bool("apply", false, "Apply the Secret with server-side apply instead of writing it to standard output (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("kubeconfig", "", "Kubeconfig of the cluster the Secret is applied to, defaults to $KUBECONFIG, ~/.kube/config or in-cluster config (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().String("context", "", "Kubeconfig context the Secret is applied to, defaults to the current context (optional)")
+	ArgocdClusterSecretCmd.PersistentFlags().Bool("force", false, "Take ownership of Secret fields managed by others when applying (optional)")
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"k8xauth/internal/authn"
+	"k8xauth/internal/logger"
+
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	AUTHN_WEBHOOK_PATH = "/authenticate"
+)
+
+// AuthnWebhookCmd represents the authn-webhook command
+var AuthnWebhookCmd = &cobra.Command{
+	Use:   "authn-webhook",
+	Short: "Serves Kubernetes TokenReview webhook authenticating cross-cloud workload identity tokens",
+	Long: `Serves the authentication.k8s.io/v1 TokenReview webhook, so that clusters (e.g. on premise)
+accept GKE, EKS, AKS and other workload identity tokens directly. Tokens are verified against
+the keys of the configured OIDC issuers, discovered and cached, and their claims are mapped
+to the username and groups with templates
+
+With the aws configuration k8s-aws-v1 tokens of the eks and awsiam commands are accepted as
+well, their presigned STS GetCallerIdentity request is checked and sent to STS and the
+resolved IAM role or user ARN is mapped to the username and groups`,
+	Example: `k8xauth authn-webhook --config /etc/k8xauth/authn.yaml --tlscertfile /etc/k8xauth/tls.crt --tlskeyfile /etc/k8xauth/tls.key`,
+	Run: func(cmd *cobra.Command, args []string) {
+		configFile, _ := cmd.Flags().GetString("config")
+		listen, _ := cmd.Flags().GetString("listen")
+		certFile, _ := cmd.Flags().GetString("tlscertfile")
+		keyFile, _ := cmd.Flags().GetString("tlskeyfile")
+		jwksTTL, _ := cmd.Flags().GetDuration("jwksttl")
+		leeway, _ := cmd.Flags().GetDuration("leeway")
+
+		if (certFile == "") != (keyFile == "") {
+			logger.Log.Error("--tlscertfile and --tlskeyfile have to be set together")
+			os.Exit(1)
+		}
+
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Couldn't read config: %s", err.Error()))
+			os.Exit(1)
+		}
+		var config authn.Config
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			logger.Log.Error(fmt.Sprintf("Invalid config %s: %s", configFile, err.Error()))
+			os.Exit(1)
+		}
+
+		authenticator, err := authn.New(config, jwksTTL, leeway)
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Invalid config %s: %s", configFile, err.Error()))
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("POST "+AUTHN_WEBHOOK_PATH, authenticator)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		logger.Log.Info(fmt.Sprintf("Serving TokenReview webhook of %d issuers (AWS tokens accepted: %t) on %s", len(config.Issuers), config.AWS != nil, listen))
+		if certFile == "" {
+			logger.Log.Info("Serving without TLS, the API server requires TLS unless a proxy terminates it")
+		}
+		if err := serveHTTPTLS(ctx, listen, mux, certFile, keyFile); err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(AuthnWebhookCmd)
+
+	AuthnWebhookCmd.Flags().String("config", "", "Path of the issuers configuration (required)")
+	AuthnWebhookCmd.Flags().String("listen", ":8443", "Address the webhook listens on (optional)")
+	AuthnWebhookCmd.Flags().String("tlscertfile", "", "Path of the PEM encoded serving certificate, served without TLS if not set (optional)")
+	AuthnWebhookCmd.Flags().String("tlskeyfile", "", "Path of the PEM encoded serving certificate key (optional)")
+	AuthnWebhookCmd.Flags().Duration("jwksttl", time.Hour, "Time issuer keys are cached for, keys are fetched again earlier for tokens signed with unknown keys (optional)")
+	AuthnWebhookCmd.Flags().Duration("leeway", time.Minute, "Clock skew tolerated validating token expiry (optional)")
+	AuthnWebhookCmd.MarkFlagRequired("config")
+}
@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"k8xauth/internal/authn"
+	"k8xauth/internal/broker"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// BrokerCmd represents the broker command
+var BrokerCmd = &cobra.Command{
+	Use:   "broker",
+	Short: "Serves target credentials to callers allowed by a policy",
+	Long: `Runs a central credential broker holding the federated trust, so that only the broker
+and not every pod has to be trusted by the target clouds. Callers authenticate with their
+Kubernetes ServiceAccount token, validated with the TokenReview API or the keys of the
+issuers in --authnconfig, and request credentials of a target with its flags. Requests
+are allowed by the rules of the --policy file, the broker runs the eks, gke, aks or other
+target flow with its own source identity and returns the token
+
+Target commands request credentials from the broker with the --broker flag`,
+	Example: `k8xauth broker --policy /etc/k8xauth/policy.yaml --tlscertfile /etc/k8xauth/tls.crt --tlskeyfile /etc/k8xauth/tls.key
+
+# Caller
+k8xauth eks --broker https://k8xauth-broker.k8xauth.svc:8443 --brokercertificateauthority /etc/k8xauth/ca.crt \
+  --rolearn "arn:aws:iam::123456789012:role/argocd" --cluster "my-cluster-name"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		policyFile, _ := cmd.Flags().GetString("policy")
+		listen, _ := cmd.Flags().GetString("listen")
+		certFile, _ := cmd.Flags().GetString("tlscertfile")
+		keyFile, _ := cmd.Flags().GetString("tlskeyfile")
+		audiences, _ := cmd.Flags().GetStringSlice("audiences")
+		authnConfigFile, _ := cmd.Flags().GetString("authnconfig")
+		kubeconfigPath, _ := cmd.Flags().GetString("kubeconfig")
+		kubeContext, _ := cmd.Flags().GetString("context")
+		skew, _ := cmd.Flags().GetDuration("cacheskew")
+
+		if (certFile == "") != (keyFile == "") {
+			logger.Log.Error("--tlscertfile and --tlskeyfile have to be set together")
+			os.Exit(1)
+		}
+
+		var policyConfig broker.PolicyConfig
+		if err := readBrokerConfig(policyFile, &policyConfig); err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		policy, err := broker.NewPolicy(policyConfig)
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Invalid policy %s: %s", policyFile, err.Error()))
+			os.Exit(1)
+		}
+
+		a, err := newBrokerAuthenticator(authnConfigFile, kubeconfigPath, kubeContext)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("POST "+broker.TOKEN_PATH, &brokerServer{
+			authenticator: a,
+			policy:        policy,
+			audiences:     audiences,
+			flags:         cmd.Flags(),
+			cache:         cache.NewMemory(skew, ""),
+		})
+		mux.HandleFunc(broker.HEALTH_PATH, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		logger.Log.Info(fmt.Sprintf("Serving broker of %v on %s", TargetNames(), listen))
+		if certFile == "" {
+			logger.Log.Info("Serving without TLS, callers' tokens and credentials are sent in plain text unless a proxy terminates TLS")
+		}
+		if err := serveHTTPTLS(ctx, listen, mux, certFile, keyFile); err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+// brokerAuthenticator authenticates caller tokens, returning the caller and the audiences the token is valid for.
+type brokerAuthenticator interface {
+	Authenticate(ctx context.Context, token string, audiences []string) (*authenticationv1.UserInfo, []string, error)
+}
+
+// tokenReviewer authenticates Kubernetes ServiceAccount tokens with the TokenReview API.
+type tokenReviewer struct {
+	client kubernetes.Interface
+}
+
+func (t *tokenReviewer) Authenticate(ctx context.Context, token string, audiences []string) (*authenticationv1.UserInfo, []string, error) {
+	review, err := t.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("TokenReview failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, nil, errors.New(review.Status.Error)
+		}
+		return nil, nil, errors.New("token not authenticated")
+	}
+	return &review.Status.User, review.Status.Audiences, nil
+}
+
+// brokerServer answers broker requests of authenticated callers allowed by the policy, retrieving credentials
+// with the broker source identity.
+type brokerServer struct {
+	authenticator brokerAuthenticator
+	policy        *broker.Policy
+	// audiences are the audiences caller tokens have to be valid for, the API server ones if empty.
+	audiences []string
+	// flags are the broker command flags, its root persistent flags configure the source identity.
+	flags *pflag.FlagSet
+	// cache holds the target and intermediate credentials shared by the callers.
+	cache *cache.Cache
+}
+
+// brokerRequestError is an error of a request the caller has to correct, answered with the status.
+type brokerRequestError struct {
+	status int
+	err    error
+}
+
+func (e *brokerRequestError) Error() string {
+	return e.err.Error()
+}
+
+// parseRequest returns the target and its flags of the request, with the broker root persistent flags.
+func (s *brokerServer) parseRequest(r broker.Request) (Target, *pflag.FlagSet, error) {
+	t, ok := LookupTarget(r.Target)
+	if !ok {
+		return t, nil, fmt.Errorf("unknown target %q", r.Target)
+	}
+
+	flags := t.NewFlagSet()
+	// Targets read the source configuration of the broker
+	if err := t.ParseRequestArgs(flags, r.Args, s.flags); err != nil {
+		return t, nil, err
+	}
+	return t, flags, nil
+}
+
+// brokerFlagValues returns the values of all target flags, an item for every slice and map entry.
+func brokerFlagValues(t Target, flags *pflag.FlagSet) map[string][]string {
+	fs := pflag.NewFlagSet(t.Name, pflag.ContinueOnError)
+	t.Flags(fs)
+
+	values := map[string][]string{}
+	fs.VisitAll(func(f *pflag.Flag) {
+		flag := flags.Lookup(f.Name)
+
+		if value, ok := flag.Value.(pflag.SliceValue); ok {
+			values[f.Name] = value.GetSlice()
+			return
+		}
+
+		if flag.Value.Type() == "stringToString" {
+			m, _ := flags.GetStringToString(f.Name)
+			values[f.Name] = []string{}
+			for k, v := range m {
+				values[f.Name] = append(values[f.Name], k+"="+v)
+			}
+			return
+		}
+
+		values[f.Name] = []string{flag.Value.String()}
+	})
+	return values
+}
+
+// token returns the credentials of the request if the policy allows the caller to request them.
+func (s *brokerServer) token(user *authenticationv1.UserInfo, r broker.Request) (*oauth2.Token, error) {
+	t, flags, err := s.parseRequest(r)
+	if err != nil {
+		return nil, &brokerRequestError{status: http.StatusBadRequest, err: err}
+	}
+
+	rule, err := s.policy.Allow(*user, t.Name, brokerFlagValues(t, flags))
+	if err != nil {
+		logger.Audit.Warn(fmt.Sprintf("Audit: %s denied %s credentials for %v: %s", user.Username, t.Name, r.Args, err.Error()))
+		return nil, &brokerRequestError{status: http.StatusForbidden, err: err}
+	}
+	logger.Audit.Info(fmt.Sprintf("Audit: %s allowed %s credentials for %v by rule %s", user.Username, t.Name, r.Args, rule))
+
+	options, err := FlagsAuthOptions(flags, r.ClusterServer)
+	if err != nil {
+		return nil, err
+	}
+	options.Cache = s.cache
+
+	// The policy of the broker is checked before cached credentials are looked up
+	t, err = t.Authorize(flags, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.Cacheable(flags) {
+		return t.Token(flags, &options)
+	}
+
+	key := s.cache.Key(CacheKeyParts(RootCmd.Name()+" broker "+t.Name, flags, r.ClusterServer)...)
+	return cache.Fetch(s.cache, key, func() (*oauth2.Token, time.Time, error) {
+		token, err := t.Token(flags, &options)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return token, token.Expiry, nil
+	})
+}
+
+// ServeHTTP answers token requests of callers authenticated with their bearer token.
+func (s *brokerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	callerToken := bearerToken(r.Header.Get("Authorization"))
+	if callerToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(broker.Response{Error: "bearer token required"})
+		return
+	}
+	user, _, err := s.authenticator.Authenticate(r.Context(), callerToken, s.audiences)
+	if err != nil {
+		logger.Log.Debug("Caller token rejected: " + err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(broker.Response{Error: "caller token not authenticated"})
+		return
+	}
+
+	var request broker.Request
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(broker.Response{Error: err.Error()})
+		return
+	}
+
+	token, err := s.token(user, request)
+	if err != nil {
+		status := http.StatusBadGateway
+		var reqErr *brokerRequestError
+		if errors.As(err, &reqErr) {
+			status = reqErr.status
+		} else {
+			logger.Log.Error(fmt.Sprintf("Couldn't retrieve %s credentials for %s: %s", request.Target, user.Username, err.Error()))
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(broker.Response{Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(broker.Response{Token: &oauth2.Token{
+		AccessToken: token.AccessToken,
+		Expiry:      token.Expiry,
+	}})
+}
+
+// readBrokerConfig reads the YAML configuration file into v, rejecting unknown fields.
+func readBrokerConfig(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return nil
+}
+
+// newBrokerAuthenticator returns the authenticator of the caller tokens, verifying them with the keys of the
+// issuers in the authn configuration if set, with the TokenReview API of the cluster otherwise.
+func newBrokerAuthenticator(authnConfigFile, kubeconfigPath, kubeContext string) (brokerAuthenticator, error) {
+	if authnConfigFile != "" {
+		var config authn.Config
+		if err := readBrokerConfig(authnConfigFile, &config); err != nil {
+			return nil, err
+		}
+		a, err := authn.New(config, time.Hour, time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", authnConfigFile, err)
+		}
+		return a, nil
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfigPath
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+		CurrentContext: kubeContext,
+	}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load kubeconfig: %w", err)
+	}
+	rest.AddUserAgent(restConfig, "k8xauth-broker")
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenReviewer{client: client}, nil
+}
+
+func init() {
+	RootCmd.AddCommand(BrokerCmd)
+
+	BrokerCmd.Flags().String("policy", "", "Path of the policy allowing callers to request targets (required)")
+	BrokerCmd.Flags().String("listen", ":8443", "Address the broker listens on (optional)")
+	BrokerCmd.Flags().String("tlscertfile", "", "Path of the PEM encoded serving certificate, served without TLS if not set (optional)")
+	BrokerCmd.Flags().String("tlskeyfile", "", "Path of the PEM encoded serving certificate key (optional)")
+	BrokerCmd.Flags().StringSlice("audiences", []string{}, "Audiences caller tokens have to be valid for, the API server audiences if not set (optional)")
+	BrokerCmd.Flags().String("authnconfig", "", "Path of the authn-webhook issuers configuration caller tokens are verified with instead of the TokenReview API (optional)")
+	BrokerCmd.Flags().String("kubeconfig", "", "Kubeconfig of the cluster caller tokens are reviewed by, defaults to $KUBECONFIG, ~/.kube/config or in-cluster config (optional)")
+	BrokerCmd.Flags().String("context", "", "Kubeconfig context of the cluster caller tokens are reviewed by, defaults to the current context (optional)")
+	AddPolicyFlag(BrokerCmd.Flags())
+	BrokerCmd.MarkFlagRequired("policy")
+}
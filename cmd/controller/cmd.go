@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// SERVICE_ACCOUNT_NAMESPACE_FILE is the namespace of the pod the controller runs in.
+	SERVICE_ACCOUNT_NAMESPACE_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// controllerCmd represents the controller command
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Keeps kubeconfig and token Secrets of target clusters fresh",
+	Long: `Runs a controller keeping kubeconfig or bearer token Secrets of target clusters fresh,
+for consumers only accepting a static kubeconfig Secret such as Flux Kustomization
+spec.kubeConfig.secretRef or Cluster API. Secrets labeled k8xauth.io/managed=true
+describe the target and its flags in annotations, the controller runs the target
+flow and writes the Secret again before the token expires, reporting failures in
+the Ready condition of the k8xauth.io/conditions annotation and in events
+
+Replicas elect a leader with a Lease so that only one of them writes the Secrets`,
+	Example: `k8xauth controller --namespace flux-system
+
+# Managed Secret
+kubectl create secret generic prod-kubeconfig -n flux-system
+kubectl label secret prod-kubeconfig -n flux-system k8xauth.io/managed=true
+kubectl annotate secret prod-kubeconfig -n flux-system k8xauth.io/target=eks \
+  k8xauth.io/args='["--rolearn=arn:aws:iam::123456789012:role/flux","--cluster=prod","--stsregion=us-east-2"]'`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		kubeconfigPath, _ := cmd.Flags().GetString("kubeconfig")
+		kubeContext, _ := cmd.Flags().GetString("context")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		workers, _ := cmd.Flags().GetInt("workers")
+		refreshBefore, _ := cmd.Flags().GetDuration("refreshbefore")
+		leaderElect, _ := cmd.Flags().GetBool("leaderelect")
+		leaseNamespace, _ := cmd.Flags().GetString("leaderelectionnamespace")
+		leaseName, _ := cmd.Flags().GetString("leaderelectionid")
+		skew, _ := cmd.Flags().GetDuration("cacheskew")
+
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfigPath
+		restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+			CurrentContext: kubeContext,
+		}).ClientConfig()
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Couldn't load kubeconfig: %s", err.Error()))
+			os.Exit(1)
+		}
+		rest.AddUserAgent(restConfig, CONTROLLER_NAME)
+
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		run := func(ctx context.Context) {
+			c, factory := newController(client, namespace, cmd.Flags(), cache.NewMemory(skew, ""), refreshBefore)
+			factory.Start(ctx.Done())
+			if err := c.run(ctx, workers); err != nil {
+				logger.Log.Error(err.Error())
+				os.Exit(1)
+			}
+		}
+
+		if !leaderElect {
+			run(ctx)
+			return
+		}
+
+		if leaseNamespace == "" {
+			leaseNamespace = podNamespace()
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta: metav1.ObjectMeta{
+					Name:      leaseName,
+					Namespace: leaseNamespace,
+				},
+				Client: client.CoordinationV1(),
+				LockConfig: resourcelock.ResourceLockConfig{
+					Identity: identity,
+				},
+			},
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: run,
+				OnStoppedLeading: func() {
+					if ctx.Err() != nil {
+						return
+					}
+					// Another replica may be writing the Secrets already
+					logger.Log.Error("Leader election lost")
+					os.Exit(1)
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						logger.Log.Info(fmt.Sprintf("Waiting for leader %s", leader))
+					}
+				},
+			},
+			Name: leaseName,
+		})
+	},
+}
+
+// podNamespace returns the namespace of the pod the controller runs in, default outside of a cluster.
+func podNamespace() string {
+	if ns, err := os.ReadFile(SERVICE_ACCOUNT_NAMESPACE_FILE); err == nil && strings.TrimSpace(string(ns)) != "" {
+		return strings.TrimSpace(string(ns))
+	}
+	return metav1.NamespaceDefault
+}
+
+func init() {
+	rootcmd.RootCmd.AddCommand(controllerCmd)
+
+	controllerCmd.Flags().String("kubeconfig", "", "Kubeconfig of the cluster the Secrets are in, defaults to $KUBECONFIG, ~/.kube/config or in-cluster config (optional)")
+	controllerCmd.Flags().String("context", "", "Kubeconfig context of the cluster the Secrets are in, defaults to the current context (optional)")
+	controllerCmd.Flags().String("namespace", "", "Namespace of the managed Secrets, anyone able to create Secrets in it gets credentials of the controller identity (required)")
+	controllerCmd.Flags().Int("workers", 2, "Number of Secrets refreshed at once (optional)")
+	controllerCmd.Flags().Duration("refreshbefore", 10*time.Minute, "How long before the token expiry the Secret is written again (optional)")
+	controllerCmd.Flags().Bool("leaderelect", true, "Elect a leader among the controller replicas with a Lease (optional)")
+	controllerCmd.Flags().String("leaderelectionnamespace", "", "Namespace of the leader election Lease, defaults to the pod namespace (optional)")
+	controllerCmd.Flags().String("leaderelectionid", CONTROLLER_NAME, "Name of the leader election Lease (optional)")
+	rootcmd.AddPolicyFlag(controllerCmd.Flags())
+	controllerCmd.MarkFlagRequired("namespace")
+}
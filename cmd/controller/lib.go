@@ -0,0 +1,473 @@
+package controller
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// MANAGED_LABEL selects the Secrets kept fresh by the controller.
+	MANAGED_LABEL = "k8xauth.io/managed"
+	// TARGET_ANNOTATION is the target command name, e.g. eks.
+	TARGET_ANNOTATION = "k8xauth.io/target"
+	// ARGS_ANNOTATION is the JSON array of the target command flags.
+	ARGS_ANNOTATION = "k8xauth.io/args"
+	// SERVER_ANNOTATION is the cluster API server URL, discovered from the target cloud API if not set.
+	SERVER_ANNOTATION = "k8xauth.io/server"
+	// CA_DATA_ANNOTATION is the base64 encoded cluster CA certificate.
+	CA_DATA_ANNOTATION = "k8xauth.io/certificate-authority-data"
+	// FORMAT_ANNOTATION is the format of the Secret, kubeconfig or token.
+	FORMAT_ANNOTATION = "k8xauth.io/format"
+	// KEY_ANNOTATION is the Secret key the kubeconfig or token is written to.
+	KEY_ANNOTATION = "k8xauth.io/key"
+
+	// EXPIRY_ANNOTATION is the expiry of the written token, set by the controller.
+	EXPIRY_ANNOTATION = "k8xauth.io/expiry"
+	// SPEC_HASH_ANNOTATION is the hash of the annotations the token was written for, set by the controller.
+	SPEC_HASH_ANNOTATION = "k8xauth.io/spec-hash"
+	// CONDITIONS_ANNOTATION are the JSON encoded status conditions, set by the controller.
+	CONDITIONS_ANNOTATION = "k8xauth.io/conditions"
+
+	FORMAT_KUBECONFIG      = "kubeconfig"
+	FORMAT_TOKEN           = "token"
+	DEFAULT_KUBECONFIG_KEY = "value" // Flux and Cluster API kubeconfig Secret key
+	DEFAULT_TOKEN_KEY      = "token"
+	CA_KEY                 = "ca.crt"
+
+	CONDITION_READY = "Ready"
+
+	REASON_REFRESHED     = "TokenRefreshed"
+	REASON_INVALID_SPEC  = "InvalidSpec"
+	REASON_REFRESH_ERROR = "RefreshFailed"
+
+	CONTROLLER_NAME      = "k8xauth-controller"
+	MIN_REFRESH_INTERVAL = 10 * time.Second
+)
+
+// requestIDRegexp matches request identifiers of cloud API errors, e.g. "RequestID: 0123-abcd, " of AWS
+// errors and "Trace ID: 0123-abcd" of Azure errors.
+var requestIDRegexp = regexp.MustCompile(`(RequestID|Trace ID|Correlation ID): [^,\s]+,? ?`)
+
+// secretSpec is the target and the format of a managed Secret parsed from its annotations.
+type secretSpec struct {
+	target rootcmd.Target
+	flags  *pflag.FlagSet
+	server string
+	caData []byte
+	format string
+	key    string
+	hash   string
+}
+
+// parseSpec returns the spec of the managed Secret. Root command persistent flags configure the source
+// identity of the controller, annotations can't set them and they are copied from the process flags.
+func parseSpec(secret *corev1.Secret, processFlags *pflag.FlagSet) (*secretSpec, error) {
+	a := secret.Annotations
+
+	t, ok := rootcmd.LookupTarget(a[TARGET_ANNOTATION])
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q in %s annotation, supported targets are %s", a[TARGET_ANNOTATION], TARGET_ANNOTATION, strings.Join(rootcmd.TargetNames(), ", "))
+	}
+
+	var args []string
+	if v := a[ARGS_ANNOTATION]; v != "" {
+		if err := json.Unmarshal([]byte(v), &args); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation, expected JSON array of flags: %w", ARGS_ANNOTATION, err)
+		}
+	}
+
+	flags := t.NewFlagSet()
+	if t.DiscoveryFlags != nil {
+		t.DiscoveryFlags(flags)
+	}
+	if err := t.ParseRequestArgs(flags, args, processFlags); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", ARGS_ANNOTATION, err)
+	}
+
+	spec := &secretSpec{
+		target: t,
+		flags:  flags,
+		server: a[SERVER_ANNOTATION],
+		format: a[FORMAT_ANNOTATION],
+		key:    a[KEY_ANNOTATION],
+	}
+
+	if v := a[CA_DATA_ANNOTATION]; v != "" {
+		caData, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", CA_DATA_ANNOTATION, err)
+		}
+		spec.caData = caData
+	}
+
+	switch spec.format {
+	case "", FORMAT_KUBECONFIG:
+		spec.format = FORMAT_KUBECONFIG
+		if spec.key == "" {
+			spec.key = DEFAULT_KUBECONFIG_KEY
+		}
+		if spec.server == "" && t.Discover == nil {
+			return nil, fmt.Errorf("%s annotation is required, %s target doesn't discover clusters", SERVER_ANNOTATION, t.Name)
+		}
+	case FORMAT_TOKEN:
+		if spec.key == "" {
+			spec.key = DEFAULT_TOKEN_KEY
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q in %s annotation, supported formats are %s and %s", spec.format, FORMAT_ANNOTATION, FORMAT_KUBECONFIG, FORMAT_TOKEN)
+	}
+
+	h := sha256.New()
+	for _, name := range []string{TARGET_ANNOTATION, ARGS_ANNOTATION, SERVER_ANNOTATION, CA_DATA_ANNOTATION, FORMAT_ANNOTATION, KEY_ANNOTATION} {
+		fmt.Fprintf(h, "%s=%s\n", name, a[name])
+	}
+	spec.hash = hex.EncodeToString(h.Sum(nil))[:16]
+
+	return spec, nil
+}
+
+// specChanged reports whether the labels or the annotations other than the ones set by the controller
+// differ between the Secrets.
+func specChanged(old, secret *corev1.Secret) bool {
+	if !maps.Equal(old.Labels, secret.Labels) {
+		return true
+	}
+	return !maps.Equal(specAnnotations(old), specAnnotations(secret))
+}
+
+// specAnnotations returns the annotations of the Secret without the ones set by the controller.
+func specAnnotations(secret *corev1.Secret) map[string]string {
+	a := maps.Clone(secret.Annotations)
+	delete(a, EXPIRY_ANNOTATION)
+	delete(a, SPEC_HASH_ANNOTATION)
+	delete(a, CONDITIONS_ANNOTATION)
+	return a
+}
+
+// conditionMessage returns the message of the error without request identifiers, which change with
+// every attempt, so retries of the same failure don't update the Secret status.
+func conditionMessage(err error) string {
+	return strings.TrimSpace(requestIDRegexp.ReplaceAllString(err.Error(), ""))
+}
+
+// controller keeps the kubeconfig or token of the managed Secrets fresh, writing them again before
+// the token expires or when the Secret annotations change.
+type controller struct {
+	client   kubernetes.Interface
+	lister   corelisters.SecretLister
+	synced   toolscache.InformerSynced
+	queue    workqueue.TypedRateLimitingInterface[string]
+	recorder record.EventRecorder
+
+	// flags are the controller command flags, root command persistent flags being used by all Secrets.
+	flags *pflag.FlagSet
+	// tokenCache holds intermediate credentials shared by the Secrets, e.g. assumed AWS role credentials.
+	tokenCache *cache.Cache
+	// refreshBefore is how long before the token expiry it is written again.
+	refreshBefore time.Duration
+}
+
+// newController returns controller of the managed Secrets in the namespace.
+func newController(client kubernetes.Interface, namespace string, flags *pflag.FlagSet, tokenCache *cache.Cache, refreshBefore time.Duration) (*controller, informers.SharedInformerFactory) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 10*time.Minute,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = MANAGED_LABEL + "=true"
+		}),
+	)
+	secrets := factory.Core().V1().Secrets()
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	c := &controller{
+		client:   client,
+		lister:   secrets.Lister(),
+		synced:   secrets.Informer().HasSynced,
+		queue:    workqueue.NewTypedRateLimitingQueueWithConfig(workqueue.DefaultTypedControllerRateLimiter[string](), workqueue.TypedRateLimitingQueueConfig[string]{Name: CONTROLLER_NAME}),
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: CONTROLLER_NAME}),
+
+		flags:         flags,
+		tokenCache:    tokenCache,
+		refreshBefore: refreshBefore,
+	}
+
+	enqueue := func(obj any) {
+		if key, err := toolscache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			c.queue.Add(key)
+		}
+	}
+	secrets.Informer().AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj any) {
+			// Writes of the controller don't change the spec and aren't reconciled again, failures are
+			// only retried with backoff
+			if oldSecret, ok := old.(*corev1.Secret); ok {
+				if secret, ok := obj.(*corev1.Secret); ok && !specChanged(oldSecret, secret) {
+					return
+				}
+			}
+			enqueue(obj)
+		},
+	})
+
+	return c, factory
+}
+
+// run processes the managed Secrets with the workers until the context is done.
+func (c *controller) run(ctx context.Context, workers int) error {
+	defer c.queue.ShutDown()
+
+	if !toolscache.WaitForCacheSync(ctx.Done(), c.synced) {
+		return errors.New("couldn't sync Secret informer")
+	}
+
+	logger.Log.Info(fmt.Sprintf("Keeping managed Secrets fresh with %d workers", workers))
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (c *controller) worker(ctx context.Context) {
+	for c.processNext(ctx) {
+	}
+}
+
+// processNext reconciles the next Secret of the queue, retrying it with backoff when it fails.
+func (c *controller) processNext(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	requeueAfter, err := c.reconcile(ctx, key)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Couldn't refresh Secret %s: %s", key, err.Error()))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	if requeueAfter > 0 {
+		c.queue.AddAfter(key, requeueAfter)
+	}
+	return true
+}
+
+// reconcile writes the kubeconfig or token of the Secret if it is about to expire or the Secret
+// annotations changed, and returns when the Secret has to be reconciled again.
+func (c *controller) reconcile(ctx context.Context, key string) (time.Duration, error) {
+	namespace, name, err := toolscache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0, nil
+	}
+
+	secret, err := c.lister.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	spec, err := parseSpec(secret, c.flags)
+	if err != nil {
+		// Not retried, the Secret is reconciled again when its annotations are fixed
+		c.recorder.Event(secret, corev1.EventTypeWarning, REASON_INVALID_SPEC, err.Error())
+		return 0, c.updateStatus(ctx, secret, metav1.ConditionFalse, REASON_INVALID_SPEC, err.Error())
+	}
+
+	if after := c.refreshIn(secret, spec); after > 0 {
+		return after, nil
+	}
+
+	expiry, err := c.write(ctx, secret, spec)
+	if err != nil {
+		message := conditionMessage(err)
+		c.recorder.Event(secret, corev1.EventTypeWarning, REASON_REFRESH_ERROR, message)
+		if statusErr := c.updateStatus(ctx, secret, metav1.ConditionFalse, REASON_REFRESH_ERROR, message); statusErr != nil {
+			logger.Log.Error(fmt.Sprintf("Couldn't update status of Secret %s: %s", key, statusErr.Error()))
+		}
+		return 0, err
+	}
+
+	logger.Log.Info(fmt.Sprintf("Secret %s refreshed, token expires at %s", key, expiry.Format(time.RFC3339)))
+	return max(c.refreshWait(expiry), MIN_REFRESH_INTERVAL), nil
+}
+
+// refreshIn returns how long until the Secret token has to be written again, zero if it has to be
+// written now. Tokens without expiry are written again every refresh before period.
+func (c *controller) refreshIn(secret *corev1.Secret, spec *secretSpec) time.Duration {
+	if secret.Annotations[SPEC_HASH_ANNOTATION] != spec.hash {
+		return 0
+	}
+
+	expiry, err := time.Parse(time.RFC3339, secret.Annotations[EXPIRY_ANNOTATION])
+	if err != nil {
+		return 0
+	}
+
+	return c.refreshWait(expiry)
+}
+
+// refreshWait returns how long until the token with the expiry has to be written again, zero if now.
+func (c *controller) refreshWait(expiry time.Time) time.Duration {
+	if expiry.IsZero() {
+		return c.refreshBefore
+	}
+	after := time.Until(expiry) - c.refreshBefore
+	if after <= 0 {
+		return 0
+	}
+	return max(after, MIN_REFRESH_INTERVAL)
+}
+
+// write retrieves the target token and writes the kubeconfig or token to the Secret with the Ready
+// condition, returning the token expiry.
+func (c *controller) write(ctx context.Context, secret *corev1.Secret, spec *secretSpec) (time.Time, error) {
+	options, err := rootcmd.FlagsAuthOptions(spec.flags, spec.server)
+	if err != nil {
+		return time.Time{}, err
+	}
+	options.Cache = c.tokenCache
+
+	server, caData := spec.server, spec.caData
+	if spec.format == FORMAT_KUBECONFIG && server == "" {
+		cluster, err := spec.target.Discover(spec.flags, &options)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("couldn't discover %s cluster: %w", spec.target.Name, err)
+		}
+		server, caData = cluster.Server, cluster.CertificateAuthorityData
+		options.ClusterServer = server
+	}
+
+	token, err := spec.target.Token(spec.flags, &options)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	data, err := secretData(secret, spec, server, caData, token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	updated := secret.DeepCopy()
+	updated.Data = data
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[SPEC_HASH_ANNOTATION] = spec.hash
+	updated.Annotations[EXPIRY_ANNOTATION] = token.Expiry.UTC().Format(time.RFC3339)
+	if err := setCondition(updated, metav1.ConditionTrue, REASON_REFRESHED, fmt.Sprintf("Token expires at %s", token.Expiry.UTC().Format(time.RFC3339))); err != nil {
+		return time.Time{}, err
+	}
+
+	if _, err := c.client.CoreV1().Secrets(secret.Namespace).Update(ctx, updated, metav1.UpdateOptions{FieldManager: CONTROLLER_NAME}); err != nil {
+		return time.Time{}, err
+	}
+
+	return token.Expiry, nil
+}
+
+// secretData returns the Secret data with the kubeconfig or token, keeping other keys of the Secret.
+func secretData(secret *corev1.Secret, spec *secretSpec, server string, caData []byte, token *oauth2.Token) (map[string][]byte, error) {
+	data := make(map[string][]byte, len(secret.Data)+2)
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+
+	if spec.format == FORMAT_TOKEN {
+		data[spec.key] = []byte(token.AccessToken)
+		if len(caData) > 0 {
+			data[CA_KEY] = caData
+		}
+		return data, nil
+	}
+
+	config, err := kubeconfig.WithToken(kubeconfig.Cluster{
+		Name:                     secret.Name,
+		Server:                   server,
+		CertificateAuthorityData: caData,
+	}, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	data[spec.key] = config
+
+	return data, nil
+}
+
+// updateStatus sets the Ready condition of the Secret, if it changed.
+func (c *controller) updateStatus(ctx context.Context, secret *corev1.Secret, status metav1.ConditionStatus, reason, message string) error {
+	updated := secret.DeepCopy()
+	if err := setCondition(updated, status, reason, message); err != nil {
+		return err
+	}
+	if updated.Annotations[CONDITIONS_ANNOTATION] == secret.Annotations[CONDITIONS_ANNOTATION] {
+		return nil
+	}
+
+	_, err := c.client.CoreV1().Secrets(secret.Namespace).Update(ctx, updated, metav1.UpdateOptions{FieldManager: CONTROLLER_NAME})
+	return err
+}
+
+// setCondition sets the Ready condition in the conditions annotation of the Secret.
+func setCondition(secret *corev1.Secret, status metav1.ConditionStatus, reason, message string) error {
+	var conditions []metav1.Condition
+	if v := secret.Annotations[CONDITIONS_ANNOTATION]; v != "" {
+		// Conditions that can't be parsed are replaced
+		json.Unmarshal([]byte(v), &conditions)
+	}
+
+	meta.SetStatusCondition(&conditions, metav1.Condition{
+		Type:               CONDITION_READY,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: secret.Generation,
+	})
+
+	v, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[CONDITIONS_ANNOTATION] = string(v)
+	return nil
+}
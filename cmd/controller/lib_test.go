@@ -0,0 +1,332 @@
+package controller
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/testutil"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const testNamespace = "flux-system"
+
+// fakeTarget retrieves the tokens of the test target.
+var fakeTarget = &testutil.Target{}
+
+// testTarget returns tokens of the --cluster flag valid for --lifetime, failing with --fail.
+var testTarget = rootcmd.Target{
+	Name:     "controllertest",
+	Flags:    fakeTarget.Flags,
+	Required: []string{"cluster"},
+	Token:    fakeTarget.Token,
+	Discover: fakeTarget.Discover,
+}
+
+func init() {
+	rootcmd.RegisterTarget(&cobra.Command{Use: testTarget.Name}, testTarget)
+}
+
+// managedSecret returns a managed Secret of the test target with the args annotation.
+func managedSecret(args string, annotations map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "prod-kubeconfig",
+			Namespace: testNamespace,
+			Labels:    map[string]string{MANAGED_LABEL: "true"},
+			Annotations: map[string]string{
+				TARGET_ANNOTATION: testTarget.Name,
+				ARGS_ANNOTATION:   args,
+			},
+		},
+		Data: map[string][]byte{"other": []byte("kept")},
+	}
+	for k, v := range annotations {
+		secret.Annotations[k] = v
+	}
+	return secret
+}
+
+// testController returns a controller of the Secrets with synced informers, running with --authsource eks.
+func testController(t *testing.T, secrets ...*corev1.Secret) (*controller, *fake.Clientset) {
+	t.Helper()
+
+	var objects []runtime.Object
+	for _, s := range secrets {
+		objects = append(objects, s)
+	}
+	client := fake.NewClientset(objects...)
+
+	flags := rootcmd.Target{Name: "controller", Flags: func(*pflag.FlagSet) {}}.NewFlagSet()
+	if err := flags.Set("authsource", "eks"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, factory := newController(client, testNamespace, flags, cache.NewMemory(time.Minute, ""), 10*time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	return c, client
+}
+
+// getSecret returns the Secret from the API.
+func getSecret(t *testing.T, c *controller) *corev1.Secret {
+	t.Helper()
+	secret, err := c.client.CoreV1().Secrets(testNamespace).Get(context.Background(), "prod-kubeconfig", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// waitForLister waits for the informer to observe the Secret annotations, the fake clientset doesn't set
+// resource versions.
+func waitForLister(t *testing.T, c *controller, secret *corev1.Secret) {
+	t.Helper()
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		cached, err := c.lister.Secrets(secret.Namespace).Get(secret.Name)
+		return err == nil && maps.Equal(cached.Annotations, secret.Annotations), nil
+	})
+	if err != nil {
+		t.Fatalf("informer didn't observe Secret update: %v", err)
+	}
+}
+
+// updateSecret updates the Secret and waits for the informer to observe it.
+func updateSecret(t *testing.T, c *controller, secret *corev1.Secret) {
+	t.Helper()
+	updated, err := c.client.CoreV1().Secrets(secret.Namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLister(t, c, updated)
+}
+
+// readyCondition returns the Ready condition of the Secret.
+func readyCondition(t *testing.T, secret *corev1.Secret) metav1.Condition {
+	t.Helper()
+	var conditions []metav1.Condition
+	if err := json.Unmarshal([]byte(secret.Annotations[CONDITIONS_ANNOTATION]), &conditions); err != nil {
+		t.Fatalf("invalid conditions annotation: %v", err)
+	}
+	ready := meta.FindStatusCondition(conditions, CONDITION_READY)
+	if ready == nil {
+		t.Fatal("no Ready condition")
+	}
+	return *ready
+}
+
+// secretToken returns the token of the kubeconfig written to the Secret.
+func secretToken(t *testing.T, secret *corev1.Secret) string {
+	t.Helper()
+	config, err := clientcmd.Load(secret.Data[DEFAULT_KUBECONFIG_KEY])
+	if err != nil {
+		t.Fatalf("invalid kubeconfig: %v", err)
+	}
+	for _, user := range config.AuthInfos {
+		return user.Token
+	}
+	t.Fatal("no user in kubeconfig")
+	return ""
+}
+
+func TestReconcileCreate(t *testing.T) {
+	c, _ := testController(t, managedSecret(`["--cluster=prod eu", "--lifetime=1h"]`, nil))
+	key := testNamespace + "/prod-kubeconfig"
+
+	requeueAfter, err := c.reconcile(context.Background(), key)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Token valid for 1h is written again 10m before expiry
+	if requeueAfter < 49*time.Minute || requeueAfter > 50*time.Minute {
+		t.Errorf("requeue after %s, want 50m", requeueAfter)
+	}
+
+	secret := getSecret(t, c)
+	// Values with spaces are kept and the controller source configuration is used
+	if token := secretToken(t, secret); !strings.HasPrefix(token, "eks/prod eu/") {
+		t.Errorf("token = %q, want token of eks source for cluster prod eu", token)
+	}
+	config, _ := clientcmd.Load(secret.Data[DEFAULT_KUBECONFIG_KEY])
+	for _, cluster := range config.Clusters {
+		if cluster.Server != "https://api.example.com" {
+			t.Errorf("server = %q, want discovered server", cluster.Server)
+		}
+	}
+	if string(secret.Data["other"]) != "kept" {
+		t.Error("other Secret keys not kept")
+	}
+	if secret.Annotations[SPEC_HASH_ANNOTATION] == "" || secret.Annotations[EXPIRY_ANNOTATION] == "" {
+		t.Errorf("spec hash and expiry annotations not set: %v", secret.Annotations)
+	}
+	if ready := readyCondition(t, secret); ready.Status != metav1.ConditionTrue || ready.Reason != REASON_REFRESHED {
+		t.Errorf("Ready = %s %s, want True %s", ready.Status, ready.Reason, REASON_REFRESHED)
+	}
+}
+
+func TestReconcileRefreshBeforeExpiry(t *testing.T) {
+	c, _ := testController(t, managedSecret(`["--cluster=prod"]`, map[string]string{FORMAT_ANNOTATION: FORMAT_TOKEN, SERVER_ANNOTATION: "https://api.example.com"}))
+	key := testNamespace + "/prod-kubeconfig"
+
+	if _, err := c.reconcile(context.Background(), key); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	secret := getSecret(t, c)
+	waitForLister(t, c, secret)
+	written := string(secret.Data[DEFAULT_TOKEN_KEY])
+
+	// Fresh token isn't written again
+	tokens := fakeTarget.Tokens
+	requeueAfter, err := c.reconcile(context.Background(), key)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if fakeTarget.Tokens != tokens || requeueAfter <= 0 {
+		t.Errorf("fresh token retrieved again (%d tokens), requeue after %s", fakeTarget.Tokens-tokens, requeueAfter)
+	}
+
+	// Token expiring within the refresh before period is written again
+	secret.Annotations[EXPIRY_ANNOTATION] = time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	updateSecret(t, c, secret)
+	if _, err := c.reconcile(context.Background(), key); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	secret = getSecret(t, c)
+	if fakeTarget.Tokens != tokens+1 || string(secret.Data[DEFAULT_TOKEN_KEY]) == written {
+		t.Errorf("expiring token not written again")
+	}
+	waitForLister(t, c, secret)
+
+	// Changed annotations are written again
+	written = string(secret.Data[DEFAULT_TOKEN_KEY])
+	secret.Annotations[ARGS_ANNOTATION] = `["--cluster=staging"]`
+	updateSecret(t, c, secret)
+	if _, err := c.reconcile(context.Background(), key); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if token := string(getSecret(t, c).Data[DEFAULT_TOKEN_KEY]); token == written || !strings.HasPrefix(token, "eks/staging/") {
+		t.Errorf("token = %q, want staging token after args change", token)
+	}
+}
+
+func TestReconcileInvalidSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "unknown target", args: `["--cluster=prod"]`, annotations: map[string]string{TARGET_ANNOTATION: "unknown"}, want: "unknown target"},
+		{name: "whitespace separated args", args: `--cluster=prod`, want: "expected JSON array"},
+		{name: "missing required flag", args: `[]`, want: "required flag --cluster"},
+		{name: "root flag", args: `["--cluster=prod", "--authsource=file"]`, want: "--authsource can't be set"},
+		{name: "policy file", args: `["--cluster=prod", "--policyfile="]`, want: "unknown flag: --policyfile"},
+		{name: "positional argument", args: `["--cluster=prod", "extra"]`, want: "unexpected arguments"},
+		{name: "unsupported format", args: `["--cluster=prod"]`, annotations: map[string]string{FORMAT_ANNOTATION: "yaml"}, want: "unsupported format"},
+		{name: "invalid CA", args: `["--cluster=prod"]`, annotations: map[string]string{CA_DATA_ANNOTATION: "not base64!"}, want: CA_DATA_ANNOTATION},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testController(t, managedSecret(tt.args, tt.annotations))
+			tokens := fakeTarget.Tokens
+
+			// Invalid specs aren't retried until the annotations change
+			requeueAfter, err := c.reconcile(context.Background(), testNamespace+"/prod-kubeconfig")
+			if err != nil || requeueAfter != 0 {
+				t.Fatalf("reconcile = %s, %v, want no retry", requeueAfter, err)
+			}
+			if fakeTarget.Tokens != tokens {
+				t.Error("token retrieved for invalid spec")
+			}
+
+			ready := readyCondition(t, getSecret(t, c))
+			if ready.Status != metav1.ConditionFalse || ready.Reason != REASON_INVALID_SPEC || !strings.Contains(ready.Message, tt.want) {
+				t.Errorf("Ready = %s %s %q, want False %s containing %q", ready.Status, ready.Reason, ready.Message, REASON_INVALID_SPEC, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileFailure(t *testing.T) {
+	c, _ := testController(t, managedSecret(`["--cluster=prod", "--fail"]`, nil))
+
+	// Failures are retried with backoff
+	if _, err := c.reconcile(context.Background(), testNamespace+"/prod-kubeconfig"); err == nil {
+		t.Fatal("reconcile didn't fail")
+	}
+
+	secret := getSecret(t, c)
+	if _, ok := secret.Data[DEFAULT_KUBECONFIG_KEY]; ok {
+		t.Error("kubeconfig written despite failure")
+	}
+	ready := readyCondition(t, secret)
+	if ready.Status != metav1.ConditionFalse || ready.Reason != REASON_REFRESH_ERROR || !strings.Contains(ready.Message, "access denied") {
+		t.Errorf("Ready = %s %s %q, want False %s with the error", ready.Status, ready.Reason, ready.Message, REASON_REFRESH_ERROR)
+	}
+}
+
+func TestStatusUpdateNotQueued(t *testing.T) {
+	c, _ := testController(t, managedSecret(`["--cluster=prod", "--fail"]`, nil))
+	key := testNamespace + "/prod-kubeconfig"
+
+	// Drain the key queued when the Secret was added
+	if queued, _ := c.queue.Get(); queued != key {
+		t.Fatalf("queued %q, want %q", queued, key)
+	}
+	c.queue.Forget(key)
+	c.queue.Done(key)
+
+	if _, err := c.reconcile(context.Background(), key); err == nil {
+		t.Fatal("reconcile didn't fail")
+	}
+	waitForLister(t, c, getSecret(t, c))
+	if n := c.queue.Len(); n != 0 {
+		t.Errorf("status update queued %d keys, want retries with backoff only", n)
+	}
+
+	// Spec changes are reconciled right away
+	secret := getSecret(t, c)
+	secret.Annotations[ARGS_ANNOTATION] = `["--cluster=prod"]`
+	updateSecret(t, c, secret)
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return c.queue.Len() == 1, nil
+	})
+	if err != nil {
+		t.Errorf("spec update queued %d keys, want 1", c.queue.Len())
+	}
+}
+
+func TestConditionMessage(t *testing.T) {
+	err := errors.New("operation error STS: AssumeRoleWithWebIdentity, https response error StatusCode: 403, RequestID: 4a8c2f1e-0000-4b6d-9c1e-7f3a5b2d8e90, api error AccessDenied: Not authorized")
+	want := "operation error STS: AssumeRoleWithWebIdentity, https response error StatusCode: 403, api error AccessDenied: Not authorized"
+	if got := conditionMessage(err); got != want {
+		t.Errorf("conditionMessage = %q, want %q", got, want)
+	}
+}
+
+func TestReconcileDeleted(t *testing.T) {
+	c, _ := testController(t)
+
+	if requeueAfter, err := c.reconcile(context.Background(), testNamespace+"/deleted"); err != nil || requeueAfter != 0 {
+		t.Errorf("reconcile of deleted Secret = %s, %v, want nothing to do", requeueAfter, err)
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/logger"
+
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// DiscoverCmd represents the discover command, with a subcommand for every target listing its clusters.
+var DiscoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Lists clusters in target cloud accounts, projects and subscriptions",
+	Long: `Lists clusters with the federated credentials in the target cloud API, EKS clusters
+across roles and regions, GKE clusters across projects and locations and AKS clusters
+across subscriptions, concurrently. Writes an inventory of the clusters with their
+endpoint, CA, tags or labels and the k8xauth arguments authenticating with them, in
+the same format for all clouds`,
+	Example: `k8xauth discover eks --rolearns "arn:aws:iam::123456789012:role/argocd,arn:aws:iam::210987654321:role/argocd" --regions "us-east-1,eu-west-1" --filter "argocd=enabled"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// runDiscover writes the inventory of clusters listed by the target.
+func runDiscover(cmd *cobra.Command, t Target) {
+	output, _ := cmd.Flags().GetString("output")
+	filter, _ := cmd.Flags().GetStringToString("filter")
+
+	if output != "yaml" && output != "json" {
+		logger.Log.Error(fmt.Sprintf("Unsupported output %q, supported outputs are yaml and json", output))
+		os.Exit(1)
+	}
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	listed, errs := t.List(cmd.Flags(), &options)
+	for _, err := range errs {
+		logger.Log.Error(fmt.Sprintf("Couldn't list %s clusters: %s", t.Name, err.Error()))
+	}
+
+	clusters := []inventory.Cluster{}
+	for _, c := range listed {
+		if !c.Matches(filter) {
+			continue
+		}
+		c.Args = execArgs(cmd.Flags(), t, c.Flags)
+		clusters = append(clusters, c)
+	}
+	inventory.Sort(clusters)
+
+	var data []byte
+	if output == "json" {
+		data, err = json.MarshalIndent(clusters, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(clusters)
+	}
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	os.Stdout.Write(data)
+
+	// Clusters of the listed accounts and locations are written, failures are reported in exit code
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(DiscoverCmd)
+	addListRunner(DiscoverCmd, runDiscover)
+
+	DiscoverCmd.PersistentFlags().StringP("output", "o", "yaml", "Output format of the inventory [yaml|json] (optional)")
+	DiscoverCmd.PersistentFlags().StringToString("filter", map[string]string{}, "Only list clusters with the tag or label in the form key=value, * matches any value, may be repeated (optional)")
+	DiscoverCmd.PersistentFlags().Int("concurrency", 8, "Number of accounts, projects, subscriptions and locations listed at once (optional)")
+}
@@ -1,42 +1,142 @@
 package eks
 
 import (
-	"k8xauth/cmd"
+	rootcmd "k8xauth/cmd"
 	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+
+	"errors"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
 )
 
 // eksCmd represents the eks command
 var eksCmd = &cobra.Command{
 	Use:   "eks",
 	Short: "Fetches AWS EKS cluster credentials",
-	Long: `Fetches AWS EKS cluster credentials from GKE or AKS Workload Identity
+	Long: `Fetches AWS EKS cluster credentials from GKE or AKS Workload Identity or EKS IRSA
 
 This is useful for cases where  Kubernetes client is running in GKE or AKS cluster
-and needs to manage external AWS EKS cluster(s)`,
+and needs to manage external AWS EKS cluster(s), or is running in EKS cluster
+and needs to manage EKS cluster(s) in other accounts`,
 	Example: `k8xauth eks --rolearn "arn:aws:iam::123456789012:role/argocd-platform" --stsregion "us-east-2" --cluster "my-cluster-name"`,
 	Run: func(cmd *cobra.Command, args []string) {
+		rootcmd.WriteCredentials(cmd, eksTarget)
+	},
+}
 
-		rolearn, _ := cmd.Flags().GetString("rolearn")
-		cluster, _ := cmd.Flags().GetString("cluster")
-		stsregion, _ := cmd.Flags().GetString("stsregion")
+// eksTarget retrieves EKS cluster credentials
+var eksTarget = rootcmd.Target{
+	Name: "eks",
+	Flags: func(fs *pflag.FlagSet) {
+		fs.StringP("rolearn", "r", "", "AWS role ARN to assume (required)")
+		fs.StringP("cluster", "c", "", "AWS EKS cluster name for which we fetch credentials (required)")
+		fs.StringP("stsregion", "s", "us-east-1", "AWS STS region to which requests are made (optional)")
+	},
+	Required: []string{"rolearn", "cluster"},
+	Token: func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		rolearn, _ := flags.GetString("rolearn")
+		cluster, _ := flags.GetString("cluster")
+		stsregion, _ := flags.GetString("stsregion")
+
+		return getToken(o, rolearn, tokenOptions{
+			clusterID:      cluster,
+			stsRegion:      stsregion,
+			presignExpires: requestPresignParam,
+		})
+	},
+	DiscoveryFlags: func(fs *pflag.FlagSet) {
+		fs.String("region", "", "AWS region of the EKS cluster, defaults to --stsregion (optional)")
+	},
+	Discover: func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+		rolearn, _ := flags.GetString("rolearn")
+		cluster, _ := flags.GetString("cluster")
+		stsregion, _ := flags.GetString("stsregion")
+		region, _ := flags.GetString("region")
 
-		options := auth.Options{
-			AuthType:         cmd.Flag("authsource").Value.String(),
-			PrintSourceToken: cmd.Flag("printsourceauthtoken").Value.String() == "true",
+		if region == "" {
+			region = stsregion
+		}
+
+		return describeCluster(o, rolearn, stsregion, region, cluster)
+	},
+	ListFlags: func(fs *pflag.FlagSet) {
+		fs.StringSlice("rolearns", []string{}, "AWS role ARNs to list clusters with, defaults to --rolearn (optional)")
+		fs.StringSlice("regions", []string{}, "AWS regions to list clusters in, defaults to --stsregion (optional)")
+	},
+	List: func(flags *pflag.FlagSet, o *auth.Options) ([]inventory.Cluster, []error) {
+		rolearn, _ := flags.GetString("rolearn")
+		stsregion, _ := flags.GetString("stsregion")
+		rolearns, _ := flags.GetStringSlice("rolearns")
+		regions, _ := flags.GetStringSlice("regions")
+		concurrency, _ := flags.GetInt("concurrency")
+
+		if len(rolearns) == 0 {
+			if rolearn == "" {
+				return nil, []error{errors.New("--rolearn or --rolearns is required")}
+			}
+			rolearns = []string{rolearn}
+		}
+		if len(regions) == 0 {
+			regions = []string{stsregion}
 		}
 
-		getCredentials(&options, rolearn, cluster, stsregion)
+		return listClusters(o, rolearns, stsregion, regions, concurrency)
 	},
 }
 
-func init() {
-	cmd.RootCmd.AddCommand(eksCmd)
+// awsIamCmd represents the awsiam command
+var awsIamCmd = &cobra.Command{
+	Use:   "awsiam",
+	Short: "Fetches credentials for clusters using self-managed aws-iam-authenticator",
+	Long: `Fetches credentials for Kubernetes clusters authenticating with a self-managed
+aws-iam-authenticator (kops, EKS Anywhere, ...) from GKE or AKS Workload Identity
+
+Unlike the eks command the cluster ID, STS endpoint, additional signed headers and
+the X-Amz-Expires value can be set to match the aws-iam-authenticator server configuration
+
+Only k8s-aws-v1. tokens are generated, the only token format aws-iam-authenticator
+servers verify`,
+	Example: `k8xauth awsiam --rolearn "arn:aws:iam::123456789012:role/argocd-platform" --clusterid "my-kops-cluster.example.com" --stsregion "eu-west-1" --stsendpoint "https://sts.eu-west-1.amazonaws.com"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rootcmd.WriteCredentials(cmd, awsIamTarget)
+	},
+}
 
-	eksCmd.Flags().StringP("rolearn", "r", "", "AWS role ARN to assume (required)")
-	eksCmd.Flags().StringP("cluster", "c", "", "AWS EKS cluster name for which we fetch credentials (required)")
-	eksCmd.Flags().StringP("stsregion", "s", "us-east-1", "AWS STS region to which requests are made (optional)")
-	eksCmd.MarkFlagRequired("rolearn")
-	eksCmd.MarkFlagRequired("cluster")
+// awsIamTarget retrieves credentials of clusters using self-managed aws-iam-authenticator
+var awsIamTarget = rootcmd.Target{
+	Name: "awsiam",
+	Flags: func(fs *pflag.FlagSet) {
+		fs.StringP("rolearn", "r", "", "AWS role ARN to assume (required)")
+		fs.StringP("clusterid", "c", "", "Cluster ID configured in aws-iam-authenticator, sent as x-k8s-aws-id header (required)")
+		fs.StringP("stsregion", "s", "us-east-1", "AWS STS region to which requests are made (optional)")
+		fs.String("stsendpoint", "", "AWS STS endpoint the token is presigned for, if not set the regional default is used (optional)")
+		fs.StringToString("header", map[string]string{}, "Additional header to sign into the token in the form key=value, may be repeated (optional)")
+		fs.Int("presignexpires", requestPresignParam, "X-Amz-Expires value in seconds of the presigned STS request, STS accepts the request for 15 minutes regardless (optional)")
+	},
+	Required: []string{"rolearn", "clusterid"},
+	Token: func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		rolearn, _ := flags.GetString("rolearn")
+		clusterID, _ := flags.GetString("clusterid")
+		stsregion, _ := flags.GetString("stsregion")
+		stsendpoint, _ := flags.GetString("stsendpoint")
+		headers, _ := flags.GetStringToString("header")
+		presignExpires, _ := flags.GetInt("presignexpires")
+
+		return getToken(o, rolearn, tokenOptions{
+			clusterID:      clusterID,
+			stsRegion:      stsregion,
+			stsEndpoint:    stsendpoint,
+			headers:        headers,
+			presignExpires: presignExpires,
+		})
+	},
+}
+
+func init() {
+	rootcmd.RegisterTarget(eksCmd, eksTarget)
+	rootcmd.RegisterTarget(awsIamCmd, awsIamTarget)
 }
@@ -0,0 +1,165 @@
+package eks
+
+import (
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/eks/types"
+)
+
+// listScope is a role and region EKS clusters are listed in.
+type listScope struct {
+	roleArn string
+	region  string
+}
+
+// newEKSClient returns EKS client of the region using the assumed role credentials.
+func newEKSClient(ctx context.Context, o *auth.Options, awsAssumeRoleArn, stsRegion, region string) (*eks.Client, error) {
+	awsCredentials, err := awsCredentials(ctx, o, awsAssumeRoleArn, stsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	eksCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region),
+		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
+			Value: awsCredentials,
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load AWS config using retrieved credentials: %w", err)
+	}
+
+	return eks.NewFromConfig(eksCfg), nil
+}
+
+// clusterCAData returns the decoded certificate authority data of the described EKS cluster.
+func clusterCAData(cluster *types.Cluster) ([]byte, error) {
+	if cluster.Endpoint == nil || cluster.CertificateAuthority == nil || cluster.CertificateAuthority.Data == nil {
+		return nil, fmt.Errorf("EKS cluster %s has no endpoint yet (status %s)", aws.ToString(cluster.Name), cluster.Status)
+	}
+
+	caData, err := base64.StdEncoding.DecodeString(aws.ToString(cluster.CertificateAuthority.Data))
+	if err != nil {
+		return nil, errors.New("couldn't decode EKS cluster certificate authority data")
+	}
+
+	return caData, nil
+}
+
+// describeCluster returns the API server endpoint and CA of the EKS cluster retrieved by DescribeCluster
+// with the assumed role credentials.
+func describeCluster(o *auth.Options, awsAssumeRoleArn, stsRegion, region, clusterName string) (*kubeconfig.Cluster, error) {
+	ctx := context.Background()
+
+	client, err := newEKSClient(ctx, o, awsAssumeRoleArn, stsRegion, region)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.DescribeCluster(ctx, &eks.DescribeClusterInput{
+		Name: aws.String(clusterName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe EKS cluster %s: %w", clusterName, err)
+	}
+
+	caData, err := clusterCAData(out.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeconfig.Cluster{
+		// Same name as aws eks update-kubeconfig
+		Name:                     aws.ToString(out.Cluster.Arn),
+		Server:                   aws.ToString(out.Cluster.Endpoint),
+		CertificateAuthorityData: caData,
+	}, nil
+}
+
+// listClusters lists EKS clusters of the regions with every role, scopes are listed concurrently.
+func listClusters(o *auth.Options, roleArns []string, stsRegion string, regions []string, concurrency int) ([]inventory.Cluster, []error) {
+	var scopes []listScope
+	for _, roleArn := range roleArns {
+		for _, region := range regions {
+			scopes = append(scopes, listScope{roleArn: roleArn, region: region})
+		}
+	}
+
+	return inventory.ForEach(scopes, concurrency, func(s listScope) ([]inventory.Cluster, error) {
+		clusters, err := listRegionClusters(o, s.roleArn, stsRegion, s.region)
+		if err != nil {
+			return clusters, fmt.Errorf("%s in %s: %w", s.roleArn, s.region, err)
+		}
+		return clusters, nil
+	})
+}
+
+// listRegionClusters lists EKS clusters of the region with the assumed role credentials.
+func listRegionClusters(o *auth.Options, awsAssumeRoleArn, stsRegion, region string) ([]inventory.Cluster, error) {
+	ctx := context.Background()
+
+	client, err := newEKSClient(ctx, o, awsAssumeRoleArn, stsRegion, region)
+	if err != nil {
+		return nil, err
+	}
+
+	var clusters []inventory.Cluster
+	paginator := eks.NewListClustersPaginator(client, &eks.ListClustersInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return clusters, fmt.Errorf("couldn't list EKS clusters: %w", err)
+		}
+
+		for _, name := range page.Clusters {
+			out, err := client.DescribeCluster(ctx, &eks.DescribeClusterInput{
+				Name: aws.String(name),
+			})
+			if err != nil {
+				return clusters, fmt.Errorf("couldn't describe EKS cluster %s: %w", name, err)
+			}
+
+			caData, err := clusterCAData(out.Cluster)
+			if err != nil {
+				logger.Log.Debug("Skipping " + err.Error())
+				continue
+			}
+
+			clusterArn := aws.ToString(out.Cluster.Arn)
+			var account string
+			if a, err := arn.Parse(clusterArn); err == nil {
+				account = a.AccountID
+			}
+
+			clusters = append(clusters, inventory.Cluster{
+				Name:     name,
+				Cloud:    inventory.CLOUD_AWS,
+				ID:       clusterArn,
+				Account:  account,
+				Location: region,
+				Endpoint: aws.ToString(out.Cluster.Endpoint),
+				CAData:   caData,
+				Labels:   out.Cluster.Tags,
+				Flags: map[string]string{
+					"rolearn":   awsAssumeRoleArn,
+					"cluster":   name,
+					"stsregion": region,
+				},
+			})
+		}
+	}
+
+	return clusters, nil
+}
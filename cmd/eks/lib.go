@@ -3,13 +3,13 @@ package eks
 import (
 	"fmt"
 	auth "k8xauth/internal/auth"
-	"k8xauth/internal/credwriter"
-	"k8xauth/internal/logger"
+	"k8xauth/internal/cache"
 
 	"context"
 	"encoding/base64"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -24,22 +24,54 @@ import (
 const (
 	eksClusterIdHeader = "x-k8s-aws-id" // Header name identifying EKS cluser in STS getCallerIdentity call
 	// The sts GetCallerIdentity request is valid for 15 minutes regardless of this parameters value after it has been
-	// signed, but we set this unused parameter to 60 for legacy reasons (we check for a value between 0 and 60 on the
-	// server side in 0.3.0 or earlier).  IT IS IGNORED.  If we can get STS to support x-amz-expires, then we should
-	// set this parameter to the actual expiration, and make it configurable.
+	// signed, but it is set to 60 by default for legacy reasons (aws-iam-authenticator 0.3.0 or earlier checks for a
+	// value between 0 and 60 on the server side). It can be set for authenticator deployments checking other values.
 	requestPresignParam    = 60
+	maxRequestPresignParam = 900
 	presignedURLExpiration = 15 * time.Minute // The actual token expiration (presigned STS urls are valid for 15 minutes after timestamp in x-amz-date).
-	tokenV1Prefix          = "k8s-aws-v1."    // Prefix of a token in client.authentication.k8s.io/v1beta1 ExecCredential
+	tokenPrefix            = "k8s-aws-v1."    // Prefix of a token in client.authentication.k8s.io/v1beta1 ExecCredential
 )
 
-func getCredentials(o *auth.Options, awsAssumeRoleArn, eksClusterName, stsRegion string) {
+// tokenOptions describes the presigned STS GetCallerIdentity request embedded in the token
+// and the way the token is formatted for the verifying aws-iam-authenticator.
+type tokenOptions struct {
+	// clusterID is the value of the x-k8s-aws-id header, the EKS cluster name or the
+	// cluster ID configured in a self-managed aws-iam-authenticator.
+	clusterID string
+	// stsRegion is the region of the STS endpoint used for signing.
+	stsRegion string
+	// stsEndpoint optionally overrides the STS endpoint the token is presigned for.
+	stsEndpoint string
+	// headers are additional headers signed into the presigned request.
+	headers map[string]string
+	// presignExpires is the X-Amz-Expires value of the presigned request in seconds.
+	presignExpires int
+}
 
-	ctx := context.Background()
+// validate checks the token options before any request is made.
+func (t tokenOptions) validate() error {
+	if t.presignExpires < 1 || t.presignExpires > maxRequestPresignParam {
+		return fmt.Errorf("X-Amz-Expires %d is out of range 1-%d", t.presignExpires, maxRequestPresignParam)
+	}
+	return nil
+}
+
+// awsCredentials returns credentials of the assumed role, cached across invocations when the
+// credential cache is enabled as they outlive the token presigned with them.
+func awsCredentials(ctx context.Context, o *auth.Options, awsAssumeRoleArn, stsRegion string) (aws.Credentials, error) {
+	cacheKey := o.Cache.Key("eks", "aws-credentials", awsAssumeRoleArn, stsRegion)
 
+	return cache.Fetch(o.Cache, cacheKey, func() (aws.Credentials, time.Time, error) {
+		awsCredentials, err := assumeRole(ctx, o, awsAssumeRoleArn, stsRegion)
+		return awsCredentials, awsCredentials.Expires, err
+	})
+}
+
+// assumeRole returns credentials of the role assumed with the source identity token.
+func assumeRole(ctx context.Context, o *auth.Options, awsAssumeRoleArn, stsRegion string) (aws.Credentials, error) {
 	authSource, err := auth.New(o)
 	if err != nil {
-		logger.Log.Error(fmt.Sprintf("Failed getting token source: %s", err.Error()))
-		os.Exit(1)
+		return aws.Credentials{}, fmt.Errorf("failed getting token source: %w", err)
 	}
 
 	if o.PrintSourceToken {
@@ -48,20 +80,17 @@ func getCredentials(o *auth.Options, awsAssumeRoleArn, eksClusterName, stsRegion
 
 	sessionIdentifier, err := authSource.GetSessionIdentifier()
 	if err != nil {
-		logger.Log.Error(fmt.Sprintf("Couldn't retrieve session identifier: %s", err.Error()))
-		os.Exit(1)
+		return aws.Credentials{}, fmt.Errorf("couldn't retrieve session identifier: %w", err)
 	}
 
 	assumeRoleCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(stsRegion))
 	if err != nil {
-		logger.Log.Error("failed to load default AWS config: %s" + err.Error())
-		os.Exit(1)
+		return aws.Credentials{}, fmt.Errorf("failed to load default AWS config: %w", err)
 	}
 
 	identityToken, err := authSource.IdentityTokenRetriever()
 	if err != nil {
-		logger.Log.Error("Failed to get JWT token from GCP metadata: %s" + err.Error())
-		os.Exit(1)
+		return aws.Credentials{}, fmt.Errorf("failed to get source identity token: %w", err)
 	}
 
 	stsAssumeClient := sts.NewFromConfig(assumeRoleCfg)
@@ -76,46 +105,65 @@ func getCredentials(o *auth.Options, awsAssumeRoleArn, eksClusterName, stsRegion
 
 	awsCredentials, err := awsCredsCache.Retrieve(ctx)
 	if err != nil {
-		logger.Log.Error(fmt.Sprintf("Couldn't retrieve AWS credentials %s", err.Error()))
-		os.Exit(1)
+		return aws.Credentials{}, fmt.Errorf("couldn't retrieve AWS credentials: %w", err)
 	}
 
-	eksSignerCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(stsRegion),
+	return awsCredentials, nil
+}
+
+// getToken returns the aws-iam-authenticator token of the presigned STS GetCallerIdentity request.
+func getToken(o *auth.Options, awsAssumeRoleArn string, t tokenOptions) (*oauth2.Token, error) {
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	awsCredentials, err := awsCredentials(ctx, o, awsAssumeRoleArn, t.stsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	eksSignerCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(t.stsRegion),
 		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
 			Value: awsCredentials,
 		}),
 	)
 	if err != nil {
-		logger.Log.Error(fmt.Sprintf("Couldn't load AWS config using retrieved credentials %s", err.Error()))
-		os.Exit(1)
+		return nil, fmt.Errorf("couldn't load AWS config using retrieved credentials: %w", err)
 	}
 
-	stsClient := sts.NewFromConfig(eksSignerCfg)
+	stsClient := sts.NewFromConfig(eksSignerCfg, func(opt *sts.Options) {
+		if t.stsEndpoint != "" {
+			opt.BaseEndpoint = aws.String(t.stsEndpoint)
+		}
+	})
+
+	signedHeaders := map[string]string{}
+	for key, val := range t.headers {
+		signedHeaders[key] = val
+	}
+	signedHeaders[eksClusterIdHeader] = t.clusterID
+
+	signedHeaders["X-Amz-Expires"] = strconv.Itoa(t.presignExpires)
 
 	presignclient := sts.NewPresignClient(stsClient)
 	presignedURLString, err := presignclient.PresignGetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}, func(opt *sts.PresignOptions) {
-		opt.Presigner = newCustomHTTPPresignerV4(opt.Presigner, map[string]string{
-			eksClusterIdHeader: eksClusterName,
-			"X-Amz-Expires":    "60",
-		})
+		opt.Presigner = newCustomHTTPPresignerV4(opt.Presigner, signedHeaders)
 	})
 	if err != nil {
-		logger.Log.Error(fmt.Sprintf("Couldn't presign STS request %s", err.Error()))
+		return nil, fmt.Errorf("couldn't presign STS request: %w", err)
 	}
 
-	token := tokenV1Prefix + base64.RawURLEncoding.EncodeToString([]byte(presignedURLString.URL))
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presignedURLString.URL))
 	// Set token expiration to 1 minute before the presigned URL expires for some cushion
 	tokenExpiration := time.Now().Local().Add(presignedURLExpiration - 1*time.Minute)
 
-	writer := credwriter.ExecCredentialWriter{}
-	err = writer.Write(oauth2.Token{
+	return &oauth2.Token{
 		AccessToken: token,
 		Expiry:      tokenExpiration,
-	}, os.Stdout)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
-	}
+	}, nil
 }
 
 type customHTTPPresignerV4 struct {
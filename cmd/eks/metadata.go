@@ -0,0 +1,102 @@
+package eks
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/logger"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	ECS_CREDENTIALS_PATH = "/v1/credentials"
+)
+
+// ecsCredentials is the credentials response of the ECS container credentials endpoint.
+type ecsCredentials struct {
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	RoleArn         string `json:"RoleArn"`
+}
+
+// ecsError is the error response of the ECS container credentials endpoint.
+type ecsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// eksMetadataCmd represents the serve-metadata eks command
+var eksMetadataCmd = &cobra.Command{
+	Use:   "eks",
+	Short: "Serves AWS ECS container credentials of the assumed role",
+	Long: `Serves AWS ECS container credentials of the role assumed with GKE or AKS Workload
+Identity or EKS IRSA
+
+AWS SDKs use the endpoint with AWS_CONTAINER_CREDENTIALS_FULL_URI environment variable set
+to http://<listen address>/v1/credentials and AWS_CONTAINER_AUTHORIZATION_TOKEN set to the
+--authtoken value`,
+	Example: `k8xauth serve-metadata eks --rolearn "arn:aws:iam::123456789012:role/app" --stsregion "us-east-2" --listen "127.0.0.1:8099"`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		rolearn, _ := cmd.Flags().GetString("rolearn")
+		stsregion, _ := cmd.Flags().GetString("stsregion")
+
+		options, err := rootcmd.MetadataAuthOptions(cmd)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(ECS_CREDENTIALS_PATH, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			if !rootcmd.MetadataAuthorized(cmd, r, "Authorization") {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(ecsError{Code: "Unauthorized", Message: "invalid authorization token"})
+				return
+			}
+
+			// Credentials of the role are checked by the policy as eks target credentials
+			if err := eksTarget.CheckPolicy(cmd.Flags(), &options); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(ecsError{Code: "AccessDenied", Message: err.Error()})
+				return
+			}
+
+			credentials, err := awsCredentials(r.Context(), &options, rolearn, stsregion)
+			if err != nil {
+				logger.Log.Error(fmt.Sprintf("Couldn't retrieve AWS credentials: %s", err.Error()))
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(ecsError{Code: "CredentialsError", Message: err.Error()})
+				return
+			}
+
+			json.NewEncoder(w).Encode(ecsCredentials{
+				AccessKeyId:     credentials.AccessKeyID,
+				SecretAccessKey: credentials.SecretAccessKey,
+				Token:           credentials.SessionToken,
+				Expiration:      credentials.Expires.UTC().Format(time.RFC3339),
+				RoleArn:         rolearn,
+			})
+		})
+
+		rootcmd.ServeMetadata(cmd, mux)
+	},
+}
+
+func init() {
+	rootcmd.ServeMetadataCmd.AddCommand(eksMetadataCmd)
+
+	eksMetadataCmd.Flags().StringP("rolearn", "r", "", "AWS role ARN to assume (required)")
+	eksMetadataCmd.Flags().StringP("stsregion", "s", "us-east-1", "AWS STS region to which requests are made (optional)")
+	eksMetadataCmd.Flags().StringP("cluster", "c", "", "AWS EKS cluster name the credentials are used for, checked by the policy like the eks command flag (optional)")
+	eksMetadataCmd.MarkFlagRequired("rolearn")
+}
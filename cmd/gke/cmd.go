@@ -1,45 +1,226 @@
 package gke
 
 import (
-	"k8xauth/cmd"
-	"k8xauth/internal/auth"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	rootcmd "k8xauth/cmd"
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
 )
 
 // gkeCmd represents the gke command
 var gkeCmd = &cobra.Command{
 	Use:   "gke",
 	Short: "Fetches Google Cloud GKE cluster credentials",
-	Long: `Fetches Google Cloud GKE cluster credentials from AKS Workload Identity or EKS IRSA
+	Long: `Fetches Google Cloud GKE cluster credentials from AKS Workload Identity, EKS IRSA
+or GKE Workload Identity
 
 This is useful for cases where  Kubernetes client is running in AKS or EKS cluster
-and needs to manage external Google Cloud GKE cluster(s)`,
-	Example: `k8xauth gke --projectid "12345678901" --poolid "gcp-fed-pool-id" --providerid "gcp-fed-provider-id" --serviceaccount "gcp-sa-name@gcp-project-name.iam.gserviceaccount.com"`,
+and needs to manage external Google Cloud GKE cluster(s), or is running in GKE cluster
+and needs to manage GKE cluster(s) in other projects by impersonating a service account`,
+	Example: `k8xauth gke --projectid "12345678901" --poolid "gcp-fed-pool-id" --providerid "gcp-fed-provider-id" --serviceaccount "gcp-sa-name@gcp-project-name.iam.gserviceaccount.com"
+
+# Print Connect Gateway server URL of a Fleet membership
+k8xauth gke --projectid "12345678901" --poolid "gcp-fed-pool-id" --providerid "gcp-fed-provider-id" --connectgateway "my-membership" --printserverurl`,
 	Run: func(cmd *cobra.Command, args []string) {
+		printServerURL, _ := cmd.Flags().GetBool("printserverurl")
+
+		if printServerURL {
+			gateway, err := connectGatewayFromFlags(cmd.Flags())
+			if err != nil {
+				logger.Log.Error(err.Error())
+				os.Exit(1)
+			}
+			if gateway == nil {
+				logger.Log.Error("--connectgateway is required with --printserverurl")
+				os.Exit(1)
+			}
+			fmt.Println(gateway.serverURL())
+			return
+		}
+
+		rootcmd.WriteCredentials(cmd, gkeTarget)
+	},
+}
+
+// gkeTarget retrieves GKE cluster credentials
+var gkeTarget = rootcmd.Target{
+	Name: "gke",
+	Flags: func(fs *pflag.FlagSet) {
+		// Pool flags are required unless source is GKE Workload Identity, which is checked once the source is known
+		fs.String("poolid", "", "GCP Worload Identity Federation pool ID (required unless source is GKE)")
+		fs.String("providerid", "", "GCP Worload Identity Federation provider ID (required unless source is GKE)")
+		fs.StringP("projectid", "p", "", "Numerical GCP project ID, for workforce pools the project used for quota and billing (required unless source is GKE)")
+		fs.Bool("workforcepool", false, "Pool and provider IDs refer to a Workforce Identity Federation pool for human users (optional)")
+		fs.StringP("serviceaccount", "s", "", "GCP Service Account to generate access token for (optional)")
+		fs.Duration("lifetime", time.Hour, "Lifetime of the access token generated for --serviceaccount, up to 12h if allowed by organization policy (optional)")
+		fs.StringSlice("scopes", []string{SCOPE}, "OAuth scopes of the access token exchanged with the pool provider, or generated for --serviceaccount if set (optional)")
+		fs.StringSlice("delegates", []string{}, "Service accounts in the impersonation delegation chain for --serviceaccount, in order (optional)")
+		fs.String("connectgateway", "", "Fleet membership name of a cluster accessed through Connect Gateway (optional)")
+		fs.String("membershiplocation", "global", "Location of the Fleet membership used with --connectgateway (optional)")
+		fs.String("fleetproject", "", "Numerical ID of the Fleet host project used with --connectgateway, defaults to --projectid (optional)")
+		fs.Bool("attachedcluster", false, "Fleet membership used with --connectgateway is an attached or on-prem (non-GKE) cluster (optional)")
+		fs.Bool("printserverurl", false, "Print Connect Gateway server URL of the --connectgateway membership and exit (optional)")
+		// Cluster flags are target flags so exec args of discovered clusters identify the cluster, as for EKS
+		fs.String("clusterproject", "", "Project ID of the GKE cluster discovered by the kubeconfig command, defaults to the --serviceaccount project (optional)")
+		fs.String("location", "", "Region or zone of the GKE cluster discovered by the kubeconfig command (required by it unless --connectgateway is set)")
+		fs.String("clustername", "", "Name of the GKE cluster discovered by the kubeconfig command (required by it unless --connectgateway is set)")
+	},
+	Token: func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		projectId, _ := flags.GetString("projectid")
+		poolId, _ := flags.GetString("poolid")
+		providerId, _ := flags.GetString("providerid")
+		gcpServiceAccount, _ := flags.GetString("serviceaccount")
+		workforcePool, _ := flags.GetBool("workforcepool")
+		lifetime, _ := flags.GetDuration("lifetime")
+		scopes, _ := flags.GetStringSlice("scopes")
+		delegates, _ := flags.GetStringSlice("delegates")
+
+		gateway, err := connectGatewayFromFlags(flags)
+		if err != nil {
+			return nil, err
+		}
+		if gateway != nil && !flags.Changed("scopes") {
+			scopes = gateway.scopes()
+		}
+
+		federation := federationOptions{
+			projectId:     projectId,
+			poolId:        poolId,
+			providerId:    providerId,
+			workforcePool: workforcePool,
+		}
+		// Without impersonation the exchanged token is used directly and needs the scopes,
+		// the token impersonating the service account needs cloud-platform only
+		if gcpServiceAccount == "" {
+			federation.scopes = scopes
+		}
+
+		return getToken(o, federation, gcpServiceAccount, impersonationOptions{
+			lifetime:  lifetime,
+			scopes:    scopes,
+			delegates: delegates,
+		})
+	},
+	DiscoveryFlags: func(fs *pflag.FlagSet) {
+		fs.Bool("privateendpoint", false, "Use the private endpoint of a private GKE cluster (optional)")
+	},
+	Discover: func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+		projectId, _ := flags.GetString("projectid")
+		poolId, _ := flags.GetString("poolid")
+		providerId, _ := flags.GetString("providerid")
+		gcpServiceAccount, _ := flags.GetString("serviceaccount")
+		workforcePool, _ := flags.GetBool("workforcepool")
+		lifetime, _ := flags.GetDuration("lifetime")
+		delegates, _ := flags.GetStringSlice("delegates")
+		clusterProject, _ := flags.GetString("clusterproject")
+		location, _ := flags.GetString("location")
+		clusterName, _ := flags.GetString("clustername")
+		privateEndpoint, _ := flags.GetBool("privateendpoint")
 
-		projectId, _ := cmd.Flags().GetString("projectid")
-		poolId, _ := cmd.Flags().GetString("poolid")
-		providerId, _ := cmd.Flags().GetString("providerid")
-		gcpServiceAccount, _ := cmd.Flags().GetString("serviceaccount")
+		gateway, err := connectGatewayFromFlags(flags)
+		if err != nil {
+			return nil, err
+		}
+		if gateway != nil {
+			return connectGatewayCluster(gateway), nil
+		}
+
+		if clusterProject == "" {
+			clusterProject = serviceAccountProject(gcpServiceAccount)
+		}
 
-		options := auth.Options{
-			AuthType:         cmd.Flag("authsource").Value.String(),
-			PrintSourceToken: cmd.Flag("printsourceauthtoken").Value.String() == "true",
+		federation := federationOptions{
+			projectId:     projectId,
+			poolId:        poolId,
+			providerId:    providerId,
+			workforcePool: workforcePool,
 		}
 
-		getCredentials(&options, projectId, poolId, providerId, gcpServiceAccount)
+		return getCluster(o, federation, gcpServiceAccount, impersonationOptions{
+			lifetime:  lifetime,
+			delegates: delegates,
+		}, clusterOptions{
+			project:         clusterProject,
+			location:        location,
+			name:            clusterName,
+			privateEndpoint: privateEndpoint,
+		})
 	},
+	ListFlags: func(fs *pflag.FlagSet) {
+		fs.StringSlice("projects", []string{}, "Project IDs to list clusters in, defaults to the --serviceaccount project (optional)")
+		fs.StringSlice("locations", []string{"-"}, "Regions or zones to list clusters in, - lists all locations (optional)")
+	},
+	List: func(flags *pflag.FlagSet, o *auth.Options) ([]inventory.Cluster, []error) {
+		projectId, _ := flags.GetString("projectid")
+		poolId, _ := flags.GetString("poolid")
+		providerId, _ := flags.GetString("providerid")
+		gcpServiceAccount, _ := flags.GetString("serviceaccount")
+		workforcePool, _ := flags.GetBool("workforcepool")
+		lifetime, _ := flags.GetDuration("lifetime")
+		delegates, _ := flags.GetStringSlice("delegates")
+		projects, _ := flags.GetStringSlice("projects")
+		locations, _ := flags.GetStringSlice("locations")
+		concurrency, _ := flags.GetInt("concurrency")
+
+		if len(projects) == 0 {
+			project := serviceAccountProject(gcpServiceAccount)
+			if project == "" {
+				return nil, []error{errors.New("--projects is required unless --serviceaccount is set")}
+			}
+			projects = []string{project}
+		}
+
+		federation := federationOptions{
+			projectId:     projectId,
+			poolId:        poolId,
+			providerId:    providerId,
+			workforcePool: workforcePool,
+		}
+
+		return listClusters(o, federation, gcpServiceAccount, impersonationOptions{
+			lifetime:  lifetime,
+			delegates: delegates,
+		}, projects, locations, concurrency)
+	},
+}
+
+// connectGatewayFromFlags returns the Connect Gateway membership set by the flags, nil if not set.
+func connectGatewayFromFlags(flags *pflag.FlagSet) (*connectGatewayOptions, error) {
+	projectId, _ := flags.GetString("projectid")
+	membership, _ := flags.GetString("connectgateway")
+	membershipLocation, _ := flags.GetString("membershiplocation")
+	fleetProject, _ := flags.GetString("fleetproject")
+	attachedCluster, _ := flags.GetBool("attachedcluster")
+
+	if membership == "" {
+		return nil, nil
+	}
+
+	if fleetProject == "" {
+		fleetProject = projectId
+	}
+	if fleetProject == "" {
+		return nil, errors.New("--fleetproject or --projectid is required with --connectgateway")
+	}
+
+	return &connectGatewayOptions{
+		projectNumber: fleetProject,
+		location:      membershipLocation,
+		membership:    membership,
+		attached:      attachedCluster,
+	}, nil
 }
 
 func init() {
-	cmd.RootCmd.AddCommand(gkeCmd)
-
-	gkeCmd.Flags().String("poolid", "", "GCP Worload Identity Federation pool ID (required)")
-	gkeCmd.Flags().String("providerid", "", "GCP Worload Identity Federation provider ID (required)")
-	gkeCmd.Flags().StringP("projectid", "p", "", "Numerical GCP project ID (required)")
-	gkeCmd.Flags().StringP("serviceaccount", "s", "", "GCP Service Account to generate access token for (optional)")
-	gkeCmd.MarkFlagRequired("projectid")
-	gkeCmd.MarkFlagRequired("poolid")
-	gkeCmd.MarkFlagRequired("providerid")
+	rootcmd.RegisterTarget(gkeCmd, gkeTarget)
 }
@@ -0,0 +1,165 @@
+package gke
+
+import (
+	auth "k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/option"
+)
+
+// clusterOptions identifies a GKE cluster in the container API.
+type clusterOptions struct {
+	// project is the project ID of the cluster.
+	project string
+	// location is the region or zone of the cluster.
+	location string
+	// name is the cluster name.
+	name string
+	// privateEndpoint selects the private endpoint of a private cluster.
+	privateEndpoint bool
+}
+
+// listScope is a project and location GKE clusters are listed in.
+type listScope struct {
+	project  string
+	location string
+}
+
+// newContainerService returns container API service using the federated or impersonated service account access token.
+func newContainerService(ctx context.Context, o *auth.Options, federation federationOptions, gcpServiceAccount string, impersonation impersonationOptions) (*container.Service, error) {
+	// Container API requires cloud-platform scope regardless of the scopes the cluster token is generated with
+	impersonation.scopes = []string{SCOPE}
+	token, err := getToken(o, federation, gcpServiceAccount, impersonation)
+	if err != nil {
+		return nil, err
+	}
+
+	return container.NewService(ctx, option.WithTokenSource(oauth2.StaticTokenSource(token)))
+}
+
+// clusterCAData returns the decoded CA certificate of the GKE cluster.
+func clusterCAData(cluster *container.Cluster) ([]byte, error) {
+	caData, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	if err != nil {
+		return nil, errors.New("couldn't decode GKE cluster CA certificate")
+	}
+	return caData, nil
+}
+
+// getCluster returns the API server endpoint and CA of the GKE cluster retrieved by projects.locations.clusters.get
+// with the federated or impersonated service account access token.
+func getCluster(o *auth.Options, federation federationOptions, gcpServiceAccount string, impersonation impersonationOptions, c clusterOptions) (*kubeconfig.Cluster, error) {
+	if c.project == "" || c.location == "" || c.name == "" {
+		return nil, errors.New("--clusterproject, --location and --clustername are required unless --connectgateway is set")
+	}
+
+	ctx := context.Background()
+	containerService, err := newContainerService(ctx, o, federation, gcpServiceAccount, impersonation)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := containerService.Projects.Locations.Clusters.Get(fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.project, c.location, c.name)).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get GKE cluster %s: %w", c.name, err)
+	}
+
+	endpoint := cluster.Endpoint
+	if c.privateEndpoint {
+		if cluster.PrivateClusterConfig == nil || cluster.PrivateClusterConfig.PrivateEndpoint == "" {
+			return nil, fmt.Errorf("GKE cluster %s has no private endpoint", c.name)
+		}
+		endpoint = cluster.PrivateClusterConfig.PrivateEndpoint
+	}
+	if endpoint == "" || cluster.MasterAuth == nil {
+		return nil, fmt.Errorf("GKE cluster %s has no endpoint yet (status %s)", c.name, cluster.Status)
+	}
+
+	caData, err := clusterCAData(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubeconfig.Cluster{
+		// Same name as gcloud container clusters get-credentials
+		Name:                     fmt.Sprintf("gke_%s_%s_%s", c.project, c.location, c.name),
+		Server:                   "https://" + endpoint,
+		CertificateAuthorityData: caData,
+	}, nil
+}
+
+// connectGatewayCluster returns the Connect Gateway API server of the membership, trusted with system roots.
+func connectGatewayCluster(gateway *connectGatewayOptions) *kubeconfig.Cluster {
+	return &kubeconfig.Cluster{
+		// Same name as gcloud container fleet memberships get-credentials
+		Name:   fmt.Sprintf("connectgateway_%s_%s_%s", gateway.projectNumber, gateway.location, gateway.membership),
+		Server: gateway.serverURL(),
+	}
+}
+
+// listClusters lists GKE clusters of the projects in the locations, "-" listing all locations, scopes
+// are listed concurrently.
+func listClusters(o *auth.Options, federation federationOptions, gcpServiceAccount string, impersonation impersonationOptions, projects, locations []string, concurrency int) ([]inventory.Cluster, []error) {
+	ctx := context.Background()
+	containerService, err := newContainerService(ctx, o, federation, gcpServiceAccount, impersonation)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var scopes []listScope
+	for _, project := range projects {
+		for _, location := range locations {
+			scopes = append(scopes, listScope{project: project, location: location})
+		}
+	}
+
+	return inventory.ForEach(scopes, concurrency, func(s listScope) ([]inventory.Cluster, error) {
+		resp, err := containerService.Projects.Locations.Clusters.List(fmt.Sprintf("projects/%s/locations/%s", s.project, s.location)).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: couldn't list GKE clusters: %w", s.project, s.location, err)
+		}
+		for _, location := range resp.MissingZones {
+			logger.Log.Debug(fmt.Sprintf("Clusters of %s in %s not listed, zone %s is unavailable", s.project, s.location, location))
+		}
+
+		var clusters []inventory.Cluster
+		for _, cluster := range resp.Clusters {
+			if cluster.Endpoint == "" || cluster.MasterAuth == nil {
+				logger.Log.Debug(fmt.Sprintf("Skipping GKE cluster %s with no endpoint yet (status %s)", cluster.Name, cluster.Status))
+				continue
+			}
+
+			caData, err := clusterCAData(cluster)
+			if err != nil {
+				return clusters, err
+			}
+
+			clusters = append(clusters, inventory.Cluster{
+				Name:     cluster.Name,
+				Cloud:    inventory.CLOUD_GCP,
+				ID:       fmt.Sprintf("projects/%s/locations/%s/clusters/%s", s.project, cluster.Location, cluster.Name),
+				Account:  s.project,
+				Location: cluster.Location,
+				Endpoint: "https://" + cluster.Endpoint,
+				CAData:   caData,
+				Labels:   cluster.ResourceLabels,
+				Flags: map[string]string{
+					"clusterproject": s.project,
+					"location":       cluster.Location,
+					"clustername":    cluster.Name,
+				},
+			})
+		}
+
+		return clusters, nil
+	})
+}
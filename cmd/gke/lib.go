@@ -4,10 +4,12 @@ import (
 	"k8xauth/internal/logger"
 
 	"context"
+	"encoding/json"
 	"fmt"
 	auth "k8xauth/internal/auth"
-	"k8xauth/internal/credwriter"
+	"k8xauth/internal/cache"
 	"os"
+	"strings"
 	"time"
 
 	"google.golang.org/api/iamcredentials/v1"
@@ -21,34 +23,130 @@ const (
 	GRANT_TYPE           = "urn:ietf:params:oauth:grant-type:token-exchange"
 	REQUESTED_TOKEN_TYPE = "urn:ietf:params:oauth:token-type:access_token"
 	SUBJECT_TOKEN_TYPE   = "urn:ietf:params:oauth:token-type:jwt"
+	ID_TOKEN_TYPE        = "urn:ietf:params:oauth:token-type:id_token"
 	SCOPE                = "https://www.googleapis.com/auth/cloud-platform"
+	USERINFO_EMAIL_SCOPE = "https://www.googleapis.com/auth/userinfo.email"
 )
 
-func getCredentials(o *auth.Options, projectId, poolId, providerId, gcpServiceAccount string) {
-	idProvider := fmt.Sprintf("//iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/providers/%s", projectId, poolId, providerId)
+// serviceAccountProject returns the project ID of the service account, empty if not a service account email.
+func serviceAccountProject(email string) string {
+	// Service account emails are in the form <name>@<project ID>.iam.gserviceaccount.com
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return ""
+	}
+	project, _, _ := strings.Cut(domain, ".")
+	return project
+}
 
-	authSource, err := auth.New(o)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+// connectGatewayOptions identifies a Fleet membership reachable through Connect Gateway.
+type connectGatewayOptions struct {
+	// projectNumber is the numerical ID of the Fleet host project.
+	projectNumber string
+	// location of the membership, "global" or a region.
+	location string
+	// membership is the Fleet membership name.
+	membership string
+	// attached is set for non-GKE (attached, on-prem) cluster memberships.
+	attached bool
+}
+
+// scopes returns OAuth scopes required by Connect Gateway.
+func (c connectGatewayOptions) scopes() []string {
+	return []string{SCOPE, USERINFO_EMAIL_SCOPE}
+}
+
+// serverURL returns the Connect Gateway Kubernetes API server URL of the membership.
+func (c connectGatewayOptions) serverURL() string {
+	host := "connectgateway.googleapis.com"
+	if c.location != "global" {
+		host = c.location + "-" + host
+	}
+	collection := "gkeMemberships"
+	if c.attached {
+		collection = "memberships"
 	}
+	return fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/%s/%s", host, c.projectNumber, c.location, collection, c.membership)
+}
 
-	if o.PrintSourceToken {
-		authSource.PrettyPrintJWTToken(os.Stdout)
+// federationOptions identifies the Workload or Workforce Identity Federation pool provider
+// the source identity token is exchanged with.
+type federationOptions struct {
+	// projectId is the numerical project ID of the workload identity pool, or the
+	// project used for quota and billing (userProject) for workforce pools.
+	projectId  string
+	poolId     string
+	providerId string
+	// workforcePool is set when the pool is a workforce identity pool for human users.
+	workforcePool bool
+	// scopes of the exchanged access token, SCOPE if not set.
+	scopes []string
+}
+
+// scope returns the space separated scopes of the exchanged access token.
+func (f federationOptions) scope() string {
+	if len(f.scopes) == 0 {
+		return SCOPE
+	}
+	return strings.Join(f.scopes, " ")
+}
+
+// audience returns the full resource name of the identity pool provider.
+func (f federationOptions) audience() string {
+	if f.workforcePool {
+		return fmt.Sprintf("//iam.googleapis.com/locations/global/workforcePools/%s/providers/%s", f.poolId, f.providerId)
 	}
+	return fmt.Sprintf("//iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/providers/%s", f.projectId, f.poolId, f.providerId)
+}
+
+// subjectTokenType returns the STS subject token type for the identity pool provider.
+func (f federationOptions) subjectTokenType() string {
+	if f.workforcePool {
+		return ID_TOKEN_TYPE
+	}
+	return SUBJECT_TOKEN_TYPE
+}
 
-	identityToken, err := authSource.Token()
+// stsOptions returns the serialized STS exchange options. Workforce pools are not bound
+// to a project so the userProject used for quota and billing has to be provided.
+func (f federationOptions) stsOptions() (string, error) {
+	if !f.workforcePool {
+		return "", nil
+	}
+	b, err := json.Marshal(sts.GoogleIdentityStsV1Options{UserProject: f.projectId})
 	if err != nil {
-		logger.Log.Debug(err.Error())
+		return "", err
+	}
+	return string(b), nil
+}
+
+// impersonationOptions holds parameters of the access token generated for the
+// impersonated service account.
+type impersonationOptions struct {
+	// lifetime of the generated access token.
+	lifetime time.Duration
+	// scopes of the generated access token.
+	scopes []string
+	// delegates is the chain of service accounts the impersonation is delegated through.
+	delegates []string
+}
+
+// exchangeToken exchanges the source identity token for a federated Google access token using
+// the Workload or Workforce Identity Federation pool provider.
+func exchangeToken(federation federationOptions, identityToken *oauth2.Token) (*oauth2.Token, error) {
+	stsOptions, err := federation.stsOptions()
+	if err != nil {
+		return nil, err
 	}
 
 	stsExchangeTokenRequest := sts.GoogleIdentityStsV1ExchangeTokenRequest{
 		GrantType:          GRANT_TYPE,
 		RequestedTokenType: REQUESTED_TOKEN_TYPE,
-		SubjectTokenType:   SUBJECT_TOKEN_TYPE,
-		Audience:           idProvider,
-		Scope:              SCOPE,
+		SubjectTokenType:   federation.subjectTokenType(),
+		Audience:           federation.audience(),
+		Scope:              federation.scope(),
 		SubjectToken:       identityToken.AccessToken,
+		Options:            stsOptions,
 	}
 
 	gcpStsService, err := sts.NewService(context.Background(), option.WithoutAuthentication())
@@ -60,57 +158,147 @@ func getCredentials(o *auth.Options, projectId, poolId, providerId, gcpServiceAc
 
 	stsToken, err := gcpStsV1Service.Token(&stsExchangeTokenRequest).Do()
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
-	// If no `--serviceaccount` flag is set the
-	// stsToken will be used directly, allowing bindings on GCP resources
-	// in the form "principal://iam.googleapis.com/projects/<proj_id_num>/locations/global/workloadIdentityPools/<wlif_pool_id>/subject/system:serviceaccount:learning:datasets-api".
-	if gcpServiceAccount == "" {
-		writer := credwriter.ExecCredentialWriter{}
-		err = writer.Write(oauth2.Token{
-			AccessToken: stsToken.AccessToken,
-			Expiry:      time.Now().Add(time.Second * time.Duration(stsToken.ExpiresIn)),
-		}, os.Stdout)
+	return &oauth2.Token{
+		AccessToken: stsToken.AccessToken,
+		Expiry:      time.Now().Add(time.Second * time.Duration(stsToken.ExpiresIn)),
+	}, nil
+}
+
+// federatedToken returns the Google access token of the source identity, either the GKE Workload
+// Identity access token or the token exchanged with the identity pool provider. It is cached across
+// invocations when the credential cache is enabled.
+func federatedToken(o *auth.Options, federation federationOptions) (*oauth2.Token, error) {
+	cacheKey := o.Cache.Key("gke", "federated-token", federation.projectId, federation.poolId, federation.providerId, fmt.Sprint(federation.workforcePool), federation.scope())
+
+	return cache.Fetch(o.Cache, cacheKey, func() (*oauth2.Token, time.Time, error) {
+		token, err := sourceFederatedToken(o, federation)
 		if err != nil {
-			logger.Log.Error(err.Error())
-			os.Exit(1)
+			return nil, time.Time{}, err
 		}
-		os.Exit(0)
+		return token, token.Expiry, nil
+	})
+}
+
+// federationSource is the source authentication providing the token exchanged for a Google access token.
+type federationSource interface {
+	GetPlatform() (string, error)
+	Token() (*oauth2.Token, error)
+	FederationToken(targetPlatform string) (*oauth2.Token, error)
+}
+
+// validate returns an error unless the identity pool provider is set or the source is GKE Workload
+// Identity, whose Google access token is used without exchange.
+func (f federationOptions) validate(platform string) error {
+	if f.poolId == "" && platform == auth.PLATFORM_GCP {
+		return nil
 	}
 
-	// If a `--serviceaccount` flag is set the
-	// stsToken will be used to fetch GCP IAM credentials for the service account
-	stsOauthToken := oauth2.Token{
-		AccessToken: stsToken.AccessToken,
-		Expiry:      time.Now().Add(time.Second * time.Duration(stsToken.ExpiresIn)),
+	var missing []string
+	if f.projectId == "" {
+		missing = append(missing, "--projectid")
+	}
+	if f.poolId == "" {
+		missing = append(missing, "--poolid")
+	}
+	if f.providerId == "" {
+		missing = append(missing, "--providerid")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s required to exchange %s source identity token, only GKE Workload Identity is used without identity pool", strings.Join(missing, ", "), platform)
+	}
+	return nil
+}
+
+// sourceFederatedToken returns the Google access token of the source identity.
+func sourceFederatedToken(o *auth.Options, federation federationOptions) (*oauth2.Token, error) {
+	authSource, err := auth.New(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.PrintSourceToken {
+		authSource.PrettyPrintJWTToken(os.Stdout)
+	}
+
+	return federateSource(authSource, federation, exchangeToken)
+}
+
+// federateSource returns the GKE Workload Identity access token of the source, or its identity token
+// exchanged with the identity pool provider.
+func federateSource(source federationSource, federation federationOptions, exchange func(federationOptions, *oauth2.Token) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	platform, _ := source.GetPlatform()
+	if err := federation.validate(platform); err != nil {
+		return nil, err
+	}
+
+	if federation.poolId == "" {
+		// GKE Workload Identity is a Google identity already, its access token is used
+		// directly or to impersonate service accounts in other projects
+		return source.FederationToken(auth.PLATFORM_GCP)
 	}
 
+	identityToken, err := source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get source identity token: %w", err)
+	}
+
+	return exchange(federation, identityToken)
+}
+
+// getToken returns the federated Google access token, or the access token generated for
+// the impersonated service account if set.
+func getToken(o *auth.Options, federation federationOptions, gcpServiceAccount string, impersonation impersonationOptions) (*oauth2.Token, error) {
+	stsOauthToken, err := federatedToken(o, federation)
+	if err != nil {
+		return nil, err
+	}
+
+	// If no `--serviceaccount` flag is set the
+	// stsToken (or GKE Workload Identity access token) will be used directly, allowing bindings on GCP resources
+	// in the form "principal://iam.googleapis.com/projects/<proj_id_num>/locations/global/workloadIdentityPools/<wlif_pool_id>/subject/system:serviceaccount:learning:datasets-api"
+	// or "principal://iam.googleapis.com/locations/global/workforcePools/<pool_id>/subject/<subject>" for workforce pools.
+	if gcpServiceAccount == "" {
+		return &oauth2.Token{
+			AccessToken: stsOauthToken.AccessToken,
+			Expiry:      stsOauthToken.Expiry,
+		}, nil
+	}
+
+	// If a `--serviceaccount` flag is set the
+	// stsToken will be used to fetch GCP IAM credentials for the service account
 	config := &oauth2.Config{}
-	iamCredentialsService, err := iamcredentials.NewService(context.Background(), option.WithTokenSource(config.TokenSource(context.Background(), &stsOauthToken)))
+	iamCredentialsService, err := iamcredentials.NewService(context.Background(), option.WithTokenSource(config.TokenSource(context.Background(), stsOauthToken)))
 	if err != nil {
-		logger.Log.Error(err.Error())
+		return nil, err
+	}
+
+	delegates := make([]string, 0, len(impersonation.delegates))
+	for _, d := range impersonation.delegates {
+		delegates = append(delegates, "projects/-/serviceAccounts/"+d)
 	}
 
 	accessTokenRequest := iamcredentials.GenerateAccessTokenRequest{
-		Lifetime: "3600s",
-		Scope:    []string{SCOPE},
+		Lifetime:  fmt.Sprintf("%ds", int64(impersonation.lifetime.Seconds())),
+		Scope:     impersonation.scopes,
+		Delegates: delegates,
 	}
 
 	gcpCredentials, err := iamCredentialsService.Projects.ServiceAccounts.GenerateAccessToken("projects/-/serviceAccounts/"+gcpServiceAccount, &accessTokenRequest).Do()
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(2)
+		return nil, err
 	}
 
-	writer := credwriter.ExecCredentialWriter{}
-	err = writer.Write(oauth2.Token{
-		AccessToken: gcpCredentials.AccessToken,
-		Expiry:      time.Now().Add(time.Second * time.Duration(stsToken.ExpiresIn)),
-	}, os.Stdout)
+	// Expiry is taken from the generated token as its lifetime is independent of the STS token
+	expiry, err := time.Parse(time.RFC3339, gcpCredentials.ExpireTime)
 	if err != nil {
-		logger.Log.Error(err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("couldn't parse generated access token expiry time: %w", err)
 	}
+
+	return &oauth2.Token{
+		AccessToken: gcpCredentials.AccessToken,
+		Expiry:      expiry,
+	}, nil
 }
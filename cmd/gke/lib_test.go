@@ -0,0 +1,143 @@
+package gke
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeSource is a source authentication with fixed tokens.
+type fakeSource struct {
+	platform       string
+	identityToken  string
+	sameCloudToken string
+	tokenErr       error
+	// federationPlatform is the target platform FederationToken was called with.
+	federationPlatform string
+}
+
+func (s *fakeSource) GetPlatform() (string, error) {
+	return s.platform, nil
+}
+
+func (s *fakeSource) Token() (*oauth2.Token, error) {
+	if s.tokenErr != nil {
+		return nil, s.tokenErr
+	}
+	return &oauth2.Token{AccessToken: s.identityToken}, nil
+}
+
+func (s *fakeSource) FederationToken(targetPlatform string) (*oauth2.Token, error) {
+	s.federationPlatform = targetPlatform
+	if targetPlatform == s.platform {
+		return &oauth2.Token{AccessToken: s.sameCloudToken}, nil
+	}
+	return s.Token()
+}
+
+func TestFederateSource(t *testing.T) {
+	pool := federationOptions{projectId: "123456", poolId: "pool", providerId: "provider"}
+
+	tests := []struct {
+		name       string
+		source     *fakeSource
+		federation federationOptions
+		// want is the returned access token, exchanged tokens are prefixed with "exchanged:".
+		want string
+		// wantErr is a substring of the expected error.
+		wantErr string
+	}{
+		{
+			name:       "GKE Workload Identity uses same cloud access token",
+			source:     &fakeSource{platform: "gcp", identityToken: "id-token", sameCloudToken: "access-token"},
+			federation: federationOptions{},
+			want:       "access-token",
+		},
+		{
+			name:       "GKE Workload Identity with pool exchanges identity token",
+			source:     &fakeSource{platform: "gcp", identityToken: "id-token", sameCloudToken: "access-token"},
+			federation: pool,
+			want:       "exchanged:id-token",
+		},
+		{
+			name:       "EKS IRSA exchanges identity token",
+			source:     &fakeSource{platform: "aws", identityToken: "irsa-token"},
+			federation: pool,
+			want:       "exchanged:irsa-token",
+		},
+		{
+			name:       "EKS IRSA without pool",
+			source:     &fakeSource{platform: "aws", identityToken: "irsa-token"},
+			federation: federationOptions{projectId: "123456"},
+			wantErr:    "--poolid, --providerid required to exchange aws source identity token",
+		},
+		{
+			name:       "AKS Workload Identity without provider",
+			source:     &fakeSource{platform: "azure", identityToken: "entra-token"},
+			federation: federationOptions{projectId: "123456", poolId: "pool"},
+			wantErr:    "--providerid required to exchange azure source identity token",
+		},
+		{
+			name:       "GKE Workload Identity with incomplete pool",
+			source:     &fakeSource{platform: "gcp", identityToken: "id-token"},
+			federation: federationOptions{poolId: "pool"},
+			wantErr:    "--projectid, --providerid required",
+		},
+		{
+			name:       "source token failure",
+			source:     &fakeSource{platform: "aws", tokenErr: errors.New("no web identity token")},
+			federation: pool,
+			wantErr:    "couldn't get source identity token: no web identity token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exchanged := false
+			exchange := func(f federationOptions, identityToken *oauth2.Token) (*oauth2.Token, error) {
+				exchanged = true
+				if f.audience() != pool.audience() {
+					t.Errorf("exchange audience = %s, want %s", f.audience(), pool.audience())
+				}
+				return &oauth2.Token{AccessToken: "exchanged:" + identityToken.AccessToken}, nil
+			}
+
+			token, err := federateSource(tt.source, tt.federation, exchange)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if exchanged {
+					t.Error("token exchanged despite error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if token.AccessToken != tt.want {
+				t.Errorf("token = %q, want %q", token.AccessToken, tt.want)
+			}
+			if wantExchange := strings.HasPrefix(tt.want, "exchanged:"); exchanged != wantExchange {
+				t.Errorf("exchanged = %t, want %t", exchanged, wantExchange)
+			}
+			if !exchanged && tt.source.federationPlatform != "gcp" {
+				t.Errorf("FederationToken platform = %q, want gcp", tt.source.federationPlatform)
+			}
+		})
+	}
+}
+
+func TestFederationScope(t *testing.T) {
+	if got := (federationOptions{}).scope(); got != SCOPE {
+		t.Errorf("default scope = %q, want %q", got, SCOPE)
+	}
+
+	gateway := connectGatewayOptions{}
+	want := SCOPE + " " + USERINFO_EMAIL_SCOPE
+	if got := (federationOptions{scopes: gateway.scopes()}).scope(); got != want {
+		t.Errorf("Connect Gateway scope = %q, want %q", got, want)
+	}
+}
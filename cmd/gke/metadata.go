@@ -0,0 +1,197 @@
+package gke
+
+import (
+	rootcmd "k8xauth/cmd"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+const (
+	METADATA_FLAVOR_HEADER = "Metadata-Flavor"
+	METADATA_FLAVOR        = "Google"
+)
+
+// gceToken is the service account token response of the GCE metadata server.
+type gceToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// gceServiceAccount is the recursive service account response of the GCE metadata server.
+type gceServiceAccount struct {
+	Aliases []string `json:"aliases"`
+	Email   string   `json:"email"`
+	Scopes  []string `json:"scopes"`
+}
+
+// gkeMetadataCmd represents the serve-metadata gke command
+var gkeMetadataCmd = &cobra.Command{
+	Use:   "gke",
+	Short: "Serves GCE metadata server service account token",
+	Long: `Serves GCE metadata server service account token of the federated identity or the
+impersonated service account from AKS Workload Identity, EKS IRSA or GKE Workload Identity
+
+Google Cloud SDKs use the endpoint with GCE_METADATA_HOST environment variable set to
+the listen address`,
+	Example: `k8xauth serve-metadata gke --projectid "12345678901" --poolid "gcp-fed-pool-id" --providerid "gcp-fed-provider-id" --serviceaccount "app@my-project.iam.gserviceaccount.com" --listen "127.0.0.1:8099"`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		projectId, _ := cmd.Flags().GetString("projectid")
+		poolId, _ := cmd.Flags().GetString("poolid")
+		providerId, _ := cmd.Flags().GetString("providerid")
+		gcpServiceAccount, _ := cmd.Flags().GetString("serviceaccount")
+		workforcePool, _ := cmd.Flags().GetBool("workforcepool")
+		lifetime, _ := cmd.Flags().GetDuration("lifetime")
+		scopes, _ := cmd.Flags().GetStringSlice("scopes")
+		delegates, _ := cmd.Flags().GetStringSlice("delegates")
+		metadataProjectId, _ := cmd.Flags().GetString("metadataprojectid")
+
+		if metadataProjectId == "" {
+			metadataProjectId = serviceAccountProject(gcpServiceAccount)
+		}
+
+		email := gcpServiceAccount
+		if email == "" {
+			email = "default"
+		}
+
+		options, err := rootcmd.MetadataAuthOptions(cmd)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+
+		federation := federationOptions{
+			projectId:     projectId,
+			poolId:        poolId,
+			providerId:    providerId,
+			workforcePool: workforcePool,
+		}
+
+		token := func(requestedScopes []string) (*oauth2.Token, error) {
+			if len(requestedScopes) == 0 {
+				requestedScopes = scopes
+			}
+			// Tokens are checked by the policy as gke target credentials before the cached ones are returned
+			if err := gkeTarget.CheckPolicy(cmd.Flags(), &options); err != nil {
+				return nil, err
+			}
+			// Without impersonation the exchanged token is served and has to be exchanged for the requested
+			// scopes, the GKE Workload Identity access token has the cloud-platform scope only
+			federation := federation
+			if gcpServiceAccount == "" {
+				if poolId == "" && !slices.Equal(requestedScopes, []string{SCOPE}) {
+					return nil, fmt.Errorf("scopes %v can't be requested for the GKE Workload Identity access token, set --serviceaccount to generate tokens of other scopes", requestedScopes)
+				}
+				federation.scopes = requestedScopes
+			}
+			return cache.Fetch(options.Cache, options.Cache.Key(requestedScopes...), func() (*oauth2.Token, time.Time, error) {
+				token, err := getToken(&options, federation, gcpServiceAccount, impersonationOptions{
+					lifetime:  lifetime,
+					scopes:    requestedScopes,
+					delegates: delegates,
+				})
+				if err != nil {
+					return nil, time.Time{}, err
+				}
+				return token, token.Expiry, nil
+			})
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			// Metadata server detection
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set(METADATA_FLAVOR_HEADER, METADATA_FLAVOR)
+		})
+		mux.HandleFunc("/computeMetadata/v1/project/project-id", func(w http.ResponseWriter, r *http.Request) {
+			if metadataProjectId == "" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, metadataProjectId)
+		})
+		mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("recursive") != "true" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(gceServiceAccount{
+				Aliases: []string{"default"},
+				Email:   email,
+				Scopes:  scopes,
+			})
+		})
+		mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/email", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, email)
+		})
+		mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/scopes", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, strings.Join(scopes, "\n"))
+		})
+		mux.HandleFunc("/computeMetadata/v1/instance/service-accounts/{account}/token", func(w http.ResponseWriter, r *http.Request) {
+			var requestedScopes []string
+			if s := r.URL.Query().Get("scopes"); s != "" {
+				requestedScopes = strings.Split(s, ",")
+			}
+
+			t, err := token(requestedScopes)
+			if err != nil {
+				logger.Log.Error(fmt.Sprintf("Couldn't retrieve Google access token: %s", err.Error()))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(gceToken{
+				AccessToken: t.AccessToken,
+				ExpiresIn:   int64(time.Until(t.Expiry).Seconds()),
+				TokenType:   "Bearer",
+			})
+		})
+
+		rootcmd.ServeMetadata(cmd, gceMetadataHandler(mux))
+	},
+}
+
+// gceMetadataHandler requires the metadata request header on computeMetadata requests, preventing
+// SSRF, and sets the metadata response header.
+func gceMetadataHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(METADATA_FLAVOR_HEADER, METADATA_FLAVOR)
+		if strings.HasPrefix(r.URL.Path, "/computeMetadata/") && r.Header.Get(METADATA_FLAVOR_HEADER) != METADATA_FLAVOR {
+			http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func init() {
+	rootcmd.ServeMetadataCmd.AddCommand(gkeMetadataCmd)
+
+	gkeMetadataCmd.Flags().String("poolid", "", "GCP Worload Identity Federation pool ID (required unless source is GKE)")
+	gkeMetadataCmd.Flags().String("providerid", "", "GCP Worload Identity Federation provider ID (required unless source is GKE)")
+	gkeMetadataCmd.Flags().StringP("projectid", "p", "", "Numerical GCP project ID, for workforce pools the project used for quota and billing (required unless source is GKE)")
+	gkeMetadataCmd.Flags().Bool("workforcepool", false, "Pool and provider IDs refer to a Workforce Identity Federation pool for human users (optional)")
+	gkeMetadataCmd.Flags().StringP("serviceaccount", "s", "", "GCP Service Account to generate access token for (optional)")
+	gkeMetadataCmd.Flags().Duration("lifetime", time.Hour, "Lifetime of the access token generated for --serviceaccount, up to 12h if allowed by organization policy (optional)")
+	gkeMetadataCmd.Flags().StringSlice("scopes", []string{SCOPE}, "Default OAuth scopes of the access token, clients may request others (optional)")
+	gkeMetadataCmd.Flags().StringSlice("delegates", []string{}, "Service accounts in the impersonation delegation chain for --serviceaccount, in order (optional)")
+	gkeMetadataCmd.Flags().String("metadataprojectid", "", "Project ID served as project/project-id, defaults to the --serviceaccount project (optional)")
+}
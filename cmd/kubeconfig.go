@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"k8xauth/internal/credwriter"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	EXEC_COMMAND      = "k8xauth"
+	EXEC_INSTALL_HINT = "k8xauth missing. For installation follow https://github.com/trhyo/k8xauth#installation"
+)
+
+// execArgsIgnoredFlags are flags not passed on to the exec credential plugin.
+var execArgsIgnoredFlags = map[string]bool{
+	"printsourceauthtoken": true,
+	"printserverurl":       true,
+}
+
+// KubeconfigCmd represents the kubeconfig command, with a subcommand for every target discovering its clusters.
+var KubeconfigCmd = &cobra.Command{
+	Use:   "kubeconfig",
+	Short: "Writes kubeconfig of a cluster discovered from the target cloud API",
+	Long: `Retrieves the API server endpoint and CA of the cluster from the target cloud API
+with the federated credentials (EKS DescribeCluster, GKE clusters.get, AKS
+listClusterUserCredential) and writes or merges a kubeconfig context whose user runs
+k8xauth as exec credential plugin with the target parameters`,
+	Example: `k8xauth kubeconfig eks --rolearn "arn:aws:iam::123456789012:role/argocd" --cluster "my-cluster-name" --stsregion "us-east-2"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// execArgs returns the exec credential plugin arguments running the target with the target and root
+// persistent flags set on the command, the overrides replacing or adding target flags.
+func execArgs(flags *pflag.FlagSet, t Target, overrides map[string]string) []string {
+	args := []string{t.Name}
+
+	var names []string
+	t.NewFlagSet().VisitAll(func(f *pflag.Flag) {
+		if _, ok := overrides[f.Name]; ok {
+			names = append(names, f.Name)
+			return
+		}
+		if flag := flags.Lookup(f.Name); flag != nil && flag.Changed && !execArgsIgnoredFlags[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	return append(args, flagArgs(flags, names, overrides)...)
+}
+
+// targetArgs returns the arguments setting the target flags set on the command, without root
+// persistent flags.
+func targetArgs(flags *pflag.FlagSet, t Target) []string {
+	fs := pflag.NewFlagSet(t.Name, pflag.ContinueOnError)
+	t.Flags(fs)
+
+	var names []string
+	fs.VisitAll(func(f *pflag.Flag) {
+		if flag := flags.Lookup(f.Name); flag != nil && flag.Changed {
+			names = append(names, f.Name)
+		}
+	})
+
+	return flagArgs(flags, names, nil)
+}
+
+// flagArgs returns the arguments setting the named flags to their values in the flag set, or the
+// override values.
+func flagArgs(flags *pflag.FlagSet, names []string, overrides map[string]string) []string {
+	var args []string
+	for _, name := range names {
+		if value, ok := overrides[name]; ok {
+			args = append(args, fmt.Sprintf("--%s=%s", name, value))
+			continue
+		}
+
+		flag := flags.Lookup(name)
+
+		if value, ok := flag.Value.(pflag.SliceValue); ok {
+			for _, v := range value.GetSlice() {
+				args = append(args, fmt.Sprintf("--%s=%s", name, v))
+			}
+			continue
+		}
+
+		if flag.Value.Type() == "stringToString" {
+			m, _ := flags.GetStringToString(name)
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				args = append(args, fmt.Sprintf("--%s=%s=%s", name, k, m[k]))
+			}
+			continue
+		}
+
+		args = append(args, fmt.Sprintf("--%s=%s", name, flag.Value.String()))
+	}
+
+	return args
+}
+
+// runKubeconfig writes or merges the kubeconfig context of the cluster discovered by the target.
+func runKubeconfig(cmd *cobra.Command, t Target) {
+	out, _ := cmd.Flags().GetString("out")
+	contextName, _ := cmd.Flags().GetString("contextname")
+	setCurrent, _ := cmd.Flags().GetBool("setcurrentcontext")
+	command, _ := cmd.Flags().GetString("execcommand")
+	provideClusterInfo, _ := cmd.Flags().GetBool("provideclusterinfo")
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	cluster, err := t.Discover(cmd.Flags(), &options)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Couldn't discover %s cluster: %s", t.Name, err.Error()))
+		os.Exit(1)
+	}
+	if contextName != "" {
+		cluster.Name = contextName
+	}
+
+	config := kubeconfig.WithExec(*cluster, kubeconfig.ExecUser{
+		Command:            command,
+		Args:               execArgs(cmd.Flags(), t, nil),
+		InstallHint:        EXEC_INSTALL_HINT,
+		ProvideClusterInfo: provideClusterInfo,
+	})
+
+	if out == "-" {
+		data, err := clientcmd.Write(*config)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+
+	if out == "" {
+		out = clientcmd.NewDefaultPathOptions().GetDefaultFilename()
+	}
+
+	data, err := kubeconfig.Merge(out, config, setCurrent)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := credwriter.WriteFileAtomic(out, data, 0600); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	logger.Log.Info(fmt.Sprintf("Context %s for %s written to %s", cluster.Name, cluster.Server, out))
+}
+
+func init() {
+	RootCmd.AddCommand(KubeconfigCmd)
+	addDiscoveryRunner(KubeconfigCmd, runKubeconfig)
+
+	KubeconfigCmd.PersistentFlags().String("out", "", "Kubeconfig file the context is merged into, - writes a new kubeconfig to standard output, defaults to $KUBECONFIG or ~/.kube/config (optional)")
+	KubeconfigCmd.PersistentFlags().String("contextname", "", "Name of the context, cluster and user entries, defaults to the cloud cluster identifier (optional)")
+	KubeconfigCmd.PersistentFlags().Bool("setcurrentcontext", true, "Set the written context as current context (optional)")
+	KubeconfigCmd.PersistentFlags().String("execcommand", EXEC_COMMAND, "Command of the exec credential plugin (optional)")
+	KubeconfigCmd.PersistentFlags().Bool("provideclusterinfo", true, "Provide cluster info in KUBERNETES_EXEC_INFO to the exec credential plugin (optional)")
+}
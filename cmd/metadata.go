@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	METADATA_AUTH_TOKEN_ENV = "K8XAUTH_METADATA_AUTH_TOKEN"
+)
+
+// ServeMetadataCmd represents the serve-metadata command, target commands add subcommands serving
+// their cloud credential endpoint.
+var ServeMetadataCmd = &cobra.Command{
+	Use:   "serve-metadata",
+	Short: "Serves target cloud credential endpoint for unmodified cloud SDKs",
+	Long: `Serves target cloud credential endpoint locally, backed by the same federation flows
+the target commands use, so applications using the stock AWS, Google Cloud and Azure
+SDKs get cross-cloud identity without code changes
+
+- eks serves AWS ECS container credentials (AWS_CONTAINER_CREDENTIALS_FULL_URI)
+- gke serves GCE metadata server service account token (GCE_METADATA_HOST)
+- aks serves Azure IMDS and App Service managed identity token (IDENTITY_ENDPOINT)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// MetadataAuthOptions returns source authentication options of a serve-metadata subcommand, with an
+// in-memory credential cache so credentials are reused by requests until they are about to expire.
+func MetadataAuthOptions(cmd *cobra.Command) (auth.Options, error) {
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		return auth.Options{}, err
+	}
+
+	skew, _ := cmd.Flags().GetDuration("cacheskew")
+	options.Cache = cache.NewMemory(skew, "")
+	options.CacheKey = ""
+
+	return options, nil
+}
+
+// MetadataAuthorized reports whether the request presents the token set by --authtoken, if any, in the header.
+func MetadataAuthorized(cmd *cobra.Command, r *http.Request, header string) bool {
+	token, _ := cmd.Flags().GetString("authtoken")
+	if token == "" {
+		token = os.Getenv(METADATA_AUTH_TOKEN_ENV)
+	}
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(header)), []byte(token)) == 1
+}
+
+// ServeMetadata serves the credential endpoint handler on the --listen address until interrupted.
+func ServeMetadata(cmd *cobra.Command, handler http.Handler) {
+	listen, _ := cmd.Flags().GetString("listen")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Log.Info("Serving " + cmd.Name() + " credential endpoint on " + listen)
+	if err := serveHTTP(ctx, listen, handler); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(ServeMetadataCmd)
+
+	ServeMetadataCmd.PersistentFlags().String("listen", "127.0.0.1:8099", "Address the credential endpoint listens on (optional)")
+	ServeMetadataCmd.PersistentFlags().String("authtoken", "", "Token clients have to present (AWS_CONTAINER_AUTHORIZATION_TOKEN, IDENTITY_HEADER), defaults to $K8XAUTH_METADATA_AUTH_TOKEN (optional)")
+	AddPolicyFlag(ServeMetadataCmd.PersistentFlags())
+}
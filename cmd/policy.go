@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+	"k8xauth/internal/policy"
+
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+// loadedPolicy is a policy file compiled once, and again when it is modified.
+type loadedPolicy struct {
+	modTime time.Time
+	policy  *policy.Policy
+}
+
+var (
+	policiesMu sync.Mutex
+	policies   = map[string]loadedPolicy{}
+
+	// installPolicyFile is the policy of the installation, checked whenever it exists.
+	installPolicyFile = policy.INSTALL_POLICY_FILE
+
+	// policyFile is the policy of the process, $K8XAUTH_POLICY_FILE or the --policyfile flag of the
+	// serving commands. Target flags and requests can't set it, so exec args can't disable the policy.
+	// policyFileEnvSet reports whether $K8XAUTH_POLICY_FILE is set, set empty it fails the checks closed
+	// rather than disabling the policy.
+	policyFile, policyFileEnvSet = os.LookupEnv(policy.POLICY_FILE_ENV)
+)
+
+// AddPolicyFlag defines the --policyfile flag of a serving command on the flag set, setting the policy
+// of the process.
+func AddPolicyFlag(fs *pflag.FlagSet) {
+	fs.StringVar(&policyFile, "policyfile", policyFile, "Policy of CEL expressions over the source token claims and target flags checked before any token exchange, defaults to $K8XAUTH_POLICY_FILE (optional)")
+}
+
+// policyFiles returns the policies checked by the process, the installation policy if it exists and the
+// policy of the process if set.
+func policyFiles() ([]string, error) {
+	var paths []string
+	if _, err := os.Stat(installPolicyFile); err == nil {
+		paths = append(paths, installPolicyFile)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("couldn't read policy: %w", err)
+	}
+
+	if policyFile == "" {
+		if policyFileEnvSet {
+			return nil, fmt.Errorf("$%s is set empty, unset it to run without a policy", policy.POLICY_FILE_ENV)
+		}
+		return paths, nil
+	}
+	if policyFile != installPolicyFile {
+		paths = append(paths, policyFile)
+	}
+	return paths, nil
+}
+
+// loadPolicy returns the compiled policy of the file.
+func loadPolicy(path string) (*policy.Policy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read policy: %w", err)
+	}
+
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	if l, ok := policies[path]; ok && l.modTime.Equal(info.ModTime()) {
+		return l.policy, nil
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	policies[path] = loadedPolicy{modTime: info.ModTime(), policy: p}
+	return p, nil
+}
+
+// policyFlags returns the values of the target, discovery and list flags set on the flag set, lists for
+// slice flags and maps for map flags.
+func policyFlags(t Target, flags *pflag.FlagSet) map[string]any {
+	defined := []func(fs *pflag.FlagSet){t.Flags}
+	if t.DiscoveryFlags != nil {
+		defined = append(defined, t.DiscoveryFlags)
+	}
+	if t.ListFlags != nil {
+		defined = append(defined, t.ListFlags)
+	}
+
+	values := map[string]any{}
+	for _, define := range defined {
+		fs := pflag.NewFlagSet(t.Name, pflag.ContinueOnError)
+		define(fs)
+		fs.VisitAll(func(f *pflag.Flag) {
+			flag := flags.Lookup(f.Name)
+			if flag == nil {
+				return
+			}
+
+			if value, ok := flag.Value.(pflag.SliceValue); ok {
+				values[f.Name] = value.GetSlice()
+				return
+			}
+
+			switch flag.Value.Type() {
+			case "stringToString":
+				values[f.Name], _ = flags.GetStringToString(f.Name)
+			case "bool":
+				values[f.Name], _ = flags.GetBool(f.Name)
+			default:
+				values[f.Name] = flag.Value.String()
+			}
+		})
+	}
+	return values
+}
+
+// processSourceClaims returns the claims of the source identity token of the process, read with the root
+// command persistent flags of the process rather than the source options of the request, so requests
+// can't choose the claims the policy checks.
+func processSourceClaims(o *auth.Options) (*auth.SourceClaims, error) {
+	options, err := FlagsAuthOptions(RootCmd.PersistentFlags(), o.ClusterServer)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ReadSourceClaims(&options)
+}
+
+// CheckPolicy checks the request of the target credentials for the flags against the policies of the
+// installation and the process, if any, before any token is exchanged. Denials are logged as audit
+// entries.
+func (t Target) CheckPolicy(flags *pflag.FlagSet, o *auth.Options) error {
+	paths, err := policyFiles()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	source, err := processSourceClaims(o)
+	if err != nil {
+		return fmt.Errorf("couldn't read source identity checked by policy: %w", err)
+	}
+
+	request := policy.Request{
+		Source: source,
+		Target: t.Name,
+		Flags:  policyFlags(t, flags),
+		Server: o.ClusterServer,
+	}
+
+	for _, path := range paths {
+		p, err := loadPolicy(path)
+		if err != nil {
+			return err
+		}
+
+		err = p.Check(request)
+
+		var denied *policy.DeniedError
+		if errors.As(err, &denied) {
+			logger.Audit.Warn("Audit: policy denied credentials",
+				"policy", path,
+				"target", denied.Target,
+				"rule", denied.Rule,
+				"reason", denied.Message,
+				"platform", denied.Platform,
+				"issuer", denied.Issuer,
+				"subject", denied.Subject,
+				"args", targetArgs(flags, t),
+				"server", o.ClusterServer,
+			)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Allowed requests are only logged at debug level, exec plugins run for every Kubernetes client
+	logger.Log.Debug("Audit: policy allowed credentials",
+		"target", t.Name,
+		"platform", source.Platform,
+		"issuer", source.Issuer,
+		"subject", source.Subject,
+		"args", targetArgs(flags, t),
+		"server", o.ClusterServer,
+	)
+	return nil
+}
+
+// Authorize checks the request against the policy and returns the target retrieving the credentials
+// without checking it again, for callers looking up cached credentials first.
+func (t Target) Authorize(flags *pflag.FlagSet, o *auth.Options) (Target, error) {
+	if err := t.CheckPolicy(flags, o); err != nil {
+		return Target{}, err
+	}
+	if t.unguarded != nil {
+		return *t.unguarded, nil
+	}
+	return t, nil
+}
+
+// guarded returns the target checking the policy before retrieving credentials, discovering or
+// listing clusters.
+func (t Target) guarded() Target {
+	if t.unguarded != nil {
+		return t
+	}
+	g := t
+	g.unguarded = &t
+
+	token := t.Token
+	g.Token = func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+		if err := t.CheckPolicy(flags, o); err != nil {
+			return nil, err
+		}
+		return token(flags, o)
+	}
+
+	if discover := t.Discover; discover != nil {
+		g.Discover = func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+			if err := t.CheckPolicy(flags, o); err != nil {
+				return nil, err
+			}
+			return discover(flags, o)
+		}
+	}
+
+	if list := t.List; list != nil {
+		g.List = func(flags *pflag.FlagSet, o *auth.Options) ([]inventory.Cluster, []error) {
+			if err := t.CheckPolicy(flags, o); err != nil {
+				return nil, []error{err}
+			}
+			return list(flags, o)
+		}
+	}
+
+	return g
+}
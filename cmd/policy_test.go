@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/testutil"
+
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+const testPolicy = `rules:
+  - name: prod-only
+    match: target.name == "policytest"
+    expression: target.flags.cluster == "prod" && source.subject == "system:serviceaccount:argocd:app"
+    message: only prod cluster credentials
+`
+
+// policyTestTarget returns the test target retrieving the tokens of the fake target.
+func policyTestTarget(fake *testutil.Target) Target {
+	return Target{
+		Name:  "policytest",
+		Flags: fake.Flags,
+		Token: fake.Token,
+	}
+}
+
+// setTestPolicy sets the policy of the process to the policy written to a file.
+func setTestPolicy(t *testing.T, content string) {
+	t.Helper()
+	path := testutil.PolicyFile(t, content)
+
+	previous := policyFile
+	t.Cleanup(func() { policyFile = previous })
+	policyFile = path
+}
+
+// testSourceOptions sets the source of the process to a file source token of the subject and returns
+// its options.
+func testSourceOptions(t *testing.T, subject string) *auth.Options {
+	t.Helper()
+	path := testutil.SourceTokenFile(t, subject)
+	testutil.SetFlags(t, RootCmd.PersistentFlags(), map[string]string{"authsource": "file", "sourcetokenfile": path})
+	return &auth.Options{AuthType: "file", SourceTokenFile: path}
+}
+
+func TestPolicyFileNotTargetFlag(t *testing.T) {
+	p := &testutil.Target{}
+	target := policyTestTarget(p)
+
+	if err := target.NewFlagSet().Parse([]string{"--cluster=prod", "--policyfile="}); err == nil {
+		t.Error("target flag set accepted --policyfile")
+	}
+
+	flags := pflag.NewFlagSet(target.Name, pflag.ContinueOnError)
+	target.Flags(flags)
+	err := target.ParseRequestArgs(flags, []string{"--cluster=prod", "--policyfile="}, pflag.NewFlagSet("process", pflag.ContinueOnError))
+	if err == nil || !strings.Contains(err.Error(), "policyfile") {
+		t.Errorf("ParseRequestArgs error = %v, want --policyfile rejected", err)
+	}
+}
+
+func TestPolicyFiles(t *testing.T) {
+	previousInstall, previousFile, previousSet := installPolicyFile, policyFile, policyFileEnvSet
+	t.Cleanup(func() { installPolicyFile, policyFile, policyFileEnvSet = previousInstall, previousFile, previousSet })
+
+	p := &testutil.Target{}
+	target := policyTestTarget(p)
+	flags := target.NewFlagSet()
+	if err := flags.Parse([]string{"--cluster=dev"}); err != nil {
+		t.Fatal(err)
+	}
+	o := testSourceOptions(t, "system:serviceaccount:argocd:app")
+
+	// The installation policy is checked without any policy set for the process
+	installPolicyFile = testutil.PolicyFile(t, testPolicy)
+	policyFile, policyFileEnvSet = "", false
+	if err := target.CheckPolicy(flags, o); err == nil || !strings.Contains(err.Error(), "only prod cluster credentials") {
+		t.Errorf("CheckPolicy error = %v, want installation policy denial", err)
+	}
+
+	// $K8XAUTH_POLICY_FILE set empty doesn't disable the policy
+	installPolicyFile = filepath.Join(t.TempDir(), "missing.yaml")
+	policyFile, policyFileEnvSet = "", true
+	if err := target.CheckPolicy(flags, o); err == nil || !strings.Contains(err.Error(), "set empty") {
+		t.Errorf("CheckPolicy error = %v, want empty policy file rejected", err)
+	}
+
+	policyFileEnvSet = false
+	if err := target.CheckPolicy(flags, o); err != nil {
+		t.Errorf("CheckPolicy without policy: %v", err)
+	}
+}
+
+func TestPolicyProcessSource(t *testing.T) {
+	setTestPolicy(t, testPolicy)
+	p := &testutil.Target{}
+	target := policyTestTarget(p)
+	flags := target.NewFlagSet()
+	if err := flags.Parse([]string{"--cluster=prod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claims are read from the source of the process, not the source options of the request
+	testSourceOptions(t, "system:serviceaccount:default:other")
+	requested := &auth.Options{AuthType: "file", SourceTokenFile: testutil.SourceTokenFile(t, "system:serviceaccount:argocd:app")}
+	if err := target.CheckPolicy(flags, requested); err == nil || !strings.Contains(err.Error(), "only prod cluster credentials") {
+		t.Errorf("CheckPolicy error = %v, want denial of the process source", err)
+	}
+}
+
+func TestGuardedTarget(t *testing.T) {
+	setTestPolicy(t, testPolicy)
+	p := &testutil.Target{}
+	g := policyTestTarget(p).guarded()
+
+	tests := []struct {
+		name    string
+		cluster string
+		subject string
+		wantErr bool
+	}{
+		{name: "allowed", cluster: "prod", subject: "system:serviceaccount:argocd:app"},
+		{name: "denied cluster", cluster: "dev", subject: "system:serviceaccount:argocd:app", wantErr: true},
+		{name: "denied source", cluster: "prod", subject: "system:serviceaccount:default:other", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := g.NewFlagSet()
+			if err := flags.Parse([]string{"--cluster=" + tt.cluster}); err != nil {
+				t.Fatal(err)
+			}
+
+			tokens := p.Tokens
+			_, err := g.Token(flags, testSourceOptions(t, tt.subject))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "only prod cluster credentials") {
+					t.Errorf("error = %v, want denial", err)
+				}
+				if p.Tokens != tokens {
+					t.Error("token retrieved for denied request")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Token: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	setTestPolicy(t, testPolicy)
+	p := &testutil.Target{}
+	g := policyTestTarget(p).guarded()
+	o := testSourceOptions(t, "system:serviceaccount:argocd:app")
+
+	flags := g.NewFlagSet()
+	flags.Parse([]string{"--cluster=dev"})
+	if _, err := g.Authorize(flags, o); err == nil {
+		t.Error("Authorize allowed denied request")
+	}
+
+	flags = g.NewFlagSet()
+	flags.Parse([]string{"--cluster=prod"})
+	unguarded, err := g.Authorize(flags, o)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	// The authorized target doesn't check the policy again, the guarded one does
+	policyFile = filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := unguarded.Token(flags, o); err != nil {
+		t.Errorf("authorized target Token: %v", err)
+	}
+	if _, err := g.Token(flags, o); err == nil {
+		t.Error("guarded target Token didn't check the policy")
+	}
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"k8xauth/internal/cache"
+	"k8xauth/internal/logger"
+
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+// ProxyCmd represents the proxy command, with a subcommand for every target.
+var ProxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Serves an authenticating reverse proxy to the target cluster API server",
+	Long: `Serves a local reverse proxy to the target cluster API server injecting a bearer token
+retrieved by the target flow into every request, for clients that can't use exec credentials.
+The token is renewed before it expires and when the API server rejects it, watch requests are
+streamed and exec, attach and port-forward connections are upgraded through the proxy`,
+	Example: `k8xauth proxy --listen 127.0.0.1:8001 --server "https://ABCDEF0123456789.gr7.us-east-2.eks.amazonaws.com" --certificateauthoritydata "LS0tLS1CRUdJTi..." eks --rolearn "arn:aws:iam::123456789012:role/argocd" --cluster "my-cluster-name"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// proxyToken is the bearer token injected by the proxy, retrieved again when it is about to expire
+// or was rejected by the API server.
+type proxyToken struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+	skew  time.Duration
+	fetch func() (*oauth2.Token, error)
+}
+
+func (p *proxyToken) get() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != nil && (p.token.Expiry.IsZero() || time.Until(p.token.Expiry) > p.skew) {
+		return p.token.AccessToken, nil
+	}
+
+	token, err := p.fetch()
+	if err != nil {
+		return "", err
+	}
+	p.token = token
+
+	return token.AccessToken, nil
+}
+
+// invalidate drops the token if it is still the rejected one.
+func (p *proxyToken) invalidate(rejected string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != nil && p.token.AccessToken == rejected {
+		p.token = nil
+	}
+}
+
+// proxyTransport returns the transport to the API server trusting the cluster CA, if set.
+func proxyTransport(caFile string, caData []byte) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connection upgrades are only supported over HTTP/1.1
+	transport.ForceAttemptHTTP2 = false
+
+	if len(caData) == 0 && caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read cluster CA certificate: %w", err)
+		}
+		caData = data
+	}
+
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no PEM encoded certificates found in cluster CA certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return transport, nil
+}
+
+// runProxy serves the reverse proxy to the --server API server authenticated by the target until interrupted.
+func runProxy(cmd *cobra.Command, t Target) {
+	listen, _ := cmd.Flags().GetString("listen")
+	server, _ := cmd.Flags().GetString("server")
+	caFile, _ := cmd.Flags().GetString("certificateauthority")
+	caData, _ := cmd.Flags().GetBytesBase64("certificateauthoritydata")
+	skew, _ := cmd.Flags().GetDuration("cacheskew")
+
+	target, err := url.Parse(server)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		logger.Log.Error(fmt.Sprintf("Invalid --server %q, expected API server URL such as https://cluster.example.com", server))
+		os.Exit(1)
+	}
+
+	transport, err := proxyTransport(caFile, caData)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+	options.ClusterServer = server
+	options.Cache = cache.NewMemory(skew, "")
+	options.CacheKey = ""
+
+	token := &proxyToken{
+		skew: skew,
+		fetch: func() (*oauth2.Token, error) {
+			return t.Token(cmd.Flags(), &options)
+		},
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+		},
+		Transport: transport,
+		// Watch responses are streamed as they are received
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusUnauthorized {
+				logger.Log.Debug("Token rejected by API server, renewing it")
+				token.invalidate(bearerToken(resp.Request.Header.Get("Authorization")))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Log.Error(fmt.Sprintf("Proxying %s %s failed: %s", r.Method, r.URL.Path, err.Error()))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, err := token.get()
+		if err != nil {
+			logger.Log.Error(fmt.Sprintf("Couldn't retrieve %s credentials: %s", t.Name, err.Error()))
+			http.Error(w, "couldn't retrieve cluster credentials", http.StatusBadGateway)
+			return
+		}
+		// Client credentials are replaced, the proxy authenticates with the target identity
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		proxy.ServeHTTP(w, r)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Log.Info(fmt.Sprintf("Proxying %s on %s", server, listen))
+	if err := serveHTTP(ctx, listen, handler); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// bearerToken returns the token of the Authorization header value.
+func bearerToken(header string) string {
+	if len(header) > 7 && header[:7] == "Bearer " {
+		return header[7:]
+	}
+	return ""
+}
+
+func init() {
+	RootCmd.AddCommand(ProxyCmd)
+	addTargetRunner(ProxyCmd, runProxy)
+
+	ProxyCmd.PersistentFlags().String("listen", "127.0.0.1:8001", "Address the proxy listens on (optional)")
+	ProxyCmd.PersistentFlags().String("server", "", "Target cluster API server URL (required)")
+	ProxyCmd.PersistentFlags().String("certificateauthority", "", "Path of the PEM encoded cluster CA certificate, system roots are trusted if not set (optional)")
+	ProxyCmd.PersistentFlags().BytesBase64("certificateauthoritydata", nil, "Base64 encoded PEM cluster CA certificate, overrides --certificateauthority (optional)")
+	AddPolicyFlag(ProxyCmd.PersistentFlags())
+	ProxyCmd.MarkPersistentFlagRequired("server")
+}
@@ -1,11 +1,36 @@
 package cmd
 
 import (
+	"k8xauth/internal/agent"
+	"k8xauth/internal/auth"
+	"k8xauth/internal/broker"
+	"k8xauth/internal/cache"
+	"k8xauth/internal/credwriter"
 	"k8xauth/internal/logger"
 
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// cacheKeyIgnoredFlags are flags not affecting credentials, excluded from the cache key
+	cacheKeyIgnoredFlags = map[string]bool{
+		"printsourceauthtoken":       true,
+		"cache":                      true,
+		"cachedir":                   true,
+		"cachekeyfile":               true,
+		"cacheskew":                  true,
+		"cachelocktimeout":           true,
+		"agentsocket":                true,
+		"brokertokenfile":            true,
+		"brokercertificateauthority": true,
+		"loglevel":                   true,
+		"logformat":                  true,
+		"logfile":                    true,
+	}
 )
 
 var (
@@ -26,12 +51,96 @@ without the need to use long-term credentials.`,
 		logFile, _ := cmd.Flags().GetString("logfile")
 
 		logger.New(logLevel, logFormat, logFile)
+		logger.NewAudit(logFormat)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
 }
 
+// AuthOptions returns source authentication options set by the root command persistent flags, with
+// the credential cache if enabled.
+func AuthOptions(cmd *cobra.Command) (auth.Options, error) {
+	clusterServer, _ := credwriter.GetClusterServerFromExecInfoEnv()
+
+	options, err := FlagsAuthOptions(cmd.Flags(), clusterServer)
+	if err != nil {
+		return auth.Options{}, err
+	}
+
+	if enabled, _ := cmd.Flags().GetBool("cache"); enabled {
+		dir, _ := cmd.Flags().GetString("cachedir")
+		keyFile, _ := cmd.Flags().GetString("cachekeyfile")
+		skew, _ := cmd.Flags().GetDuration("cacheskew")
+		lockTimeout, _ := cmd.Flags().GetDuration("cachelocktimeout")
+
+		c, err := cache.New(cache.Options{
+			Dir:            dir,
+			KeyFile:        keyFile,
+			Skew:           skew,
+			SourceIdentity: auth.SourceIdentity(&options),
+			LockTimeout:    lockTimeout,
+		})
+		if err != nil {
+			// Credentials are still retrieved without the cache
+			logger.Log.Debug("Credential cache disabled: " + err.Error())
+		} else {
+			options.Cache = c
+			options.CacheKey = c.Key(CacheKeyParts(cmd.CommandPath(), cmd.Flags(), clusterServer)...)
+		}
+	}
+
+	return options, nil
+}
+
+// FlagsAuthOptions returns source authentication options set by the root persistent flags in the flag
+// set, for the target cluster API server. The credential cache is not set.
+func FlagsAuthOptions(flags *pflag.FlagSet, clusterServer string) (auth.Options, error) {
+	options := auth.Options{
+		AuthType:         flags.Lookup("authsource").Value.String(),
+		PrintSourceToken: flags.Lookup("printsourceauthtoken").Value.String() == "true",
+		SourceTokenFile:  flags.Lookup("sourcetokenfile").Value.String(),
+		ClusterServer:    clusterServer,
+	}
+
+	options.AzureDisableInstanceDiscovery, _ = flags.GetBool("azuredisableinstancediscovery")
+
+	// Azure cloud is only set when configured so the AZURE_AUTHORITY_HOST environment variable is honoured otherwise
+	if flags.Changed("azurecloud") || flags.Changed("azureauthorityhost") || flags.Changed("azurearmendpoint") {
+		azureCloud, err := auth.AzureCloudConfiguration(
+			flags.Lookup("azurecloud").Value.String(),
+			flags.Lookup("azureauthorityhost").Value.String(),
+			flags.Lookup("azurearmendpoint").Value.String(),
+		)
+		if err != nil {
+			return auth.Options{}, err
+		}
+		options.AzureCloud = &azureCloud
+	}
+
+	return options, nil
+}
+
+// CacheKeyParts returns the command path, the flags affecting credentials and the target cluster
+// API server, identifying credentials of the invocation.
+func CacheKeyParts(commandPath string, flags *pflag.FlagSet, clusterServer string) []string {
+	parts := []string{commandPath}
+
+	// Flags are visited in lexicographical order
+	flags.VisitAll(func(f *pflag.Flag) {
+		if cacheKeyIgnoredFlags[f.Name] {
+			return
+		}
+		parts = append(parts, f.Name+"="+f.Value.String())
+	})
+
+	if clusterServer != "" {
+		parts = append(parts, "server="+clusterServer)
+	}
+
+	return parts
+}
+
 func Execute() {
 	err := RootCmd.Execute()
 	if err != nil {
@@ -39,10 +148,29 @@ func Execute() {
 	}
 }
 
+// persistentFlags defines the root command persistent flags on the flag set.
+func persistentFlags(fs *pflag.FlagSet) {
+	fs.String("authsource", "all", "Authentication source to use [gke|eks|aks|all|file] (optional)")
+	fs.String("sourcetokenfile", "", "Path to an external identity provider token used with --authsource file, defaults to $K8XAUTH_SOURCE_TOKEN_FILE (optional)")
+	fs.Bool("printsourceauthtoken", false, "Print source authentication token, useful for debugging. May expose sensitive data")
+	fs.String("azurecloud", auth.AZURE_PUBLIC, "Azure cloud used by Azure source and targets [AzurePublic|AzureUSGovernment|AzureChina] (optional)")
+	fs.String("azureauthorityhost", "", "Custom Microsoft Entra authority host, overrides the --azurecloud one (optional)")
+	fs.String("azurearmendpoint", "", "Custom Azure Resource Manager endpoint, overrides the --azurecloud one (optional)")
+	fs.Bool("azuredisableinstancediscovery", true, "Disable Microsoft Entra instance discovery, must be disabled for disconnected and private clouds (optional)")
+	fs.Bool("cache", false, "Cache credentials encrypted on disk and share them across invocations (optional)")
+	fs.String("cachedir", cache.DefaultDir(), "Credential cache directory (optional)")
+	fs.String("cachekeyfile", "", "File with base64 encoded 32 byte credential cache encryption key outside --cachedir, defaults to $K8XAUTH_CACHE_KEY or a key generated in the user configuration directory (optional)")
+	fs.Duration("cacheskew", 2*time.Minute, "Refresh cached credentials this long before they expire (optional)")
+	fs.Duration("cachelocktimeout", 30*time.Second, "Longest time to wait for a concurrent invocation retrieving the same credentials, locks held twice as long are considered stale (optional)")
+	fs.String("agentsocket", agent.DefaultSocket(), "Credential agent socket, credentials are retrieved by the agent when it is listening on it, defaults to $K8XAUTH_AGENT_SOCKET if set (optional)")
+	fs.String("broker", os.Getenv(broker.BROKER_ENV), "Credential broker URL credentials are requested from instead of retrieving them, defaults to $K8XAUTH_BROKER (optional)")
+	fs.String("brokertokenfile", broker.DEFAULT_TOKEN_FILE, "Kubernetes ServiceAccount token the broker authenticates the caller with (optional)")
+	fs.String("brokercertificateauthority", "", "Path of the PEM encoded broker CA certificate, system roots are trusted if not set (optional)")
+	fs.String("loglevel", "info", "Set log level (optional)")
+	fs.String("logformat", "text", "Set log format [text|json] (optional)")
+	fs.String("logfile", "", "Set log file. If not set logs are sent to standard output (optional)")
+}
+
 func init() {
-	RootCmd.PersistentFlags().String("authsource", "all", "Authentication source to use [gke|eks|aks|all] (optional)")
-	RootCmd.PersistentFlags().Bool("printsourceauthtoken", false, "Print source authentication token, useful for debugging. May expose sensitive data")
-	RootCmd.PersistentFlags().String("loglevel", "info", "Set log level (optional)")
-	RootCmd.PersistentFlags().String("logformat", "text", "Set log format [text|json] (optional)")
-	RootCmd.PersistentFlags().String("logfile", "", "Set log file. If not set logs are sent to standard output (optional)")
+	persistentFlags(RootCmd.PersistentFlags())
 }
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// serveHTTP serves the handler on the address until the context is done, then shuts the server down gracefully.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	return serveHTTPTLS(ctx, addr, handler, "", "")
+}
+
+// serveHTTPTLS serves the handler on the address like serveHTTP, over TLS with the PEM encoded certificate
+// and key files if set.
+func serveHTTPTLS(ctx context.Context, addr string, handler http.Handler, certFile, keyFile string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if certFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"k8xauth/internal/agent"
+	"k8xauth/internal/auth"
+	"k8xauth/internal/broker"
+	"k8xauth/internal/credwriter"
+	"k8xauth/internal/inventory"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+// Target is a target platform command retrieving cluster credentials. Targets are registered so the
+// credentials can be retrieved outside of their command, e.g. by the credential agent.
+type Target struct {
+	// Name is the target command name.
+	Name string
+	// Flags defines the target command flags on the flag set.
+	Flags func(fs *pflag.FlagSet)
+	// Required are names of the required flags.
+	Required []string
+	// Token retrieves the credentials for the flags set.
+	Token func(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error)
+	// Uncacheable reports whether the credentials for the flags set must not be cached, optional.
+	Uncacheable func(flags *pflag.FlagSet) bool
+	// DiscoveryFlags defines flags identifying the cluster in the target cloud API, optional.
+	DiscoveryFlags func(fs *pflag.FlagSet)
+	// Discover retrieves the cluster API server endpoint and CA from the target cloud API, optional.
+	Discover func(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error)
+	// ListFlags defines flags selecting the accounts and locations clusters are listed in, optional.
+	ListFlags func(fs *pflag.FlagSet)
+	// List lists clusters in the target cloud API, with errors of the accounts and locations that
+	// couldn't be listed, optional. Listed cluster Flags identify the cluster among the target flags.
+	List func(flags *pflag.FlagSet, o *auth.Options) ([]inventory.Cluster, []error)
+
+	// unguarded is the target without the policy checks, set on targets whose Token, Discover and
+	// List check the policy first.
+	unguarded *Target
+}
+
+// targetRunner is a command running targets, with a subcommand for every registered target.
+type targetRunner struct {
+	parent *cobra.Command
+	run    func(cmd *cobra.Command, t Target)
+	// applies reports whether the runner runs the target, all targets are run if not set.
+	applies func(t Target) bool
+	// flags defines the target flags on the subcommand, the target command flags if not set.
+	flags func(t Target, cmd *cobra.Command)
+}
+
+var (
+	targets       = map[string]Target{}
+	targetRunners []targetRunner
+)
+
+// addTargetRunner adds a subcommand of the parent running the target for every registered target.
+func addTargetRunner(parent *cobra.Command, run func(cmd *cobra.Command, t Target)) {
+	targetRunners = append(targetRunners, targetRunner{parent: parent, run: run})
+}
+
+// addDiscoveryRunner adds a subcommand of the parent running the target for every registered target
+// discovering its clusters.
+func addDiscoveryRunner(parent *cobra.Command, run func(cmd *cobra.Command, t Target)) {
+	targetRunners = append(targetRunners, targetRunner{
+		parent: parent,
+		run:    run,
+		applies: func(t Target) bool {
+			return t.Discover != nil
+		},
+		flags: func(t Target, cmd *cobra.Command) {
+			t.addFlags(cmd)
+			if t.DiscoveryFlags != nil {
+				t.DiscoveryFlags(cmd.Flags())
+			}
+		},
+	})
+}
+
+// addListRunner adds a subcommand of the parent running the target for every registered target
+// listing its clusters. Flags identifying a single cluster are not required by the subcommands.
+func addListRunner(parent *cobra.Command, run func(cmd *cobra.Command, t Target)) {
+	targetRunners = append(targetRunners, targetRunner{
+		parent: parent,
+		run:    run,
+		applies: func(t Target) bool {
+			return t.List != nil
+		},
+		flags: func(t Target, cmd *cobra.Command) {
+			t.Flags(cmd.Flags())
+			if t.ListFlags != nil {
+				t.ListFlags(cmd.Flags())
+			}
+		},
+	})
+}
+
+// RegisterTarget registers the target, adds its command to the root command and a subcommand
+// running it to the target runner commands. Registered targets check the policy before retrieving
+// credentials.
+func RegisterTarget(cmd *cobra.Command, t Target) {
+	t = t.guarded()
+	targets[t.Name] = t
+
+	t.addFlags(cmd)
+	RootCmd.AddCommand(cmd)
+
+	for _, r := range targetRunners {
+		if r.applies != nil && !r.applies(t) {
+			continue
+		}
+
+		run := r.run
+		sub := &cobra.Command{
+			Use:   t.Name,
+			Short: cmd.Short,
+			Run: func(cmd *cobra.Command, args []string) {
+				run(cmd, t)
+			},
+		}
+		if r.flags != nil {
+			r.flags(t, sub)
+		} else {
+			t.addFlags(sub)
+		}
+		r.parent.AddCommand(sub)
+	}
+}
+
+// addFlags defines the target flags on the command.
+func (t Target) addFlags(cmd *cobra.Command) {
+	t.Flags(cmd.Flags())
+	for _, name := range t.Required {
+		cmd.MarkFlagRequired(name)
+	}
+}
+
+// LookupTarget returns the registered target with the name.
+func LookupTarget(name string) (Target, bool) {
+	t, ok := targets[name]
+	return t, ok
+}
+
+// TargetNames returns names of the registered targets, sorted.
+func TargetNames() []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFlagSet returns a new flag set with the root command persistent flags and the target flags.
+func (t Target) NewFlagSet() *pflag.FlagSet {
+	fs := pflag.NewFlagSet(t.Name, pflag.ContinueOnError)
+	persistentFlags(fs)
+	t.Flags(fs)
+	return fs
+}
+
+// requestDeniedFlags are target flags requests can't set, as they would use files or interactive
+// credentials of the process serving them.
+var requestDeniedFlags = map[string]bool{
+	"popkeyfile":      true,
+	"credentialchain": true,
+	"printserverurl":  true,
+}
+
+// delegable reports whether the credentials for the flags can be requested from a process serving them
+// with its own identity, requests can't set the requestDeniedFlags.
+func (t Target) delegable(flags *pflag.FlagSet) bool {
+	for name := range requestDeniedFlags {
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRequestArgs parses the target flags of a request served with the identity of the process, e.g.
+// by the broker or the controller, into the flag set of the target. Root command persistent flags
+// configure the source identity of the process, requests can't set them and they are copied from the
+// process flags.
+func (t Target) ParseRequestArgs(flags *pflag.FlagSet, args []string, processFlags *pflag.FlagSet) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	var denied []string
+	flags.Visit(func(f *pflag.Flag) {
+		if RootCmd.PersistentFlags().Lookup(f.Name) != nil || requestDeniedFlags[f.Name] {
+			denied = append(denied, "--"+f.Name)
+		}
+	})
+	if len(denied) > 0 {
+		return fmt.Errorf("flags %s can't be set in requests", strings.Join(denied, ", "))
+	}
+	for _, name := range t.Required {
+		if !flags.Changed(name) {
+			return fmt.Errorf("required flag --%s not set", name)
+		}
+	}
+
+	var err error
+	processFlags.Visit(func(f *pflag.Flag) {
+		if err == nil && RootCmd.PersistentFlags().Lookup(f.Name) != nil {
+			err = flags.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// Cacheable reports whether the credentials for the flags set can be cached.
+func (t Target) Cacheable(flags *pflag.FlagSet) bool {
+	return t.Uncacheable == nil || !t.Uncacheable(flags)
+}
+
+// WriteCredentials writes the ExecCredential of the target command to standard output. Credentials are
+// requested from the broker if set, retrieved by the credential agent when it is listening on the agent
+// socket, in process otherwise. The broker and agent check the request against their own policy, the
+// policy of the process is checked before the agent is asked.
+func WriteCredentials(cmd *cobra.Command, t Target) {
+	writer := credwriter.ExecCredentialWriter{}
+	clusterServer, _ := credwriter.GetClusterServerFromExecInfoEnv()
+
+	if brokerURL, _ := cmd.Flags().GetString("broker"); brokerURL != "" {
+		token, err := brokerToken(cmd, t, brokerURL, clusterServer)
+		if err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		if err := writer.Write(*token, os.Stdout); err != nil {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Credentials of the agent and cached credentials are only returned to requests the policy allows
+	t, err = t.Authorize(cmd.Flags(), &options)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// The agent retrieves credentials with its own root flags, flags requests can't set are retrieved in process
+	if t.delegable(cmd.Flags()) {
+		socket, _ := cmd.Flags().GetString("agentsocket")
+		token, err := agent.Token(context.Background(), socket, agent.Request{
+			Target:        t.Name,
+			Args:          targetArgs(cmd.Flags(), t),
+			ClusterServer: clusterServer,
+		})
+		if err == nil {
+			logger.Log.Debug("Credentials retrieved by agent listening on " + socket)
+			if err := writer.Write(*token, os.Stdout); err != nil {
+				logger.Log.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+		if !errors.Is(err, agent.ErrUnavailable) {
+			logger.Log.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	cacheKey := options.CacheKey
+	if !t.Cacheable(cmd.Flags()) {
+		cacheKey = ""
+	}
+
+	err = writer.WriteCached(options.Cache, cacheKey, func() (*oauth2.Token, error) {
+		return t.Token(cmd.Flags(), &options)
+	}, os.Stdout)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// brokerToken requests credentials of the target command from the broker, authenticated with the
+// --brokertokenfile token.
+func brokerToken(cmd *cobra.Command, t Target, brokerURL, clusterServer string) (*oauth2.Token, error) {
+	tokenFile, _ := cmd.Flags().GetString("brokertokenfile")
+	caFile, _ := cmd.Flags().GetString("brokercertificateauthority")
+
+	callerToken, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read broker token: %w", err)
+	}
+
+	client, err := broker.NewHTTPClient(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Log.Debug("Requesting credentials from broker " + brokerURL)
+	return broker.Token(context.Background(), client, brokerURL, strings.TrimSpace(string(callerToken)), broker.Request{
+		Target:        t.Name,
+		Args:          targetArgs(cmd.Flags(), t),
+		ClusterServer: clusterServer,
+	})
+}
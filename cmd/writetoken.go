@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"k8xauth/internal/cache"
+	"k8xauth/internal/credwriter"
+	"k8xauth/internal/kubeconfig"
+	"k8xauth/internal/logger"
+
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	WRITE_TOKEN_MIN_INTERVAL = 10 * time.Second
+	WRITE_TOKEN_MAX_BACKOFF  = 5 * time.Minute
+)
+
+// WriteTokenCmd represents the write-token command, with a subcommand for every target.
+var WriteTokenCmd = &cobra.Command{
+	Use:   "write-token",
+	Short: "Writes target credentials to a file, refreshing them before expiry",
+	Long: `Writes target bearer token to a file and atomically replaces it before the token expires,
+for tools reading a token from a file that can't run an exec credential plugin (Prometheus,
+Flux, Terraform providers). Runs as a sidecar until terminated, optionally writing a
+kubeconfig with the token next to it and serving readiness of the written token`,
+	Example: `k8xauth write-token --out /var/run/k8xauth/token eks --rolearn "arn:aws:iam::123456789012:role/prometheus" --cluster "my-cluster-name"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// tokenFile tracks expiry of the last written token for the readiness endpoint.
+type tokenFile struct {
+	mu     sync.Mutex
+	expiry time.Time
+	ready  bool
+}
+
+func (f *tokenFile) written(expiry time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expiry = expiry
+	f.ready = true
+}
+
+// isReady reports whether a token was written and it has not expired yet.
+func (f *tokenFile) isReady() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ready && (f.expiry.IsZero() || time.Now().Before(f.expiry))
+}
+
+// runWriteToken writes the target token to the --out file until interrupted.
+func runWriteToken(cmd *cobra.Command, t Target) {
+	out, _ := cmd.Flags().GetString("out")
+	kubeconfigPath, _ := cmd.Flags().GetString("kubeconfig")
+	server, _ := cmd.Flags().GetString("server")
+	caFile, _ := cmd.Flags().GetString("certificateauthority")
+	caData, _ := cmd.Flags().GetBytesBase64("certificateauthoritydata")
+	readiness, _ := cmd.Flags().GetString("readiness")
+	once, _ := cmd.Flags().GetBool("once")
+	refreshBefore, _ := cmd.Flags().GetDuration("refreshbefore")
+	fileModeFlag, _ := cmd.Flags().GetString("filemode")
+	skew, _ := cmd.Flags().GetDuration("cacheskew")
+
+	fileMode, err := strconv.ParseUint(fileModeFlag, 8, 32)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Invalid --filemode %q, expected octal permissions such as 0600", fileModeFlag))
+		os.Exit(1)
+	}
+
+	if kubeconfigPath != "" && server == "" {
+		logger.Log.Error("--server is required to write --kubeconfig")
+		os.Exit(1)
+	}
+
+	options, err := AuthOptions(cmd)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+	if server != "" {
+		options.ClusterServer = server
+	}
+	// The token is retrieved again before it expires, only intermediate credentials are cached
+	if options.Cache == nil {
+		options.Cache = cache.NewMemory(skew, "")
+	}
+	options.CacheKey = ""
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	state := &tokenFile{}
+	if readiness != "" && !once {
+		go serveReadiness(ctx, readiness, state)
+	}
+
+	write := func() (time.Time, error) {
+		token, err := t.Token(cmd.Flags(), &options)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if err := credwriter.WriteFileAtomic(out, []byte(token.AccessToken), os.FileMode(fileMode)); err != nil {
+			return time.Time{}, err
+		}
+
+		if kubeconfigPath != "" {
+			config, err := kubeconfig.WithToken(kubeconfig.Cluster{
+				Name:                     t.Name,
+				Server:                   server,
+				CertificateAuthorityData: caData,
+				CertificateAuthority:     caFile,
+			}, token.AccessToken)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if err := credwriter.WriteFileAtomic(kubeconfigPath, config, os.FileMode(fileMode)); err != nil {
+				return time.Time{}, err
+			}
+		}
+
+		return token.Expiry, nil
+	}
+
+	backoff := WRITE_TOKEN_MIN_INTERVAL
+	for {
+		var wait time.Duration
+
+		expiry, err := write()
+		if err != nil {
+			if once {
+				logger.Log.Error(err.Error())
+				os.Exit(1)
+			}
+			logger.Log.Error(fmt.Sprintf("Couldn't write token, retrying in %s: %s", backoff, err.Error()))
+			wait = backoff
+			backoff = min(backoff*2, WRITE_TOKEN_MAX_BACKOFF)
+		} else {
+			state.written(expiry)
+			if once {
+				return
+			}
+			backoff = WRITE_TOKEN_MIN_INTERVAL
+
+			wait = refreshBefore
+			if !expiry.IsZero() {
+				wait = time.Until(expiry) - refreshBefore
+			}
+			wait = max(wait, WRITE_TOKEN_MIN_INTERVAL)
+			logger.Log.Info(fmt.Sprintf("Token written to %s, expires at %s, refreshing in %s", out, expiry.Format(time.RFC3339), wait.Round(time.Second)))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// serveReadiness serves /readyz, ready while the written token has not expired, and /healthz on the address.
+func serveReadiness(ctx context.Context, addr string, state *tokenFile) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !state.isReady() {
+			http.Error(w, "token not written", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	logger.Log.Info("Serving readiness on " + addr)
+	if err := serveHTTP(ctx, addr, mux); err != nil {
+		logger.Log.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(WriteTokenCmd)
+	addTargetRunner(WriteTokenCmd, runWriteToken)
+
+	WriteTokenCmd.PersistentFlags().String("out", "", "Path of the file the token is written to (required)")
+	WriteTokenCmd.PersistentFlags().String("kubeconfig", "", "Path of a kubeconfig file with the token to write, requires --server (optional)")
+	WriteTokenCmd.PersistentFlags().String("server", "", "Cluster API server URL, used for the kubeconfig and as the cluster of KUBERNETES_EXEC_INFO (optional)")
+	WriteTokenCmd.PersistentFlags().String("certificateauthority", "", "Path of the cluster CA certificate referenced by the kubeconfig (optional)")
+	WriteTokenCmd.PersistentFlags().BytesBase64("certificateauthoritydata", nil, "Base64 encoded cluster CA certificate embedded in the kubeconfig (optional)")
+	WriteTokenCmd.PersistentFlags().String("readiness", "", "Address serving /readyz, ready while the written token is valid, and /healthz (optional)")
+	WriteTokenCmd.PersistentFlags().Bool("once", false, "Write the token once and exit (optional)")
+	WriteTokenCmd.PersistentFlags().Duration("refreshbefore", 5*time.Minute, "How long before the token expiry it is replaced (optional)")
+	WriteTokenCmd.PersistentFlags().String("filemode", "0600", "Permissions of the written files (optional)")
+	AddPolicyFlag(WriteTokenCmd.PersistentFlags())
+	WriteTokenCmd.MarkPersistentFlagRequired("out")
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	AGENT_SOCKET_ENV = "K8XAUTH_AGENT_SOCKET"
+	TOKEN_PATH       = "/v1/token"
+	HEALTH_PATH      = "/healthz"
+	requestTimeout   = 5 * time.Minute
+)
+
+// ErrUnavailable is returned when no agent is listening on the socket.
+var ErrUnavailable = errors.New("agent not available")
+
+// Request asks the agent for credentials of a target command.
+type Request struct {
+	// Target is the target command name, e.g. "eks".
+	Target string `json:"target"`
+	// Args are the command line arguments of the invocation, parsed by the agent with the
+	// root and target command flags.
+	Args []string `json:"args"`
+	// ClusterServer is the target cluster API server URL provided in KUBERNETES_EXEC_INFO.
+	ClusterServer string `json:"clusterServer,omitempty"`
+}
+
+// Response is the agent answer to a Request.
+type Response struct {
+	Token *oauth2.Token `json:"token,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// DefaultSocket returns the agent socket path from K8XAUTH_AGENT_SOCKET environment variable, or
+// the k8xauth directory in the user runtime directory.
+func DefaultSocket() string {
+	if socket := os.Getenv(AGENT_SOCKET_ENV); socket != "" {
+		return socket
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("k8xauth-%d", os.Getuid()))
+	} else {
+		dir = filepath.Join(dir, "k8xauth")
+	}
+	return filepath.Join(dir, "agent.sock")
+}
+
+// NewHTTPClient returns an HTTP client connecting to the agent socket.
+func NewHTTPClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// Token requests credentials from the agent listening on the socket. ErrUnavailable is returned
+// if the socket doesn't exist or no agent is listening on it.
+func Token(ctx context.Context, socket string, r Request) (*oauth2.Token, error) {
+	if socket == "" {
+		return nil, ErrUnavailable
+	}
+	if _, err := os.Stat(socket); err != nil {
+		return nil, ErrUnavailable
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Host is ignored, the connection is made to the socket
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://k8xauth-agent"+TOKEN_PATH, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := NewHTTPClient(socket).Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("couldn't decode agent response (status %d): %w", resp.StatusCode, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("agent: %s", response.Error)
+	}
+	if resp.StatusCode != http.StatusOK || response.Token == nil {
+		return nil, fmt.Errorf("agent returned no token (status %d)", resp.StatusCode)
+	}
+
+	return response.Token, nil
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"k8xauth/internal/logger"
+	"os"
 	"time"
 
 	"context"
@@ -12,10 +13,18 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	AZURE_FEDERATED_TOKEN_FILE = "AZURE_FEDERATED_TOKEN_FILE"
+)
+
 // GetAKSTokenSource returns an OAuth2 token source for Azure Kubernetes Service (AKS) authentication.
 // It uses the default Azure credentials to obtain a token and creates an OAuth2 token source using the obtained token.
-func GetAKSTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
-	options := azidentity.WorkloadIdentityCredentialOptions{}
+// The token is requested from the authority of the Azure cloud set in options.
+func GetAKSTokenSource(ctx context.Context, o *Options) (oauth2.TokenSource, error) {
+	options := azidentity.WorkloadIdentityCredentialOptions{
+		ClientOptions:            o.AzureClientOptions(),
+		DisableInstanceDiscovery: o.AzureDisableInstanceDiscovery,
+	}
 
 	creds, err := azidentity.NewWorkloadIdentityCredential(&options)
 	if err != nil {
@@ -39,8 +48,8 @@ func GetAKSTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 	return tokenSource, nil
 }
 
-func aksWorkloadIdentityAuth(ctx context.Context) (*clientAuth, error) {
-	azureTokenSource, err := GetAKSTokenSource(ctx)
+func aksWorkloadIdentityAuth(ctx context.Context, o *Options) (*clientAuth, error) {
+	azureTokenSource, err := GetAKSTokenSource(ctx, o)
 	if azureTokenSource != nil && err == nil {
 		identitiyToken, err := azureTokenSource.Token()
 		if err != nil {
@@ -48,11 +57,16 @@ func aksWorkloadIdentityAuth(ctx context.Context) (*clientAuth, error) {
 			return nil, err
 		}
 
+		// Kubernetes service account token projected by Azure Workload Identity is federated
+		// with Entra applications in the same cloud
+		var serviceAccountTokenSource oauth2.TokenSource = externalTokenFileSource{path: os.Getenv(AZURE_FEDERATED_TOKEN_FILE)}
+
 		clientAuth := clientAuth{
-			platform:               "azure",
-			sessionIdentifier:      fmt.Sprintf("%s-%s", "k8xauth", fmt.Sprint(time.Now().UnixNano()))[:32],
+			platform:               PLATFORM_AZURE,
+			sessionIdentifier:      NewSessionIdentifier("k8xauth", fmt.Sprint(time.Now().UnixNano())),
 			tokenSource:            &azureTokenSource,
 			identityTokenRetriever: identityTokenRetriever{token: []byte(identitiyToken.AccessToken)},
+			sameCloudTokenSource:   &serviceAccountTokenSource,
 		}
 		return &clientAuth, nil
 	}
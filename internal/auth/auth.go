@@ -21,7 +21,7 @@ type identityTokenRetriever struct {
 
 type clientAuth struct {
 	// platform represents the name of the platform.
-	// It can be "aws" or "gcp" or "azure"
+	// It can be "aws" or "gcp" or "azure" or "external"
 	platform string
 
 	// sessionIdentifier represents the unique identifier for a session.
@@ -33,6 +33,11 @@ type clientAuth struct {
 	// identityTokenRetriever is an interface that defines the method for retrieving an identity token.
 	// It is used for AWS EKS authentication.
 	identityTokenRetriever identityTokenRetriever
+
+	// sameCloudTokenSource represents the source of the token presented to the identity provider of the
+	// source platform itself, when source and target are the same cloud. For Azure it is the Kubernetes
+	// service account token, for GCP the Google access token and for AWS the IRSA web identity token.
+	sameCloudTokenSource *oauth2.TokenSource
 }
 
 // ClientAuth is an interface that defines the methods for client authentication.
@@ -70,16 +75,47 @@ func New(options *Options) (*clientAuth, error) {
 
 	if options.AuthType == "aks" || options.AuthType == "all" {
 		logger.Log.Debug("Source Authentication - Trying AKS Workload Identity")
-		clientAuth, err := aksWorkloadIdentityAuth(ctx)
+		clientAuth, err := aksWorkloadIdentityAuth(ctx, options)
 		if clientAuth != nil && err == nil {
 			logger.Log.Debug("Source Authentication - Successfully retrieved AKS Workload Identity token")
 			return clientAuth, nil
 		}
 	}
 
+	// External identity provider tokens are used only when explicitly requested
+	if options.AuthType == "file" {
+		logger.Log.Debug("Source Authentication - Trying external token file")
+		clientAuth, err := externalTokenFileAuth(ctx, options.SourceTokenFile)
+		if clientAuth != nil && err == nil {
+			logger.Log.Debug("Source Authentication - Successfully retrieved external token file token")
+			return clientAuth, nil
+		}
+	}
+
 	return nil, errors.New("no valid authentication source found")
 }
 
+// FederationToken returns the token to federate with the identity provider of the target platform.
+// When source and target are the same cloud the token issued for cross-cloud federation can't be used,
+// e.g. an Entra access token can't be federated with another Entra application, so the token presented
+// to the source platform itself is returned instead.
+func (ac *clientAuth) FederationToken(targetPlatform string) (*oauth2.Token, error) {
+	if ac.platform == targetPlatform && ac.sameCloudTokenSource != nil {
+		logger.Log.Debug(fmt.Sprintf("Source and target platform is %s, using same cloud token", targetPlatform))
+		return (*ac.sameCloudTokenSource).Token()
+	}
+	return ac.Token()
+}
+
+// NewSessionIdentifier joins the parts into a session identifier of at most 32 characters.
+func NewSessionIdentifier(parts ...string) string {
+	sessionIdentifier := strings.Join(parts, "-")
+	if len(sessionIdentifier) > 32 {
+		return sessionIdentifier[:32]
+	}
+	return sessionIdentifier
+}
+
 // IdentityTokenRetriever returns the identity token retriever for the client authentication.
 // It retrieves the identity token used for authentication.
 func (ca *clientAuth) IdentityTokenRetriever() (identityTokenRetriever, error) {
@@ -95,7 +131,7 @@ func (ac *clientAuth) GetSessionIdentifier() (string, error) {
 }
 
 // GetPlatform returns the platform associated with the clientAuth instance.
-// Possible values are "aws" or "gcp" or "azure"
+// Possible values are "aws" or "gcp" or "azure" or "external"
 // It retrieves the platform value stored in the ac.platform field.
 // The platform represents the platform on which the client is authenticated.
 // It returns the platform value as a string and an error if any.
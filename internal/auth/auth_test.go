@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestFederationToken(t *testing.T) {
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "cross-cloud"})
+	sameCloudTokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "same-cloud"})
+
+	tests := []struct {
+		name           string
+		platform       string
+		sameCloud      *oauth2.TokenSource
+		targetPlatform string
+		want           string
+	}{
+		{
+			name:           "AKS to Azure uses service account token",
+			platform:       PLATFORM_AZURE,
+			sameCloud:      &sameCloudTokenSource,
+			targetPlatform: PLATFORM_AZURE,
+			want:           "same-cloud",
+		},
+		{
+			name:           "GKE to Google uses access token",
+			platform:       PLATFORM_GCP,
+			sameCloud:      &sameCloudTokenSource,
+			targetPlatform: PLATFORM_GCP,
+			want:           "same-cloud",
+		},
+		{
+			name:           "EKS to AWS uses web identity token",
+			platform:       PLATFORM_AWS,
+			sameCloud:      &sameCloudTokenSource,
+			targetPlatform: PLATFORM_AWS,
+			want:           "same-cloud",
+		},
+		{
+			name:           "AKS to Google uses cross-cloud token",
+			platform:       PLATFORM_AZURE,
+			sameCloud:      &sameCloudTokenSource,
+			targetPlatform: PLATFORM_GCP,
+			want:           "cross-cloud",
+		},
+		{
+			name:           "same cloud without same cloud token source",
+			platform:       PLATFORM_GCP,
+			targetPlatform: PLATFORM_GCP,
+			want:           "cross-cloud",
+		},
+		{
+			name:           "external source",
+			platform:       PLATFORM_EXTERNAL,
+			targetPlatform: PLATFORM_AWS,
+			want:           "cross-cloud",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := &clientAuth{
+				platform:             tt.platform,
+				tokenSource:          &tokenSource,
+				sameCloudTokenSource: tt.sameCloud,
+			}
+
+			token, err := ac.FederationToken(tt.targetPlatform)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if token.AccessToken != tt.want {
+				t.Errorf("token = %q, want %q", token.AccessToken, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+const (
+	AZURE_PUBLIC        = "AzurePublic"
+	AZURE_US_GOVERNMENT = "AzureUSGovernment"
+	AZURE_CHINA         = "AzureChina"
+)
+
+// AzureCloudConfiguration returns the Azure cloud configuration for the named cloud.
+// The authority host and ARM endpoint, if set, override the ones of the named cloud, allowing
+// custom (private, Azure Stack) clouds.
+func AzureCloudConfiguration(name, authorityHost, armEndpoint string) (cloud.Configuration, error) {
+	var c cloud.Configuration
+
+	switch strings.ToLower(name) {
+	case "", strings.ToLower(AZURE_PUBLIC):
+		c = cloud.AzurePublic
+	case strings.ToLower(AZURE_US_GOVERNMENT):
+		c = cloud.AzureGovernment
+	case strings.ToLower(AZURE_CHINA):
+		c = cloud.AzureChina
+	default:
+		return cloud.Configuration{}, fmt.Errorf("unsupported Azure cloud %q, supported clouds are %s, %s and %s", name, AZURE_PUBLIC, AZURE_US_GOVERNMENT, AZURE_CHINA)
+	}
+
+	// Copy services so the SDK defaults are not modified
+	services := map[cloud.ServiceName]cloud.ServiceConfiguration{}
+	for k, v := range c.Services {
+		services[k] = v
+	}
+	c.Services = services
+
+	if authorityHost != "" {
+		c.ActiveDirectoryAuthorityHost = strings.TrimSuffix(authorityHost, "/") + "/"
+	}
+
+	if armEndpoint != "" {
+		c.Services[cloud.ResourceManager] = cloud.ServiceConfiguration{
+			Audience: strings.TrimSuffix(armEndpoint, "/"),
+			Endpoint: strings.TrimSuffix(armEndpoint, "/"),
+		}
+	}
+
+	return c, nil
+}
@@ -63,10 +63,14 @@ func EksAWSIRSATokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 func eksIRSAAuth(ctx context.Context) (*clientAuth, error) {
 	awsTokenSource, err := EksAWSIRSATokenSource(ctx)
 	if awsTokenSource != nil && err == nil {
+		// Instance identity document is not available on Fargate or when IMDS is not reachable from pods
+		sessionIdentifier := NewSessionIdentifier("k8xauth", fmt.Sprint(time.Now().UnixNano()))
 		c := imds.New(imds.Options{})
 		i, err := c.GetInstanceIdentityDocument(ctx, nil)
 		if err != nil {
 			logger.Log.Debug("Couldn't fetch ProjectId from AWS/EKS metadata server")
+		} else {
+			sessionIdentifier = NewSessionIdentifier(i.AccountID, i.InstanceID)
 		}
 
 		identitiyToken, err := awsTokenSource.Token()
@@ -75,10 +79,12 @@ func eksIRSAAuth(ctx context.Context) (*clientAuth, error) {
 		}
 
 		clientAuth := clientAuth{
-			platform:               "aws",
-			sessionIdentifier:      fmt.Sprintf("%s-%s", i.AccountID, i.InstanceID)[:32],
+			platform:               PLATFORM_AWS,
+			sessionIdentifier:      sessionIdentifier,
 			tokenSource:            &awsTokenSource,
 			identityTokenRetriever: identityTokenRetriever{token: []byte(identitiyToken.AccessToken)},
+			// IRSA web identity token is assumed with roles in other accounts as well
+			sameCloudTokenSource: &awsTokenSource,
 		}
 		return &clientAuth, nil
 	}
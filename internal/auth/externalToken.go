@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"k8xauth/internal/logger"
+
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	SOURCE_TOKEN_FILE_ENV = "K8XAUTH_SOURCE_TOKEN_FILE"
+)
+
+// externalTokenFileSource is an OAuth2 token source reading an identity token issued by an
+// external identity provider (browser or CI obtained) from a file.
+// The file is read on every call so tokens refreshed by an external process are picked up.
+type externalTokenFileSource struct {
+	path string
+}
+
+// Token reads the identity token from the file and returns it with expiry from its `exp` claim.
+func (s externalTokenFileSource) Token() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read source token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+
+	t, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse source token: %w", err)
+	}
+
+	var claims jwt.Claims
+	if err := t.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, fmt.Errorf("couldn't read source token claims: %w", err)
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("source token has no exp claim")
+	}
+
+	return &oauth2.Token{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		Expiry:      claims.Expiry.Time(),
+	}, nil
+}
+
+// ExternalTokenFileSource returns an OAuth2 token source for an identity token stored in a file.
+// The path is taken from the provided argument or from K8XAUTH_SOURCE_TOKEN_FILE environment variable.
+func ExternalTokenFileSource(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	if path == "" {
+		path = os.Getenv(SOURCE_TOKEN_FILE_ENV)
+	}
+	if path == "" {
+		return nil, errors.New("source token file not set")
+	}
+
+	return externalTokenFileSource{path: path}, nil
+}
+
+func externalTokenFileAuth(ctx context.Context, path string) (*clientAuth, error) {
+	tokenSource, err := ExternalTokenFileSource(ctx, path)
+	if err != nil {
+		logger.Log.Debug("Error retrieving external token file source: " + err.Error())
+		return nil, err
+	}
+
+	identitiyToken, err := tokenSource.Token()
+	if err != nil {
+		logger.Log.Debug("Error retrieving token from external token file: " + err.Error())
+		return nil, err
+	}
+
+	clientAuth := clientAuth{
+		platform:               PLATFORM_EXTERNAL,
+		sessionIdentifier:      NewSessionIdentifier("k8xauth", fmt.Sprint(time.Now().UnixNano())),
+		tokenSource:            &tokenSource,
+		identityTokenRetriever: identityTokenRetriever{token: []byte(identitiyToken.AccessToken)},
+	}
+	return &clientAuth, nil
+}
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"context"
-	"fmt"
 	"k8xauth/internal/logger"
 	"net/http"
 
@@ -14,7 +13,8 @@ import (
 )
 
 const (
-	GCP_TOKEN_AUDIENCE = "gcp"
+	GCP_TOKEN_AUDIENCE       = "gcp"
+	GCP_CLOUD_PLATFORM_SCOPE = "https://www.googleapis.com/auth/cloud-platform"
 )
 
 // gcpGKETokenSource returns an OAuth2 token source for authenticating with GCP GKE.
@@ -53,12 +53,21 @@ func gkeWorkloadIdentityAuth(ctx context.Context) (*clientAuth, error) {
 			logger.Log.Debug("Couldn't fetch identity token from GCP metadata server")
 		}
 
+		// Google access token of the source identity is used directly in the same cloud
+		accessTokenSource, err := google.DefaultTokenSource(ctx, GCP_CLOUD_PLATFORM_SCOPE)
+		if err != nil {
+			logger.Log.Debug("Couldn't fetch GCP default access token source")
+		}
+
 		clientAuth := clientAuth{
-			platform:               "gcp",
-			sessionIdentifier:      fmt.Sprintf("%s-%s", projectId, hostname)[:32],
+			platform:               PLATFORM_GCP,
+			sessionIdentifier:      NewSessionIdentifier(projectId, hostname),
 			tokenSource:            &gcpTokenSource,
 			identityTokenRetriever: identityTokenRetriever{token: []byte(identitiyToken.AccessToken)},
 		}
+		if accessTokenSource != nil {
+			clientAuth.sameCloudTokenSource = &accessTokenSource
+		}
 		return &clientAuth, nil
 	}
 	return nil, err
@@ -1,8 +1,39 @@
 package auth
 
+import (
+	"k8xauth/internal/cache"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
 type Options struct {
 	// AuthType represents the type of authentication used.
 	AuthType string
 	// PrintSourceToken is a boolean flag that determines whether the source token should be printed to the console. This is to be used for debugging purposes only as it may expose sensitive information.
 	PrintSourceToken bool
+	// SourceTokenFile is a path to an identity token issued by an external identity provider, used by the "file" authentication type.
+	SourceTokenFile string
+	// AzureCloud is the Azure cloud used by Azure authentication source and targets. If nil, the public cloud
+	// or the authority host set in AZURE_AUTHORITY_HOST environment variable is used.
+	AzureCloud *cloud.Configuration
+	// AzureDisableInstanceDiscovery disables Microsoft Entra instance metadata discovery, required for
+	// disconnected and private clouds.
+	AzureDisableInstanceDiscovery bool
+	// ClusterServer is the target cluster API server URL, provided by the Kubernetes client in
+	// KUBERNETES_EXEC_INFO when the exec plugin is configured with provideClusterInfo.
+	ClusterServer string
+	// Cache is the credential cache shared across invocations, nil if caching is disabled.
+	Cache *cache.Cache
+	// CacheKey identifies the final credentials of the invocation (command, flags and target) in Cache.
+	CacheKey string
+}
+
+// AzureClientOptions returns Azure SDK client options for the configured Azure cloud.
+func (o *Options) AzureClientOptions() azcore.ClientOptions {
+	options := azcore.ClientOptions{}
+	if o.AzureCloud != nil {
+		options.Cloud = *o.AzureCloud
+	}
+	return options
 }
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+)
+
+const (
+	PLATFORM_AWS      = "aws"
+	PLATFORM_GCP      = "gcp"
+	PLATFORM_AZURE    = "azure"
+	PLATFORM_EXTERNAL = "external"
+)
+
+// IssuerPlatform returns the platform of the workload identity tokens issued by the OIDC issuer, GKE,
+// EKS and AKS cluster issuers and the Google and Entra identity providers being recognized, external
+// otherwise.
+func IssuerPlatform(issuer string) string {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return PLATFORM_EXTERNAL
+	}
+	host := strings.ToLower(u.Hostname())
+
+	switch {
+	case host == "container.googleapis.com" || host == "accounts.google.com":
+		return PLATFORM_GCP
+	case strings.HasPrefix(host, "oidc.eks.") && (strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn")):
+		return PLATFORM_AWS
+	case strings.HasSuffix(host, ".oic.prod-aks.azure.com") || host == "login.microsoftonline.com" || host == "sts.windows.net":
+		return PLATFORM_AZURE
+	}
+	return PLATFORM_EXTERNAL
+}
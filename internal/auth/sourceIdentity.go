@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// SourceIdentity returns an identifier of the source identities the environment provides for the
+// authentication type, read from the environment, token files and metadata server without any
+// token exchange. It changes when the workload identity (service account, role, application)
+// changes and is used to scope cached credentials to the source identity.
+func SourceIdentity(o *Options) string {
+	var identities []string
+
+	if o.AuthType == "gke" || o.AuthType == "all" {
+		if credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); credentialsFile != "" {
+			if b, err := os.ReadFile(credentialsFile); err == nil {
+				sum := sha256.Sum256(b)
+				identities = append(identities, "gcp:"+hex.EncodeToString(sum[:]))
+			}
+		} else if metadata.OnGCE() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if email, err := metadata.EmailWithContext(ctx, "default"); err == nil {
+				identities = append(identities, "gcp:"+email)
+			}
+		}
+	}
+
+	if o.AuthType == "eks" || o.AuthType == "all" {
+		if roleArn := os.Getenv("AWS_ROLE_ARN"); roleArn != "" {
+			identities = append(identities, "aws:"+roleArn+":"+tokenFileSubject(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")))
+		}
+	}
+
+	if o.AuthType == "aks" || o.AuthType == "all" {
+		if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+			identities = append(identities, "azure:"+os.Getenv("AZURE_TENANT_ID")+":"+clientID+":"+tokenFileSubject(os.Getenv(AZURE_FEDERATED_TOKEN_FILE)))
+		}
+	}
+
+	if o.AuthType == "file" {
+		path := o.SourceTokenFile
+		if path == "" {
+			path = os.Getenv(SOURCE_TOKEN_FILE_ENV)
+		}
+		identities = append(identities, "external:"+tokenFileSubject(path))
+	}
+
+	return strings.Join(identities, ",")
+}
+
+// tokenFileSubject returns the issuer and subject of the JWT stored in the file, or an empty
+// string if it can't be read.
+func tokenFileSubject(path string) string {
+	if path == "" {
+		return ""
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	t, err := jwt.ParseSigned(strings.TrimSpace(string(b)))
+	if err != nil {
+		return ""
+	}
+	var claims jwt.Claims
+	if err := t.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return ""
+	}
+	return claims.Issuer + "|" + claims.Subject
+}
+
+// SourceClaims are the claims of the source identity token.
+type SourceClaims struct {
+	// Platform is the source platform, "aws", "gcp", "azure" or "external".
+	Platform string
+	Issuer   string
+	Subject  string
+	// Claims are all claims of the token.
+	Claims map[string]any
+}
+
+// ReadSourceClaims returns the claims of the identity token of the first source available for the
+// authentication type, in the order sources are tried authenticating. The token is read from token
+// files or the metadata server without any token exchange and its signature is not verified. For AKS
+// sources these are the claims of the service account token, not of the Entra token of the
+// AZURE_CLIENT_ID application exchanged with other clouds.
+func ReadSourceClaims(o *Options) (*SourceClaims, error) {
+	if o.AuthType == "gke" || o.AuthType == "all" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if ts, err := gcpGKETokenSource(ctx); err == nil {
+			if token, err := ts.Token(); err == nil {
+				return parseSourceClaims(PLATFORM_GCP, token.AccessToken)
+			}
+		}
+	}
+
+	if o.AuthType == "eks" || o.AuthType == "all" {
+		if path := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); path != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+			return readSourceClaims(PLATFORM_AWS, path)
+		}
+	}
+
+	if o.AuthType == "aks" || o.AuthType == "all" {
+		if path := os.Getenv(AZURE_FEDERATED_TOKEN_FILE); path != "" && os.Getenv("AZURE_CLIENT_ID") != "" {
+			return readSourceClaims(PLATFORM_AZURE, path)
+		}
+	}
+
+	if o.AuthType == "file" {
+		path := o.SourceTokenFile
+		if path == "" {
+			path = os.Getenv(SOURCE_TOKEN_FILE_ENV)
+		}
+		if path != "" {
+			return readSourceClaims(PLATFORM_EXTERNAL, path)
+		}
+	}
+
+	return nil, errors.New("no valid authentication source found")
+}
+
+func readSourceClaims(platform, path string) (*SourceClaims, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read source token file: %w", err)
+	}
+	return parseSourceClaims(platform, strings.TrimSpace(string(b)))
+}
+
+func parseSourceClaims(platform, token string) (*SourceClaims, error) {
+	t, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse source token: %w", err)
+	}
+
+	var claims jwt.Claims
+	var all map[string]any
+	if err := t.UnsafeClaimsWithoutVerification(&claims, &all); err != nil {
+		return nil, fmt.Errorf("couldn't read source token claims: %w", err)
+	}
+
+	return &SourceClaims{
+		Platform: platform,
+		Issuer:   claims.Issuer,
+		Subject:  claims.Subject,
+		Claims:   all,
+	}, nil
+}
@@ -0,0 +1,360 @@
+package authn
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/logger"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	DEFAULT_USERNAME_TEMPLATE = "{{ .Issuer }}#{{ .Subject }}"
+	DEFAULT_GROUP_TEMPLATE    = "k8xauth:{{ .Platform }}"
+
+	EXTRA_PLATFORM           = "k8xauth.io/platform"
+	EXTRA_ISSUER             = "k8xauth.io/issuer"
+	EXTRA_SESSION_IDENTIFIER = "k8xauth.io/session-identifier"
+)
+
+// Config is the authentication webhook configuration.
+type Config struct {
+	// Issuers are the OIDC issuers whose tokens are accepted.
+	Issuers []IssuerConfig `json:"issuers,omitempty"`
+	// AWS configures verification of k8s-aws-v1 tokens, not accepted if not set.
+	AWS *AWSConfig `json:"aws,omitempty"`
+}
+
+// IssuerConfig configures an OIDC issuer whose tokens are accepted and how their claims are mapped
+// to the Kubernetes user.
+type IssuerConfig struct {
+	// Issuer is the issuer URL, matched exactly against the iss claim.
+	Issuer string `json:"issuer"`
+	// JWKSURL is the key set URL, discovered from the issuer OpenID configuration if not set.
+	JWKSURL string `json:"jwksURL,omitempty"`
+	// Audiences are the accepted aud claim values, at least one is required.
+	Audiences []string `json:"audiences"`
+	// Platform is the platform of the issued tokens, derived from the issuer URL if not set.
+	Platform string `json:"platform,omitempty"`
+	// RequiredClaims are claims the token must have with the values.
+	RequiredClaims map[string]string `json:"requiredClaims,omitempty"`
+	// Username is the template of the username, DEFAULT_USERNAME_TEMPLATE if not set.
+	Username string `json:"username,omitempty"`
+	// Groups are the templates of the groups, DEFAULT_GROUP_TEMPLATE if not set. Groups rendered empty are dropped.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Identity is the verified identity of a token, the data of the username and groups templates.
+type Identity struct {
+	Platform string
+	Issuer   string
+	Subject  string
+	// SessionIdentifier joins the platform and subject the same way source session identifiers are named.
+	SessionIdentifier string
+	// Claims are all claims of the token.
+	Claims map[string]any
+}
+
+// userTemplates map identities to Kubernetes users.
+type userTemplates struct {
+	username *template.Template
+	groups   []*template.Template
+}
+
+// issuer verifies tokens of a configured issuer.
+type issuer struct {
+	*userTemplates
+	config IssuerConfig
+	keys   *keySet
+}
+
+// Authenticator authenticates workload identity tokens of the configured issuers and AWS IAM identities.
+type Authenticator struct {
+	issuers map[string]*issuer
+	aws     *awsVerifier
+	// leeway is the clock skew tolerated validating the time claims.
+	leeway time.Duration
+}
+
+// New returns authenticator of the configured issuers, their key sets being cached for the TTL.
+func New(config Config, jwksTTL, leeway time.Duration) (*Authenticator, error) {
+	if len(config.Issuers) == 0 && config.AWS == nil {
+		return nil, errors.New("no issuers or aws configured")
+	}
+
+	a := &Authenticator{
+		issuers: map[string]*issuer{},
+		leeway:  leeway,
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if config.AWS != nil {
+		v, err := newAWSVerifier(*config.AWS, client, leeway)
+		if err != nil {
+			return nil, fmt.Errorf("aws: %w", err)
+		}
+		a.aws = v
+	}
+
+	for _, c := range config.Issuers {
+		if c.Issuer == "" {
+			return nil, errors.New("issuer URL is required")
+		}
+		if _, ok := a.issuers[c.Issuer]; ok {
+			return nil, fmt.Errorf("issuer %s configured twice", c.Issuer)
+		}
+		if len(c.Audiences) == 0 {
+			return nil, fmt.Errorf("issuer %s has no audiences", c.Issuer)
+		}
+		if c.Platform == "" {
+			c.Platform = auth.IssuerPlatform(c.Issuer)
+		}
+
+		templates, err := newUserTemplates(c.Username, DEFAULT_USERNAME_TEMPLATE, c.Groups)
+		if err != nil {
+			return nil, fmt.Errorf("issuer %s: %w", c.Issuer, err)
+		}
+
+		a.issuers[c.Issuer] = &issuer{
+			userTemplates: templates,
+			config:        c,
+			keys: &keySet{
+				issuer:  c.Issuer,
+				jwksURL: c.JWKSURL,
+				ttl:     jwksTTL,
+				client:  client,
+			},
+		}
+	}
+
+	return a, nil
+}
+
+// newUserTemplates parses the username template, defaultUsername if not set, and the group templates,
+// DEFAULT_GROUP_TEMPLATE if not set.
+func newUserTemplates(username, defaultUsername string, groups []string) (*userTemplates, error) {
+	if username == "" {
+		username = defaultUsername
+	}
+	if groups == nil {
+		groups = []string{DEFAULT_GROUP_TEMPLATE}
+	}
+
+	u := &userTemplates{}
+	var err error
+	if u.username, err = parseTemplate("username", username); err != nil {
+		return nil, err
+	}
+	for n, g := range groups {
+		t, err := parseTemplate(fmt.Sprintf("groups[%d]", n), g)
+		if err != nil {
+			return nil, err
+		}
+		u.groups = append(u.groups, t)
+	}
+	return u, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// Authenticate verifies the token and returns the user it maps to with the audiences of the request
+// it is valid for. If the request has no audiences the token has to be valid for the issuer audiences.
+// k8s-aws-v1 tokens are bound to the cluster ID instead of audiences.
+func (a *Authenticator) Authenticate(ctx context.Context, token string, audiences []string) (*authenticationv1.UserInfo, []string, error) {
+	if isAWSToken(token) {
+		if a.aws == nil {
+			return nil, nil, errors.New("AWS tokens are not accepted")
+		}
+		user, err := a.aws.authenticate(ctx, token)
+		return user, nil, err
+	}
+
+	identity, tokenAudiences, i, err := a.verify(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accepted := intersect(tokenAudiences, i.config.Audiences)
+	if len(accepted) == 0 {
+		return nil, nil, fmt.Errorf("token audiences %v are not accepted for %s", tokenAudiences, identity.Issuer)
+	}
+	if len(audiences) > 0 {
+		accepted = intersect(accepted, audiences)
+		if len(accepted) == 0 {
+			return nil, nil, fmt.Errorf("token is not valid for audiences %v", audiences)
+		}
+	} else {
+		accepted = nil
+	}
+
+	user, err := i.user(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, accepted, nil
+}
+
+// verify verifies signature and claims of the token with the keys of its issuer.
+func (a *Authenticator) verify(ctx context.Context, token string) (*Identity, []string, *issuer, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	var unverified jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	i, ok := a.issuers[unverified.Issuer]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("issuer %q is not trusted", unverified.Issuer)
+	}
+
+	var kid string
+	if len(parsed.Headers) > 0 {
+		kid = parsed.Headers[0].KeyID
+	}
+	keys, err := i.keys.verificationKeys(ctx, kid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var claims jwt.Claims
+	var all map[string]any
+	verified := false
+	for _, key := range keys {
+		if err := parsed.Claims(key.Key, &claims, &all); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, nil, nil, fmt.Errorf("token signature of %s is invalid", i.config.Issuer)
+	}
+
+	if claims.Expiry == nil {
+		return nil, nil, nil, errors.New("token has no expiry")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{
+		Issuer: i.config.Issuer,
+		Time:   time.Now(),
+	}, a.leeway); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, nil, nil, errors.New("token has no subject")
+	}
+
+	for name, value := range i.config.RequiredClaims {
+		if v, ok := all[name]; !ok || fmt.Sprint(v) != value {
+			return nil, nil, nil, fmt.Errorf("token claim %s doesn't have the required value", name)
+		}
+	}
+
+	return &Identity{
+		Platform:          i.config.Platform,
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		SessionIdentifier: auth.NewSessionIdentifier(i.config.Platform, claims.Subject),
+		Claims:            all,
+	}, claims.Audience, i, nil
+}
+
+// user renders the username and groups of the identity.
+func (u *userTemplates) user(identity *Identity) (*authenticationv1.UserInfo, error) {
+	username, err := render(u.username, identity)
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		return nil, errors.New("username template rendered empty")
+	}
+
+	groups := []string{}
+	for _, t := range u.groups {
+		group, err := render(t, identity)
+		if err != nil {
+			return nil, err
+		}
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	return &authenticationv1.UserInfo{
+		Username: username,
+		UID:      identity.Issuer + "#" + identity.Subject,
+		Groups:   groups,
+		Extra: map[string]authenticationv1.ExtraValue{
+			EXTRA_PLATFORM:           {identity.Platform},
+			EXTRA_ISSUER:             {identity.Issuer},
+			EXTRA_SESSION_IDENTIFIER: {identity.SessionIdentifier},
+		},
+	}, nil
+}
+
+func render(t *template.Template, identity *Identity) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, identity); err != nil {
+		return "", fmt.Errorf("couldn't render %s: %w", t.Name(), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func intersect(a, b []string) []string {
+	var both []string
+	for _, v := range a {
+		if slices.Contains(b, v) && !slices.Contains(both, v) {
+			both = append(both, v)
+		}
+	}
+	return both
+}
+
+// ServeHTTP answers authentication.k8s.io/v1 TokenReview requests of the API server.
+func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var review authenticationv1.TokenReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("invalid TokenReview: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if review.APIVersion != authenticationv1.SchemeGroupVersion.String() || review.Kind != "TokenReview" {
+		http.Error(w, fmt.Sprintf("unsupported %s %s, only %s TokenReview is supported", review.APIVersion, review.Kind, authenticationv1.SchemeGroupVersion.String()), http.StatusBadRequest)
+		return
+	}
+
+	user, audiences, err := a.Authenticate(r.Context(), review.Spec.Token, review.Spec.Audiences)
+	review.Status = authenticationv1.TokenReviewStatus{}
+	if err != nil {
+		logger.Log.Debug("Token rejected: " + err.Error())
+		review.Status.Error = err.Error()
+	} else {
+		logger.Log.Debug(fmt.Sprintf("Token of %s authenticated", user.Username))
+		review.Status.Authenticated = true
+		review.Status.User = *user
+		review.Status.Audiences = audiences
+	}
+	// The token isn't returned to the API server
+	review.Spec = authenticationv1.TokenReviewSpec{}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
@@ -0,0 +1,329 @@
+package authn
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	AWS_TOKEN_V1_PREFIX = "k8s-aws-v1."
+	// AWS_MAX_TOKEN_LENGTH is the length of the longest accepted token, presigned URLs with session
+	// tokens are well below it.
+	AWS_MAX_TOKEN_LENGTH = 4096
+	// AWS_CLUSTER_ID_HEADER is the signed header binding the token to the cluster.
+	AWS_CLUSTER_ID_HEADER = "x-k8s-aws-id"
+	// AWS_ISSUER is the issuer of the AWS identities.
+	AWS_ISSUER = "sts.amazonaws.com"
+	// AWS_PRESIGNED_URL_EXPIRATION is how long STS accepts the presigned request after it was signed.
+	AWS_PRESIGNED_URL_EXPIRATION = 15 * time.Minute
+	// AWS_MAX_PRESIGN_EXPIRES is the highest accepted X-Amz-Expires value in seconds.
+	AWS_MAX_PRESIGN_EXPIRES       = 900
+	AWS_DEFAULT_USERNAME_TEMPLATE = "{{ .Subject }}"
+)
+
+var (
+	// awsSTSHostRegexp matches the global and regional STS endpoints of all partitions. Only region labels
+	// are matched, other labels such as s3 would name hosts of other services, e.g. S3 buckets.
+	awsSTSHostRegexp = regexp.MustCompile(`^sts(\.[a-z]{2}(-gov|-iso[a-z]*)?-[a-z]+-\d)?\.amazonaws\.com(\.cn)?$`)
+
+	// awsAllowedParams are the query parameters of a presigned GetCallerIdentity request.
+	awsAllowedParams = []string{
+		"action",
+		"version",
+		"x-amz-algorithm",
+		"x-amz-credential",
+		"x-amz-date",
+		"x-amz-expires",
+		"x-amz-security-token",
+		"x-amz-signature",
+		"x-amz-signedheaders",
+	}
+)
+
+// AWSConfig configures verification of the k8s-aws-v1 tokens presigning an STS GetCallerIdentity request,
+// as generated by the eks and awsiam commands, and how the IAM identities map to Kubernetes users.
+type AWSConfig struct {
+	// ClusterID is the x-k8s-aws-id header value the tokens have to be signed for, the --cluster or --clusterid flag.
+	ClusterID string `json:"clusterID"`
+	// Headers are additional headers the tokens are signed with, the awsiam --header flag.
+	Headers map[string]string `json:"headers,omitempty"`
+	// AllowedHosts are STS hosts accepted in addition to the AWS STS endpoints, e.g. VPC endpoints.
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// STSEndpoint is the URL presigned requests are sent to, the presigned URL if not set.
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+	// Mappings map IAM roles and users to Kubernetes users, the first matching one is used.
+	Mappings []AWSMapping `json:"mappings"`
+}
+
+// AWSMapping maps an IAM role or user, or all identities of an account, to a Kubernetes user.
+type AWSMapping struct {
+	// ARN is the IAM role or user ARN, assumed role sessions match their role ARN.
+	ARN string `json:"arn,omitempty"`
+	// Account is the AWS account ID whose identities match.
+	Account string `json:"account,omitempty"`
+	// Username is the template of the username, AWS_DEFAULT_USERNAME_TEMPLATE (the ARN) if not set.
+	Username string `json:"username,omitempty"`
+	// Groups are the templates of the groups, DEFAULT_GROUP_TEMPLATE if not set. Groups rendered empty are dropped.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// awsMapping is a parsed AWSMapping.
+type awsMapping struct {
+	*userTemplates
+	config AWSMapping
+}
+
+// awsVerifier verifies AWS tokens by sending their presigned GetCallerIdentity request to STS.
+type awsVerifier struct {
+	config   AWSConfig
+	mappings []awsMapping
+	client   *http.Client
+	leeway   time.Duration
+}
+
+// awsCallerIdentity is the GetCallerIdentity JSON response.
+type awsCallerIdentity struct {
+	GetCallerIdentityResponse struct {
+		GetCallerIdentityResult struct {
+			Account string `json:"Account"`
+			Arn     string `json:"Arn"`
+			UserID  string `json:"UserId"`
+		} `json:"GetCallerIdentityResult"`
+	} `json:"GetCallerIdentityResponse"`
+}
+
+// isAWSToken reports whether the token is an AWS token rather than a JWT.
+func isAWSToken(token string) bool {
+	return strings.HasPrefix(token, AWS_TOKEN_V1_PREFIX)
+}
+
+func newAWSVerifier(config AWSConfig, client *http.Client, leeway time.Duration) (*awsVerifier, error) {
+	if config.ClusterID == "" {
+		return nil, errors.New("clusterID is required")
+	}
+	if len(config.Mappings) == 0 {
+		return nil, errors.New("no mappings configured")
+	}
+
+	// Signed header names are lower case
+	headers := make(map[string]string, len(config.Headers))
+	for key, value := range config.Headers {
+		headers[strings.ToLower(key)] = value
+	}
+	config.Headers = headers
+
+	v := &awsVerifier{
+		config: config,
+		client: client,
+		leeway: leeway,
+	}
+	for n, m := range config.Mappings {
+		if (m.ARN == "") == (m.Account == "") {
+			return nil, fmt.Errorf("mappings[%d]: exactly one of arn and account is required", n)
+		}
+		templates, err := newUserTemplates(m.Username, AWS_DEFAULT_USERNAME_TEMPLATE, m.Groups)
+		if err != nil {
+			return nil, fmt.Errorf("mappings[%d]: %w", n, err)
+		}
+		v.mappings = append(v.mappings, awsMapping{userTemplates: templates, config: m})
+	}
+
+	return v, nil
+}
+
+// authenticate verifies the token and returns the user its IAM identity maps to.
+func (v *awsVerifier) authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	presigned, err := v.presignedURL(token)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := v.callerIdentity(ctx, presigned)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range v.mappings {
+		if m.config.ARN == identity.Subject || m.config.Account == identity.Claims["account"] {
+			return m.user(identity)
+		}
+	}
+	return nil, fmt.Errorf("%s is not mapped to a user", identity.Subject)
+}
+
+// presignedURL decodes the presigned GetCallerIdentity URL of the token and checks it is a request
+// to STS signed for the cluster that hasn't expired.
+func (v *awsVerifier) presignedURL(token string) (*url.URL, error) {
+	if len(token) > AWS_MAX_TOKEN_LENGTH {
+		return nil, fmt.Errorf("AWS token is longer than %d bytes", AWS_MAX_TOKEN_LENGTH)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, AWS_TOKEN_V1_PREFIX))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS token: %w", err)
+	}
+
+	u, err := url.Parse(string(decoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS token URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("unexpected AWS token URL scheme %q", u.Scheme)
+	}
+	if !awsSTSHostRegexp.MatchString(u.Host) && !slices.Contains(v.config.AllowedHosts, u.Host) {
+		return nil, fmt.Errorf("unexpected AWS token URL host %q", u.Host)
+	}
+	if u.Path != "/" && u.Path != "" {
+		return nil, fmt.Errorf("unexpected AWS token URL path %q", u.Path)
+	}
+
+	query := url.Values{}
+	for key, values := range u.Query() {
+		if !slices.Contains(awsAllowedParams, strings.ToLower(key)) {
+			return nil, fmt.Errorf("unexpected AWS token URL parameter %q", key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("AWS token URL parameter %q has %d values", key, len(values))
+		}
+		query.Set(strings.ToLower(key), values[0])
+	}
+
+	if query.Get("action") != "GetCallerIdentity" {
+		return nil, fmt.Errorf("unexpected AWS token action %q", query.Get("action"))
+	}
+
+	signedHeaders := strings.Split(query.Get("x-amz-signedheaders"), ";")
+	if !slices.Contains(signedHeaders, AWS_CLUSTER_ID_HEADER) {
+		return nil, fmt.Errorf("AWS token isn't signed with the %s header", AWS_CLUSTER_ID_HEADER)
+	}
+	for _, h := range signedHeaders {
+		if _, ok := v.config.Headers[h]; !ok && h != "host" && h != AWS_CLUSTER_ID_HEADER {
+			return nil, fmt.Errorf("AWS token is signed with unexpected header %q", h)
+		}
+	}
+
+	// STS accepts the request for 15 minutes after signing regardless of X-Amz-Expires, larger values
+	// aren't signed by the token generators
+	if query.Has("x-amz-expires") {
+		expires, err := strconv.Atoi(query.Get("x-amz-expires"))
+		if err != nil || expires < 1 || expires > AWS_MAX_PRESIGN_EXPIRES {
+			return nil, fmt.Errorf("AWS token X-Amz-Expires %q is out of range 1-%d", query.Get("x-amz-expires"), AWS_MAX_PRESIGN_EXPIRES)
+		}
+	}
+
+	date, err := time.Parse("20060102T150405Z", query.Get("x-amz-date"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS token date: %w", err)
+	}
+	now := time.Now()
+	if now.Add(v.leeway).Before(date) {
+		return nil, fmt.Errorf("AWS token is signed in the future at %s", date.Format(time.RFC3339))
+	}
+	if now.After(date.Add(AWS_PRESIGNED_URL_EXPIRATION + v.leeway)) {
+		return nil, fmt.Errorf("AWS token signed at %s is expired", date.Format(time.RFC3339))
+	}
+
+	return u, nil
+}
+
+// callerIdentity sends the presigned request to STS with the cluster ID header and returns the identity
+// of the signer. STS rejects requests signed for other cluster IDs as the header value is signed.
+func (v *awsVerifier) callerIdentity(ctx context.Context, presigned *url.URL) (*Identity, error) {
+	reqURL := *presigned
+	if v.config.STSEndpoint != "" {
+		endpoint, err := url.Parse(v.config.STSEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stsEndpoint: %w", err)
+		}
+		reqURL.Scheme, reqURL.Host = endpoint.Scheme, endpoint.Host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The signature covers the host of the presigned URL
+	req.Host = presigned.Host
+	req.Header.Set(AWS_CLUSTER_ID_HEADER, v.config.ClusterID)
+	for key, value := range v.config.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't call STS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read STS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Log.Debug(fmt.Sprintf("STS rejected token: %s", body))
+		return nil, fmt.Errorf("STS rejected AWS token with status %d", resp.StatusCode)
+	}
+
+	var caller awsCallerIdentity
+	if err := json.Unmarshal(body, &caller); err != nil {
+		return nil, fmt.Errorf("invalid STS response: %w", err)
+	}
+	result := caller.GetCallerIdentityResponse.GetCallerIdentityResult
+
+	canonicalARN, sessionName, err := canonicalizeARN(result.Arn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Platform: auth.PLATFORM_AWS,
+		Issuer:   AWS_ISSUER,
+		Subject:  canonicalARN,
+		// Role session name, the source session identifier for sessions assumed by k8xauth
+		SessionIdentifier: sessionName,
+		Claims: map[string]any{
+			"arn":         result.Arn,
+			"account":     result.Account,
+			"userId":      result.UserID,
+			"sessionName": sessionName,
+		},
+	}, nil
+}
+
+// canonicalizeARN returns the IAM role ARN of an assumed role session ARN with the session name, IAM
+// user ARNs are returned as they are.
+func canonicalizeARN(s string) (string, string, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid caller ARN %q: %w", s, err)
+	}
+
+	switch {
+	case a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/"):
+		parts := strings.Split(a.Resource, "/")
+		if len(parts) != 3 {
+			return "", "", fmt.Errorf("unexpected assumed role ARN %q", s)
+		}
+		return arn.ARN{Partition: a.Partition, Service: "iam", AccountID: a.AccountID, Resource: "role/" + parts[1]}.String(), parts[2], nil
+	case a.Service == "iam" && strings.HasPrefix(a.Resource, "user/"):
+		return s, "", nil
+	}
+	return "", "", fmt.Errorf("unsupported caller ARN %q", s)
+}
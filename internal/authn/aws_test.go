@@ -0,0 +1,344 @@
+package authn
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	awsTestClusterID = "prod-eu"
+	awsTestAccount   = "111111111111"
+)
+
+// awsTestSTS stands in for STS, returning the caller ARN of the access key in the credential of the
+// presigned request when it has the cluster ID header of the verifier.
+type awsTestSTS struct {
+	callers map[string]string
+	hosts   []string
+	calls   int
+}
+
+func (s *awsTestSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls++
+	s.hosts = append(s.hosts, r.Host)
+
+	// The signature of the request covers the cluster ID header
+	if r.Header.Get(AWS_CLUSTER_ID_HEADER) != awsTestClusterID || r.URL.Query().Get("Action") != "GetCallerIdentity" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	accessKey, _, _ := strings.Cut(r.URL.Query().Get("X-Amz-Credential"), "/")
+	callerARN, ok := s.callers[accessKey]
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var identity awsCallerIdentity
+	result := &identity.GetCallerIdentityResponse.GetCallerIdentityResult
+	result.Arn, result.Account, result.UserID = callerARN, strings.Split(callerARN, ":")[4], "AROAEXAMPLE:"+accessKey
+	json.NewEncoder(w).Encode(identity)
+}
+
+// newAWSTestVerifier returns a verifier sending the presigned requests to the STS stand-in.
+func newAWSTestVerifier(t *testing.T, sts *awsTestSTS, mappings []AWSMapping) *awsVerifier {
+	t.Helper()
+	server := httptest.NewTLSServer(sts)
+	t.Cleanup(server.Close)
+
+	v, err := newAWSVerifier(AWSConfig{
+		ClusterID:    awsTestClusterID,
+		AllowedHosts: []string{"vpce-0123.sts.eu-west-1.vpce.amazonaws.com"},
+		STSEndpoint:  server.URL,
+		Mappings:     mappings,
+	}, server.Client(), time.Minute)
+	if err != nil {
+		t.Fatalf("newAWSVerifier: %v", err)
+	}
+	return v
+}
+
+// awsTestToken returns a token presigning a GetCallerIdentity request with the access key, the URL
+// and query are changed by modify if set.
+func awsTestToken(accessKey string, signed time.Time, modify func(u *url.URL, query url.Values)) string {
+	u := &url.URL{Scheme: "https", Host: "sts.eu-west-1.amazonaws.com", Path: "/"}
+	query := url.Values{
+		"Action":              {"GetCallerIdentity"},
+		"Version":             {"2011-06-15"},
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {accessKey + "/" + signed.Format("20060102") + "/eu-west-1/sts/aws4_request"},
+		"X-Amz-Date":          {signed.UTC().Format("20060102T150405Z")},
+		"X-Amz-Expires":       {"60"},
+		"X-Amz-SignedHeaders": {"host;" + AWS_CLUSTER_ID_HEADER},
+		"X-Amz-Signature":     {"0123456789abcdef"},
+	}
+	if modify != nil {
+		modify(u, query)
+	}
+	u.RawQuery = query.Encode()
+	return AWS_TOKEN_V1_PREFIX + base64.RawURLEncoding.EncodeToString([]byte(u.String()))
+}
+
+func TestAWSAuthenticateMappings(t *testing.T) {
+	sts := &awsTestSTS{callers: map[string]string{
+		"ASIAADMIN":  "arn:aws:sts::111111111111:assumed-role/Admin/eks:prod:default:deployer",
+		"ASIAREADER": "arn:aws:sts::111111111111:assumed-role/Reader/reader-session",
+		"AKIAUSER":   "arn:aws:iam::111111111111:user/alice",
+		"ASIAOTHER":  "arn:aws:sts::222222222222:assumed-role/Admin/session",
+	}}
+	v := newAWSTestVerifier(t, sts, []AWSMapping{
+		{ARN: "arn:aws:iam::111111111111:role/Admin", Username: "admin:{{ .SessionIdentifier }}", Groups: []string{"system:masters"}},
+		{ARN: "arn:aws:iam::111111111111:user/alice", Groups: []string{"developers", "{{ .Claims.userId }}"}},
+		{Account: awsTestAccount, Username: "account:{{ .Claims.sessionName }}"},
+	})
+
+	tests := []struct {
+		name       string
+		accessKey  string
+		wantUser   string
+		wantGroups []string
+		wantErr    bool
+	}{
+		{
+			name:       "assumed role session maps by role ARN",
+			accessKey:  "ASIAADMIN",
+			wantUser:   "admin:eks:prod:default:deployer",
+			wantGroups: []string{"system:masters"},
+		},
+		{
+			name:       "IAM user maps by user ARN",
+			accessKey:  "AKIAUSER",
+			wantUser:   "arn:aws:iam::111111111111:user/alice",
+			wantGroups: []string{"developers", "AROAEXAMPLE:AKIAUSER"},
+		},
+		{
+			name:       "role without ARN mapping maps by account",
+			accessKey:  "ASIAREADER",
+			wantUser:   "account:reader-session",
+			wantGroups: []string{"k8xauth:aws"},
+		},
+		{
+			name:      "identity of another account isn't mapped",
+			accessKey: "ASIAOTHER",
+			wantErr:   true,
+		},
+		{
+			name:      "STS rejects unknown credentials",
+			accessKey: "ASIAUNKNOWN",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := v.authenticate(context.Background(), awsTestToken(tt.accessKey, time.Now(), nil))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("authenticated as %s, want error", user.Username)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			if user.Username != tt.wantUser {
+				t.Errorf("username = %q, want %q", user.Username, tt.wantUser)
+			}
+			if !slices.Equal(user.Groups, tt.wantGroups) {
+				t.Errorf("groups = %v, want %v", user.Groups, tt.wantGroups)
+			}
+		})
+	}
+
+	// Requests are sent to the STS endpoint with the host the URL was presigned for
+	for _, host := range sts.hosts {
+		if host != "sts.eu-west-1.amazonaws.com" {
+			t.Errorf("STS request host = %q, want presigned URL host", host)
+		}
+	}
+}
+
+func TestAWSPresignedURL(t *testing.T) {
+	sts := &awsTestSTS{callers: map[string]string{"ASIAADMIN": "arn:aws:sts::111111111111:assumed-role/Admin/session"}}
+	v := newAWSTestVerifier(t, sts, []AWSMapping{{Account: awsTestAccount}})
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			token: awsTestToken("ASIAADMIN", now, nil),
+		},
+		{
+			name:  "signed within the presigned URL expiration",
+			token: awsTestToken("ASIAADMIN", now.Add(-10*time.Minute), nil),
+		},
+		{
+			name: "allowed host",
+			token: awsTestToken("ASIAADMIN", now, func(u *url.URL, _ url.Values) {
+				u.Host = "vpce-0123.sts.eu-west-1.vpce.amazonaws.com"
+			}),
+		},
+		{
+			name:    "expired",
+			token:   awsTestToken("ASIAADMIN", now.Add(-AWS_PRESIGNED_URL_EXPIRATION-2*time.Minute), nil),
+			wantErr: "expired",
+		},
+		{
+			name:    "signed in the future",
+			token:   awsTestToken("ASIAADMIN", now.Add(5*time.Minute), nil),
+			wantErr: "future",
+		},
+		{
+			name: "oversized X-Amz-Expires",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("X-Amz-Expires", "86400")
+			}),
+			wantErr: "X-Amz-Expires",
+		},
+		{
+			name: "invalid X-Amz-Expires",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("X-Amz-Expires", "0")
+			}),
+			wantErr: "X-Amz-Expires",
+		},
+		{
+			name: "oversized token",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("X-Amz-Security-Token", strings.Repeat("a", AWS_MAX_TOKEN_LENGTH))
+			}),
+			wantErr: "longer than",
+		},
+		{
+			name: "non-STS host",
+			token: awsTestToken("ASIAADMIN", now, func(u *url.URL, _ url.Values) {
+				u.Host = "attacker.example.com"
+			}),
+			wantErr: "host",
+		},
+		{
+			name: "STS host suffix",
+			token: awsTestToken("ASIAADMIN", now, func(u *url.URL, _ url.Values) {
+				u.Host = "sts.amazonaws.com.attacker.example.com"
+			}),
+			wantErr: "host",
+		},
+		{
+			name: "S3 bucket host",
+			token: awsTestToken("ASIAADMIN", now, func(u *url.URL, _ url.Values) {
+				u.Host = "sts.s3.amazonaws.com"
+			}),
+			wantErr: "host",
+		},
+		{
+			name: "http scheme",
+			token: awsTestToken("ASIAADMIN", now, func(u *url.URL, _ url.Values) {
+				u.Scheme = "http"
+			}),
+			wantErr: "scheme",
+		},
+		{
+			name: "other action",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("Action", "AssumeRole")
+			}),
+			wantErr: "action",
+		},
+		{
+			name: "unexpected parameter",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("RoleArn", "arn:aws:iam::111111111111:role/Admin")
+			}),
+			wantErr: "parameter",
+		},
+		{
+			name: "not signed with cluster ID header",
+			token: awsTestToken("ASIAADMIN", now, func(_ *url.URL, query url.Values) {
+				query.Set("X-Amz-SignedHeaders", "host")
+			}),
+			wantErr: AWS_CLUSTER_ID_HEADER,
+		},
+		{
+			name:    "v2 token",
+			token:   "k8s-aws-v2." + strings.TrimPrefix(awsTestToken("ASIAADMIN", now, nil), AWS_TOKEN_V1_PREFIX),
+			wantErr: "invalid AWS token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := sts.calls
+			_, err := v.authenticate(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("authenticate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+			}
+			// Invalid URLs are never sent anywhere
+			if sts.calls != calls {
+				t.Errorf("invalid token sent to STS")
+			}
+		})
+	}
+
+	if isAWSToken("k8s-aws-v2.token") {
+		t.Error("k8s-aws-v2 token accepted as AWS token")
+	}
+}
+
+func TestCanonicalizeARN(t *testing.T) {
+	tests := []struct {
+		arn         string
+		want        string
+		wantSession string
+		wantErr     bool
+	}{
+		{
+			arn:         "arn:aws:sts::111111111111:assumed-role/Admin/session",
+			want:        "arn:aws:iam::111111111111:role/Admin",
+			wantSession: "session",
+		},
+		{
+			arn:         "arn:aws-cn:sts::111111111111:assumed-role/Admin/eks:prod:default:deployer",
+			want:        "arn:aws-cn:iam::111111111111:role/Admin",
+			wantSession: "eks:prod:default:deployer",
+		},
+		{
+			arn:  "arn:aws:iam::111111111111:user/alice",
+			want: "arn:aws:iam::111111111111:user/alice",
+		},
+		{arn: "arn:aws:sts::111111111111:assumed-role/Admin", wantErr: true},
+		{arn: "arn:aws:sts::111111111111:federated-user/bob", wantErr: true},
+		{arn: "arn:aws:iam::111111111111:role/Admin", wantErr: true},
+		{arn: "not-an-arn", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, session, err := canonicalizeARN(tt.arn)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("canonicalizeARN(%q) = %q, want error", tt.arn, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || session != tt.wantSession {
+			t.Errorf("canonicalizeARN(%q) = %q, %q, %v, want %q, %q", tt.arn, got, session, err, tt.want, tt.wantSession)
+		}
+	}
+}
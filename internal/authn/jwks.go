@@ -0,0 +1,129 @@
+package authn
+
+import (
+	"k8xauth/internal/logger"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+const (
+	// JWKS_MIN_REFRESH_INTERVAL limits fetching the key set again for tokens signed with unknown keys.
+	JWKS_MIN_REFRESH_INTERVAL = time.Minute
+	DISCOVERY_PATH            = "/.well-known/openid-configuration"
+)
+
+// keySet is the JSON Web Key Set of an issuer, fetched again after the TTL or when a token is signed
+// with a key it doesn't have, e.g. after the issuer rotated its keys.
+type keySet struct {
+	issuer string
+	// jwksURL is the key set URL, discovered from the issuer OpenID configuration if empty.
+	jwksURL string
+	ttl     time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// verificationKeys returns the keys with the key ID, all keys if the token has no key ID.
+func (k *keySet) verificationKeys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys == nil || time.Since(k.fetched) > k.ttl {
+		if err := k.refresh(ctx); err != nil {
+			if k.keys == nil {
+				return nil, err
+			}
+			// Keys fetched before are used until the issuer is reachable again
+			logger.Log.Error(fmt.Sprintf("Couldn't refresh keys of %s: %s", k.issuer, err.Error()))
+		}
+	}
+
+	keys := k.lookup(kid)
+	if len(keys) == 0 && time.Since(k.fetched) > JWKS_MIN_REFRESH_INTERVAL {
+		logger.Log.Debug(fmt.Sprintf("Key %q of %s not found, refreshing keys", kid, k.issuer))
+		if err := k.refresh(ctx); err != nil {
+			return nil, err
+		}
+		keys = k.lookup(kid)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key %q not found in %s keys", kid, k.issuer)
+	}
+
+	return keys, nil
+}
+
+func (k *keySet) lookup(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return k.keys.Keys
+	}
+	return k.keys.Key(kid)
+}
+
+// refresh fetches the key set, discovering its URL first if not configured.
+func (k *keySet) refresh(ctx context.Context) error {
+	jwksURL := k.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := k.get(ctx, strings.TrimSuffix(k.issuer, "/")+DISCOVERY_PATH, &discovery); err != nil {
+			return fmt.Errorf("couldn't discover OpenID configuration: %w", err)
+		}
+		if discovery.Issuer != k.issuer {
+			return fmt.Errorf("OpenID configuration issuer %q doesn't match %q", discovery.Issuer, k.issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("no jwks_uri in OpenID configuration")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := k.get(ctx, jwksURL, &keys); err != nil {
+		return fmt.Errorf("couldn't fetch keys: %w", err)
+	}
+
+	logger.Log.Debug(fmt.Sprintf("Fetched %d keys of %s from %s", len(keys.Keys), k.issuer, jwksURL))
+	k.keys = &keys
+	k.fetched = time.Now()
+	return nil
+}
+
+func (k *keySet) get(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	BROKER_ENV  = "K8XAUTH_BROKER"
+	TOKEN_PATH  = "/v1/token"
+	HEALTH_PATH = "/healthz"
+	// DEFAULT_TOKEN_FILE is the Kubernetes ServiceAccount token callers authenticate with by default.
+	DEFAULT_TOKEN_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	requestTimeout     = 5 * time.Minute
+)
+
+// Request asks the broker for credentials of a target command.
+type Request struct {
+	// Target is the target command name, e.g. "eks".
+	Target string `json:"target"`
+	// Args are the target flags of the invocation, parsed by the broker with the target command flags.
+	// Root command persistent flags are not accepted, the broker authenticates with its own source.
+	Args []string `json:"args"`
+	// ClusterServer is the target cluster API server URL provided in KUBERNETES_EXEC_INFO.
+	ClusterServer string `json:"clusterServer,omitempty"`
+}
+
+// Response is the broker answer to a Request.
+type Response struct {
+	Token *oauth2.Token `json:"token,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// NewHTTPClient returns an HTTP client connecting to the broker, trusting the PEM encoded CA
+// certificates in the file if set and the system roots otherwise.
+func NewHTTPClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read broker CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no PEM encoded certificates found in broker CA certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: transport,
+	}, nil
+}
+
+// Token requests credentials from the broker at the URL, authenticated with the caller token.
+func Token(ctx context.Context, client *http.Client, brokerURL, callerToken string, r Request) (*oauth2.Token, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(brokerURL, "/")+TOKEN_PATH, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+callerToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("couldn't decode broker response (status %d): %w", resp.StatusCode, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("broker (status %d): %s", resp.StatusCode, response.Error)
+	}
+	if resp.StatusCode != http.StatusOK || response.Token == nil {
+		return nil, fmt.Errorf("broker returned no token (status %d)", resp.StatusCode)
+	}
+
+	return response.Token, nil
+}
@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// ErrDenied is returned when no policy rule allows the request.
+var ErrDenied = errors.New("denied by broker policy")
+
+// PolicyConfig is the broker policy configuration. Requests are denied unless a rule allows them.
+type PolicyConfig struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// RuleConfig allows callers to request credentials of targets. Patterns are globs whose * matches any
+// characters, including / and :.
+type RuleConfig struct {
+	// Name identifies the rule in audit logs.
+	Name string `json:"name"`
+	// Users are patterns of the caller usernames, e.g. system:serviceaccount:argocd:*.
+	Users []string `json:"users,omitempty"`
+	// Groups are patterns of the caller groups. The caller has to match Users or Groups.
+	Groups []string `json:"groups,omitempty"`
+	// Targets are names of the targets the caller may request, e.g. eks.
+	Targets []string `json:"targets"`
+	// Args are patterns of the values the caller may request the target flags with, e.g. rolearn.
+	// Flags not listed may be set to any value, default values of listed flags have to match too.
+	Args map[string][]string `json:"args,omitempty"`
+}
+
+// Policy decides which callers may request credentials of which targets.
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	name    string
+	users   []*regexp.Regexp
+	groups  []*regexp.Regexp
+	targets []string
+	args    map[string][]*regexp.Regexp
+}
+
+// NewPolicy returns the policy of the configuration.
+func NewPolicy(config PolicyConfig) (*Policy, error) {
+	if len(config.Rules) == 0 {
+		return nil, errors.New("no rules configured")
+	}
+
+	p := &Policy{}
+	names := map[string]bool{}
+	for n, c := range config.Rules {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("rules[%d]", n)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("rule %s configured twice", c.Name)
+		}
+		names[c.Name] = true
+
+		if len(c.Users) == 0 && len(c.Groups) == 0 {
+			return nil, fmt.Errorf("rule %s has no users or groups", c.Name)
+		}
+		if len(c.Targets) == 0 {
+			return nil, fmt.Errorf("rule %s has no targets", c.Name)
+		}
+
+		r := rule{
+			name:    c.Name,
+			users:   compileGlobs(c.Users),
+			groups:  compileGlobs(c.Groups),
+			targets: c.Targets,
+			args:    map[string][]*regexp.Regexp{},
+		}
+		for flag, patterns := range c.Args {
+			if len(patterns) == 0 {
+				return nil, fmt.Errorf("rule %s has no patterns of flag %s", c.Name, flag)
+			}
+			r.args[flag] = compileGlobs(patterns)
+		}
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+// compileGlobs returns regular expressions matching the whole value against the patterns.
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	globs := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+		globs = append(globs, regexp.MustCompile("^"+quoted+"$"))
+	}
+	return globs
+}
+
+func matchAny(globs []*regexp.Regexp, value string) bool {
+	for _, g := range globs {
+		if g.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow returns the name of the first rule allowing the user to request the target with the flag values,
+// args holding the values of all target flags. An error wrapping ErrDenied is returned if no rule allows it.
+func (p *Policy) Allow(user authenticationv1.UserInfo, target string, args map[string][]string) (string, error) {
+	var reasons []string
+	for _, r := range p.rules {
+		if !slices.Contains(r.targets, target) || !r.matchesUser(user) {
+			continue
+		}
+		if reason := r.argsDenied(args); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("rule %s: %s", r.name, reason))
+			continue
+		}
+		return r.name, nil
+	}
+
+	if len(reasons) == 0 {
+		return "", fmt.Errorf("%w: no rule allows %s to request %s", ErrDenied, user.Username, target)
+	}
+	return "", fmt.Errorf("%w: %s", ErrDenied, strings.Join(reasons, ", "))
+}
+
+func (r rule) matchesUser(user authenticationv1.UserInfo) bool {
+	if matchAny(r.users, user.Username) {
+		return true
+	}
+	for _, group := range user.Groups {
+		if matchAny(r.groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// argsDenied returns why the flag values aren't allowed, empty if they are.
+func (r rule) argsDenied(args map[string][]string) string {
+	for _, flag := range slices.Sorted(maps.Keys(r.args)) {
+		globs := r.args[flag]
+		values, ok := args[flag]
+		if !ok {
+			return fmt.Sprintf("target has no flag %s", flag)
+		}
+		for _, value := range values {
+			if !matchAny(globs, value) {
+				return fmt.Sprintf("--%s %q isn't allowed", flag, value)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,340 @@
+package cache
+
+import (
+	"k8xauth/internal/logger"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_KEY_ENV  = "K8XAUTH_CACHE_KEY"
+	keyFileName    = "cache.key"
+	entryExtension = ".bin"
+	keySize        = 32
+)
+
+// Options configures the credential cache.
+type Options struct {
+	// Dir is the directory cache entries are stored in.
+	Dir string
+	// KeyFile is the path to the encryption key file. If not set, the key is taken from
+	// K8XAUTH_CACHE_KEY environment variable or generated in DefaultKeyFile. The key file can't be
+	// in Dir.
+	KeyFile string
+	// Skew is the period before expiry in which cached entries are refreshed.
+	Skew time.Duration
+	// SourceIdentity identifies the source identity, entries of other source identities are not used.
+	SourceIdentity string
+	// LockTimeout is the longest time a process waits for another one retrieving the same credentials.
+	LockTimeout time.Duration
+}
+
+// Cache is an on-disk cache of credentials encrypted with AES-256-GCM, or an in-memory cache
+// for long-running processes. A nil *Cache is a disabled cache, Get always misses and Put does nothing.
+type Cache struct {
+	memory         *memoryStore
+	dir            string
+	aead           cipher.AEAD
+	skew           time.Duration
+	sourceIdentity string
+	lockTimeout    time.Duration
+	staleLockAge   time.Duration
+}
+
+// entry is a cache entry as stored (encrypted) on disk.
+type entry struct {
+	Expiry time.Time       `json:"expiry"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// memoryStore holds entries of an in-memory cache.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	// locks single-flight retrieval of the same key
+	locks map[string]*keyLock
+}
+
+// DefaultDir returns the default cache directory.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "k8xauth")
+}
+
+// DefaultKeyFile returns the path of the generated encryption key, in the user configuration directory
+// so it is kept apart from the entries it encrypts.
+func DefaultKeyFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "k8xauth", keyFileName), nil
+}
+
+// New returns a credential cache stored in o.Dir. It fails when no key is configured and none can be
+// generated outside o.Dir, entries are never stored next to the key decrypting them.
+func New(o Options) (*Cache, error) {
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create cache directory: %w", err)
+	}
+
+	key, err := loadKey(o)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cache{
+		dir:            o.Dir,
+		aead:           aead,
+		skew:           o.Skew,
+		sourceIdentity: o.SourceIdentity,
+		lockTimeout:    o.LockTimeout,
+		// Lock holders retrieve credentials within the timeout others wait for them
+		staleLockAge: 2 * o.LockTimeout,
+	}, nil
+}
+
+// NewMemory returns an in-memory credential cache.
+func NewMemory(skew time.Duration, sourceIdentity string) *Cache {
+	return &Cache{
+		memory: &memoryStore{
+			entries: map[string]entry{},
+			locks:   map[string]*keyLock{},
+		},
+		skew:           skew,
+		sourceIdentity: sourceIdentity,
+	}
+}
+
+// loadKey returns the encryption key from the key file, the environment or generates one
+// in the default key file on first use.
+func loadKey(o Options) ([]byte, error) {
+	if o.KeyFile == "" {
+		if env := os.Getenv(CACHE_KEY_ENV); env != "" {
+			return decodeKey(env)
+		}
+	}
+
+	keyFile := o.KeyFile
+	if keyFile == "" {
+		var err error
+		if keyFile, err = DefaultKeyFile(); err != nil {
+			return nil, fmt.Errorf("no cache key configured and no directory to generate it in: %w", err)
+		}
+	}
+	if isWithin(o.Dir, keyFile) {
+		return nil, fmt.Errorf("cache key file %s has to be outside the cache directory", keyFile)
+	}
+
+	b, err := os.ReadFile(keyFile)
+	if err == nil {
+		return decodeKey(string(b))
+	}
+	if !errors.Is(err, os.ErrNotExist) || o.KeyFile != "" {
+		return nil, fmt.Errorf("couldn't read cache key file: %w", err)
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create cache key directory: %w", err)
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		// Key was created by a concurrent invocation
+		return loadKey(o)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create cache key file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// isWithin returns whether path is dir or in it.
+func isWithin(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode cache key: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("cache key has to be %d bytes long", keySize)
+	}
+	return key, nil
+}
+
+// Key returns the cache key for the parts, scoped to the source identity.
+func (c *Cache) Key(parts ...string) string {
+	if c == nil {
+		return ""
+	}
+	h := sha256.New()
+	for _, p := range append([]string{c.sourceIdentity}, parts...) {
+		// Length prefix keeps part boundaries unambiguous
+		fmt.Fprintf(h, "%d:%s;", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+entryExtension)
+}
+
+// Get decodes the entry stored under key into v. It returns false if there is no entry,
+// the entry expires within the refresh skew or it can't be decrypted.
+func (c *Cache) Get(key string, v any) bool {
+	if c == nil {
+		return false
+	}
+
+	e, ok := c.read(key)
+	if !ok {
+		return false
+	}
+
+	if time.Now().Add(c.skew).After(e.Expiry) {
+		logger.Log.Debug("Cache - Entry expired or about to expire")
+		return false
+	}
+
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		logger.Log.Debug("Cache - Couldn't decode entry value: " + err.Error())
+		return false
+	}
+
+	logger.Log.Debug(fmt.Sprintf("Cache - Using entry valid until %s", e.Expiry.Format(time.RFC3339)))
+	return true
+}
+
+// read returns the entry stored under key.
+func (c *Cache) read(key string) (entry, bool) {
+	if c.memory != nil {
+		c.memory.mu.Lock()
+		defer c.memory.mu.Unlock()
+		e, ok := c.memory.entries[key]
+		return e, ok
+	}
+
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Debug("Cache - Couldn't read entry: " + err.Error())
+		}
+		return entry{}, false
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(b) < nonceSize {
+		logger.Log.Debug("Cache - Invalid entry")
+		return entry{}, false
+	}
+	plaintext, err := c.aead.Open(nil, b[:nonceSize], b[nonceSize:], []byte(key))
+	if err != nil {
+		logger.Log.Debug("Cache - Couldn't decrypt entry: " + err.Error())
+		return entry{}, false
+	}
+
+	var e entry
+	if err := json.Unmarshal(plaintext, &e); err != nil {
+		logger.Log.Debug("Cache - Couldn't decode entry: " + err.Error())
+		return entry{}, false
+	}
+	return e, true
+}
+
+// Put stores v under key until expiry. The entry is written atomically so concurrent
+// readers never see a partially written entry.
+func (c *Cache) Put(key string, v any, expiry time.Time) error {
+	if c == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if c.memory != nil {
+		c.memory.mu.Lock()
+		defer c.memory.mu.Unlock()
+		// Expired entries are dropped so long-running processes don't accumulate them
+		for k, e := range c.memory.entries {
+			if time.Now().After(e.Expiry) {
+				delete(c.memory.entries, k)
+			}
+		}
+		c.memory.entries[key] = entry{Expiry: expiry, Value: value}
+		return nil
+	}
+
+	plaintext, err := json.Marshal(entry{Expiry: expiry, Value: value})
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	ciphertext := c.aead.Seal(nonce, nonce, plaintext, []byte(key))
+
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("couldn't create cache entry: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(ciphertext); err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't write cache entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), c.path(key))
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache in a temporary directory with its key generated in a temporary user
+// configuration directory.
+func newTestCache(t *testing.T, dir string) *Cache {
+	t.Helper()
+	t.Setenv(CACHE_KEY_ENV, "")
+	if os.Getenv("XDG_CONFIG_HOME") == "" {
+		t.Setenv("XDG_CONFIG_HOME", filepath.Join(t.TempDir(), "config"))
+	}
+
+	c, err := New(Options{Dir: dir, Skew: time.Minute, LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestGeneratedKeyOutsideDir(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	t.Setenv("XDG_CONFIG_HOME", config)
+	dir := filepath.Join(t.TempDir(), "cache")
+
+	c := newTestCache(t, dir)
+	key := c.Key("token")
+	if err := c.Put(key, "secret", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(config, "k8xauth", keyFileName)); err != nil {
+		t.Fatalf("generated key: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), entryExtension) {
+			t.Errorf("unexpected file %s in cache directory", e.Name())
+		}
+	}
+
+	// Another process reuses the generated key
+	var v string
+	if !newTestCache(t, dir).Get(key, &v) || v != "secret" {
+		t.Errorf("Get = %q, want entry of the first cache", v)
+	}
+}
+
+func TestKeyFileInDir(t *testing.T) {
+	t.Setenv(CACHE_KEY_ENV, "")
+	dir := t.TempDir()
+
+	for _, keyFile := range []string{filepath.Join(dir, "cache.key"), filepath.Join(dir, "keys", "cache.key"), dir} {
+		_, err := New(Options{Dir: dir, KeyFile: keyFile})
+		if err == nil || !strings.Contains(err.Error(), "outside the cache directory") {
+			t.Errorf("New with key file %s: error = %v, want key file outside the cache directory", keyFile, err)
+		}
+	}
+
+	// Cache directory set to the directory the key is generated in
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	if _, err := New(Options{Dir: filepath.Join(dir, "k8xauth")}); err == nil {
+		t.Error("New generated key in the cache directory")
+	}
+}
+
+func TestNoKeyLocation(t *testing.T) {
+	t.Setenv(CACHE_KEY_ENV, "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "")
+
+	if _, err := New(Options{Dir: t.TempDir()}); err == nil {
+		t.Error("New without key location succeeded")
+	}
+}
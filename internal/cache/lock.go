@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"k8xauth/internal/logger"
+
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	lockExtension    = ".lock"
+	lockPollInterval = 50 * time.Millisecond
+)
+
+// lock is a lock file held by one process per cache key while it retrieves credentials, or a
+// mutex of the key for in-memory caches.
+type lock struct {
+	path string
+	// token identifies the process holding the lock file.
+	token string
+	// memory and key identify the mutex of in-memory caches.
+	memory *memoryStore
+	key    string
+}
+
+// keyLock is the mutex of a key of in-memory caches, removed once no goroutine holds or waits for it.
+type keyLock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+// lock acquires the lock of the key, waiting for the process holding it at most the lock timeout.
+// Lock files older than the stale lock age are left behind by crashed processes and removed. Removal
+// racing with another waiter can at worst let two processes retrieve the same credentials.
+func (c *Cache) lock(key string) (*lock, error) {
+	if c.memory != nil {
+		c.memory.mu.Lock()
+		kl, ok := c.memory.locks[key]
+		if !ok {
+			kl = &keyLock{}
+			c.memory.locks[key] = kl
+		}
+		kl.holders++
+		c.memory.mu.Unlock()
+
+		kl.mu.Lock()
+		return &lock{memory: c.memory, key: key}, nil
+	}
+
+	path := filepath.Join(c.dir, key+lockExtension)
+	token := fmt.Sprintf("%d-%016x", os.Getpid(), rand.Uint64())
+	deadline := time.Now().Add(c.lockTimeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("couldn't write lock file: %w", err)
+			}
+			return &lock{path: path, token: token}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("couldn't create lock file: %w", err)
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > c.staleLockAge {
+			removeStaleLock(path, info)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", path)
+		}
+
+		// Jitter spreads concurrent processes polling the same lock
+		time.Sleep(lockPollInterval + rand.N(lockPollInterval))
+	}
+}
+
+// removeStaleLock removes the lock file if it is still the stale one. Another waiter may have removed
+// the stale lock and a process taken the lock since, so the file is moved aside first and restored if it
+// isn't the stale one.
+func removeStaleLock(path string, stale os.FileInfo) {
+	aside := fmt.Sprintf("%s.%016x.stale", path, rand.Uint64())
+	if err := os.Rename(path, aside); err != nil {
+		return
+	}
+
+	// Inodes are reused, the lock taken since has a recent modification time
+	info, err := os.Stat(aside)
+	if err == nil && os.SameFile(info, stale) && info.ModTime().Equal(stale.ModTime()) {
+		logger.Log.Debug("Cache - Removing stale lock " + path)
+		os.Remove(aside)
+		return
+	}
+
+	// Link fails if yet another process took the lock meanwhile, its lock is kept
+	if err := os.Link(aside, path); err != nil && !errors.Is(err, os.ErrExist) {
+		logger.Log.Debug("Cache - Couldn't restore lock: " + err.Error())
+	}
+	os.Remove(aside)
+}
+
+// unlock releases the lock. The lock file is only removed while it holds the token of the lock, it
+// may have been removed as stale and taken by another process.
+func (l *lock) unlock() {
+	if l.memory != nil {
+		l.memory.mu.Lock()
+		kl := l.memory.locks[l.key]
+		kl.holders--
+		if kl.holders == 0 {
+			delete(l.memory.locks, l.key)
+		}
+		l.memory.mu.Unlock()
+
+		kl.mu.Unlock()
+		return
+	}
+
+	b, err := os.ReadFile(l.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Log.Debug("Cache - Couldn't read lock: " + err.Error())
+		}
+		return
+	}
+	if string(b) != l.token {
+		logger.Log.Debug("Cache - Lock " + l.path + " was taken by another process")
+		return
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Log.Debug("Cache - Couldn't remove lock: " + err.Error())
+	}
+}
+
+// Fetch returns the value cached under key, or the value returned by fetch, cached until the returned
+// expiry. Concurrent processes missing the same key are coordinated with a lock file (goroutines with
+// a mutex for in-memory caches) so only one of them calls fetch while the others wait and read its
+// result. If the lock can't be acquired in time, fetch is called without it. A nil cache calls fetch.
+func Fetch[T any](c *Cache, key string, fetch func() (T, time.Time, error)) (T, error) {
+	var v T
+	if c == nil || key == "" {
+		v, _, err := fetch()
+		return v, err
+	}
+
+	if c.Get(key, &v) {
+		return v, nil
+	}
+
+	l, err := c.lock(key)
+	if err != nil {
+		logger.Log.Debug("Cache - " + err.Error())
+	} else {
+		defer l.unlock()
+
+		// Value was retrieved by the process holding the lock before
+		if c.Get(key, &v) {
+			return v, nil
+		}
+	}
+
+	v, expiry, err := fetch()
+	if err != nil {
+		return v, err
+	}
+
+	if !expiry.IsZero() {
+		if err := c.Put(key, v, expiry); err != nil {
+			logger.Log.Debug("Cache - Couldn't store entry: " + err.Error())
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fetchConcurrently fetches the key from every cache at once and returns the values and the number of
+// fetch calls.
+func fetchConcurrently(t *testing.T, caches []*Cache, key string) ([]string, int32) {
+	t.Helper()
+
+	var fetches atomic.Int32
+	values := make([]string, len(caches))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, c := range caches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			v, err := Fetch(c, key, func() (string, time.Time, error) {
+				n := fetches.Add(1)
+				// Slow retrieval keeps the others waiting on the lock
+				time.Sleep(200 * time.Millisecond)
+				return fmt.Sprintf("token-%d", n), time.Now().Add(time.Hour), nil
+			})
+			if err != nil {
+				t.Errorf("Fetch: %v", err)
+			}
+			values[i] = v
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	return values, fetches.Load()
+}
+
+func TestFetchSharedDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every cache stands for a process sharing the cache directory
+	caches := make([]*Cache, 20)
+	for i := range caches {
+		caches[i] = newTestCache(t, dir)
+	}
+
+	values, fetches := fetchConcurrently(t, caches, caches[0].Key("eks", "cluster"))
+	if fetches != 1 {
+		t.Errorf("fetched %d times, want 1", fetches)
+	}
+	for i, v := range values {
+		if v != values[0] {
+			t.Errorf("cache %d got %q, want %q", i, v, values[0])
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+lockExtension))
+	if len(matches) != 0 {
+		t.Errorf("lock files left behind: %v", matches)
+	}
+}
+
+func TestFetchMemory(t *testing.T) {
+	c := NewMemory(time.Minute, "")
+
+	caches := make([]*Cache, 20)
+	for i := range caches {
+		caches[i] = c
+	}
+
+	_, fetches := fetchConcurrently(t, caches, c.Key("gke", "cluster"))
+	if fetches != 1 {
+		t.Errorf("fetched %d times, want 1", fetches)
+	}
+
+	if len(c.memory.locks) != 0 {
+		t.Errorf("%d key locks left in memory, want 0", len(c.memory.locks))
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	c := newTestCache(t, t.TempDir())
+	key := c.Key("aks", "cluster")
+
+	path := filepath.Join(c.dir, key+lockExtension)
+	if err := os.WriteFile(path, []byte("crashed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * c.staleLockAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		l, err := c.lock(key)
+		if err == nil {
+			l.unlock()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+	case <-time.After(c.lockTimeout):
+		t.Fatal("stale lock wasn't removed")
+	}
+}
+
+func TestRemoveStaleLockOwnership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key"+lockExtension)
+	if err := os.WriteFile(path, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another waiter removed the stale lock and a process took the lock
+	os.Remove(path)
+	if err := os.WriteFile(path, []byte("owner"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	removeStaleLock(path, stale)
+
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != "owner" {
+		t.Errorf("lock of the owner = %q, %v, want it kept", b, err)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 0 {
+		t.Errorf("files left behind: %v", matches)
+	}
+}
+
+func TestUnlockOwnership(t *testing.T) {
+	c := newTestCache(t, t.TempDir())
+	key := c.Key("arc", "cluster")
+
+	l, err := c.lock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock was removed as stale and taken by another process
+	if err := os.WriteFile(l.path, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l.unlock()
+
+	if _, err := os.Stat(l.path); err != nil {
+		t.Errorf("lock of another process removed: %v", err)
+	}
+}
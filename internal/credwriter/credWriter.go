@@ -1,10 +1,14 @@
 package credwriter
 
 import (
+	"k8xauth/internal/cache"
+
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"golang.org/x/oauth2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -65,6 +69,25 @@ func (*ExecCredentialWriter) Write(token oauth2.Token, writer ...io.Writer) erro
 	return nil
 }
 
+// WriteCached writes the ExecCredential of the token stored in the credential cache under key.
+// If there is no valid cached token, the token returned by fetch is written and cached, with
+// concurrent invocations waiting for the one retrieving it. Caching is skipped when the cache is
+// disabled (nil) or the key is empty.
+func (w *ExecCredentialWriter) WriteCached(c *cache.Cache, key string, fetch func() (*oauth2.Token, error), writer ...io.Writer) error {
+	token, err := cache.Fetch(c, key, func() (*oauth2.Token, time.Time, error) {
+		token, err := fetch()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return token, token.Expiry, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Write(*token, writer...)
+}
+
 func getAPIVersionFromExecInfoEnv() (string, error) {
 	env := os.Getenv(execInfoEnv)
 	if env == "" {
@@ -83,3 +106,44 @@ func getAPIVersionFromExecInfoEnv() (string, error) {
 		return "", fmt.Errorf("api version: %s is not supported", execCredential.TypeMeta.APIVersion)
 	}
 }
+
+// GetClusterServerFromExecInfoEnv returns the target cluster API server URL provided by the
+// Kubernetes client in KUBERNETES_EXEC_INFO when the exec plugin is configured with provideClusterInfo.
+func GetClusterServerFromExecInfoEnv() (string, error) {
+	env := os.Getenv(execInfoEnv)
+	if env == "" {
+		return "", fmt.Errorf("%s environment variable not set", execInfoEnv)
+	}
+	var execCredential clientauthentication.ExecCredential
+	if err := json.Unmarshal([]byte(env), &execCredential); err != nil {
+		return "", fmt.Errorf("cannot unmarshal %q to ExecCredential: %w", env, err)
+	}
+	if execCredential.Spec.Cluster == nil || execCredential.Spec.Cluster.Server == "" {
+		return "", fmt.Errorf("no cluster info in %s, exec plugin has to be configured with provideClusterInfo: true", execInfoEnv)
+	}
+	return execCredential.Spec.Cluster.Server, nil
+}
+
+// WriteFileAtomic writes data to the file at path by replacing it with a temporary file written
+// next to it, so readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
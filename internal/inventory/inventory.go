@@ -0,0 +1,101 @@
+package inventory
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	CLOUD_AWS   = "aws"
+	CLOUD_GCP   = "gcp"
+	CLOUD_AZURE = "azure"
+)
+
+// Cluster is a cluster listed in a cloud API, normalized across clouds.
+type Cluster struct {
+	// Name is the cluster name.
+	Name string `json:"name"`
+	// Cloud is the cloud the cluster runs in, aws, gcp or azure.
+	Cloud string `json:"cloud"`
+	// ID is the cloud resource identifier of the cluster (ARN, resource name, ARM resource ID).
+	ID string `json:"id"`
+	// Account is the AWS account, Google Cloud project or Azure subscription of the cluster.
+	Account string `json:"account"`
+	// Location is the region or zone of the cluster.
+	Location string `json:"location"`
+	// Endpoint is the API server URL.
+	Endpoint string `json:"endpoint"`
+	// CAData is the PEM encoded cluster CA.
+	CAData []byte `json:"caData,omitempty"`
+	// Labels are the cluster tags or labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Args are the k8xauth arguments authenticating with the cluster.
+	Args []string `json:"args"`
+	// Flags are the target flags identifying the cluster, overriding the listing flags in Args.
+	Flags map[string]string `json:"-"`
+}
+
+// Matches reports whether the cluster has all the labels, "*" matching any value of a label.
+func (c Cluster) Matches(labels map[string]string) bool {
+	for k, v := range labels {
+		value, ok := c.Labels[k]
+		if !ok || (v != "*" && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sort sorts the clusters by cloud, account, location and name.
+func Sort(clusters []Cluster) {
+	sort.Slice(clusters, func(i, j int) bool {
+		a, b := clusters[i], clusters[j]
+		if a.Cloud != b.Cloud {
+			return a.Cloud < b.Cloud
+		}
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		return a.Name < b.Name
+	})
+}
+
+// ForEach calls fn for every item with at most concurrency calls running at once and returns the
+// clusters of all calls with the errors of the failed ones.
+func ForEach[T any](items []T, concurrency int, fn func(item T) ([]Cluster, error)) ([]Cluster, []error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		clusters []Cluster
+		errs     []error
+	)
+
+	sem := make(chan struct{}, concurrency)
+	for _, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			c, err := fn(item)
+
+			mu.Lock()
+			defer mu.Unlock()
+			clusters = append(clusters, c...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return clusters, errs
+}
@@ -0,0 +1,109 @@
+package kubeconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	EXEC_API_VERSION = "client.authentication.k8s.io/v1beta1"
+)
+
+// Cluster describes a target cluster API server.
+type Cluster struct {
+	// Name is the name of the cluster, user and context entries.
+	Name string
+	// Server is the API server URL.
+	Server string
+	// CertificateAuthorityData is the PEM encoded cluster CA.
+	CertificateAuthorityData []byte
+	// CertificateAuthority is the path to the PEM encoded cluster CA file, used if no data is set.
+	CertificateAuthority string
+}
+
+// newConfig returns a kubeconfig with the cluster, the user and a context selecting them.
+func newConfig(c Cluster, user *clientcmdapi.AuthInfo) *clientcmdapi.Config {
+	cluster := clientcmdapi.NewCluster()
+	cluster.Server = c.Server
+	cluster.CertificateAuthorityData = c.CertificateAuthorityData
+	if len(c.CertificateAuthorityData) == 0 {
+		cluster.CertificateAuthority = c.CertificateAuthority
+	}
+
+	context := clientcmdapi.NewContext()
+	context.Cluster = c.Name
+	context.AuthInfo = c.Name
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[c.Name] = cluster
+	config.AuthInfos[c.Name] = user
+	config.Contexts[c.Name] = context
+	config.CurrentContext = c.Name
+
+	return config
+}
+
+// WithToken returns a kubeconfig of the cluster authenticating with the bearer token.
+func WithToken(c Cluster, token string) ([]byte, error) {
+	user := clientcmdapi.NewAuthInfo()
+	user.Token = token
+
+	return clientcmd.Write(*newConfig(c, user))
+}
+
+// ExecUser is the exec credential plugin the kubeconfig user authenticates with.
+type ExecUser struct {
+	// Command is the plugin executable.
+	Command string
+	// Args are the plugin arguments.
+	Args []string
+	// InstallHint is shown to the user when the plugin executable is missing.
+	InstallHint string
+	// ProvideClusterInfo passes the cluster to the plugin in KUBERNETES_EXEC_INFO.
+	ProvideClusterInfo bool
+}
+
+// WithExec returns a kubeconfig of the cluster authenticating with the exec credential plugin.
+func WithExec(c Cluster, e ExecUser) *clientcmdapi.Config {
+	user := clientcmdapi.NewAuthInfo()
+	user.Exec = &clientcmdapi.ExecConfig{
+		APIVersion:         EXEC_API_VERSION,
+		Command:            e.Command,
+		Args:               e.Args,
+		InstallHint:        e.InstallHint,
+		ProvideClusterInfo: e.ProvideClusterInfo,
+		InteractiveMode:    clientcmdapi.IfAvailableExecInteractiveMode,
+	}
+
+	return newConfig(c, user)
+}
+
+// Merge returns the kubeconfig file at the path, empty if it doesn't exist, with the clusters, users and
+// contexts of the config added or replaced, selecting the config current context if setCurrent is set.
+func Merge(path string, config *clientcmdapi.Config, setCurrent bool) ([]byte, error) {
+	merged, err := clientcmd.LoadFromFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		merged = clientcmdapi.NewConfig()
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't load kubeconfig %s: %w", path, err)
+	}
+
+	for name, cluster := range config.Clusters {
+		merged.Clusters[name] = cluster
+	}
+	for name, user := range config.AuthInfos {
+		merged.AuthInfos[name] = user
+	}
+	for name, context := range config.Contexts {
+		merged.Contexts[name] = context
+	}
+	if setCurrent || merged.CurrentContext == "" {
+		merged.CurrentContext = config.CurrentContext
+	}
+
+	return clientcmd.Write(*merged)
+}
@@ -7,7 +7,12 @@ import (
 )
 
 var (
-	Log *slog.Logger
+	// Log is the default logger until New configures it.
+	Log = slog.Default()
+
+	// Audit logs policy decisions to standard error, kept apart from the output of the command such as
+	// the ExecCredential, in text format until NewAudit configures it.
+	Audit = slog.New(slog.NewTextHandler(os.Stderr, nil))
 )
 
 func New(logLevel, logFormat, logFile string) {
@@ -48,3 +53,12 @@ func New(logLevel, logFormat, logFile string) {
 		Log = slog.New(slog.NewTextHandler(w, &opts))
 	}
 }
+
+// NewAudit sets the format of the audit logger.
+func NewAudit(logFormat string) {
+	if logFormat == "json" {
+		Audit = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	} else {
+		Audit = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+}
@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"k8xauth/internal/auth"
+
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	POLICY_FILE_ENV = "K8XAUTH_POLICY_FILE"
+	// INSTALL_POLICY_FILE is the policy of the installation, checked whenever it exists. Environment
+	// variables and flags, e.g. exec env and args written to a kubeconfig, can't change or disable it.
+	INSTALL_POLICY_FILE = "/etc/k8xauth/policy.yaml"
+)
+
+// Config is the policy configuration, a request is allowed when the expressions of all rules it
+// matches evaluate to true.
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// RuleConfig is a policy rule of CEL expressions over the source and target variables.
+type RuleConfig struct {
+	// Name identifies the rule in denials and audit entries.
+	Name string `json:"name"`
+	// Match is the expression selecting the requests the rule applies to, all requests if not set.
+	Match string `json:"match,omitempty"`
+	// Expression is the expression the requests the rule applies to have to satisfy.
+	Expression string `json:"expression"`
+	// Message explains the denial, the expression is reported if not set.
+	Message string `json:"message,omitempty"`
+}
+
+// Request is a request of target credentials checked by the policy.
+type Request struct {
+	// Source are the claims of the source identity token.
+	Source *auth.SourceClaims
+	// Target is the target command name, e.g. "eks".
+	Target string
+	// Flags are the values of the target flags.
+	Flags map[string]any
+	// Server is the target cluster API server URL provided in KUBERNETES_EXEC_INFO, if any.
+	Server string
+}
+
+// DeniedError is returned for requests a rule denies.
+type DeniedError struct {
+	Rule    string
+	Message string
+	Target  string
+	// Platform, Issuer and Subject identify the source identity.
+	Platform string
+	Issuer   string
+	Subject  string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%s credentials for %s subject %q of %s denied by policy rule %s: %s", e.Target, e.Platform, e.Subject, e.Issuer, e.Rule, e.Message)
+}
+
+// Policy checks requests against compiled rules.
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	name       string
+	match      cel.Program
+	expression cel.Program
+	message    string
+}
+
+// Load reads and compiles the policy file.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read policy: %w", err)
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	p, err := New(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// New compiles the rules of the configuration.
+func New(config Config) (*Policy, error) {
+	if len(config.Rules) == 0 {
+		return nil, errors.New("no rules configured")
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("source", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("target", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	for n, c := range config.Rules {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("rules[%d]", n)
+		}
+		if c.Expression == "" {
+			return nil, fmt.Errorf("rule %s has no expression", c.Name)
+		}
+
+		r := rule{
+			name:    c.Name,
+			message: c.Message,
+		}
+		if r.message == "" {
+			r.message = "expression " + c.Expression + " is false"
+		}
+		if r.expression, err = compile(env, c.Expression); err != nil {
+			return nil, fmt.Errorf("rule %s expression: %w", c.Name, err)
+		}
+		if c.Match != "" {
+			if r.match, err = compile(env, c.Match); err != nil {
+				return nil, fmt.Errorf("rule %s match: %w", c.Name, err)
+			}
+		}
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+// compile compiles the boolean expression.
+func compile(env *cel.Env, expression string) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("expression returns %s instead of bool", ast.OutputType())
+	}
+	return env.Program(ast)
+}
+
+// eval evaluates the boolean expression, failing for other results.
+func eval(program cel.Program, vars map[string]any) (bool, error) {
+	out, _, err := program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %v instead of bool", out.Value())
+	}
+	return result, nil
+}
+
+// Check returns a *DeniedError if a rule denies the request. Rules failing to evaluate, e.g. for claims
+// the source token doesn't have, deny the request.
+func (p *Policy) Check(r Request) error {
+	source := map[string]any{
+		"platform": r.Source.Platform,
+		"issuer":   r.Source.Issuer,
+		"subject":  r.Source.Subject,
+		"claims":   r.Source.Claims,
+	}
+	target := map[string]any{
+		"name":   r.Target,
+		"flags":  r.Flags,
+		"server": r.Server,
+	}
+	vars := map[string]any{"source": source, "target": target}
+
+	denied := func(rule, message string) error {
+		return &DeniedError{
+			Rule:     rule,
+			Message:  message,
+			Target:   r.Target,
+			Platform: r.Source.Platform,
+			Issuer:   r.Source.Issuer,
+			Subject:  r.Source.Subject,
+		}
+	}
+
+	for _, rule := range p.rules {
+		if rule.match != nil {
+			matched, err := eval(rule.match, vars)
+			if err != nil {
+				return denied(rule.name, "match failed: "+err.Error())
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		allowed, err := eval(rule.expression, vars)
+		if err != nil {
+			return denied(rule.name, "expression failed: "+err.Error())
+		}
+		if !allowed {
+			return denied(rule.name, rule.message)
+		}
+	}
+
+	return nil
+}
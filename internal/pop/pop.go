@@ -0,0 +1,153 @@
+package pop
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// POP_TOKEN_TYPE is the token type of proof-of-possession tokens issued by Microsoft Entra.
+	POP_TOKEN_TYPE = "pop"
+	keySize        = 2048
+)
+
+// Key is an RSA key the proof-of-possession access token is bound to.
+type Key struct {
+	key *rsa.PrivateKey
+	// kid is the base64url encoded SHA-256 thumbprint of the public key JWK.
+	kid string
+	// jwk is the public key in JWK format.
+	jwk map[string]string
+}
+
+// GenerateKey generates an ephemeral RSA key.
+func GenerateKey() (*Key, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate RSA key: %w", err)
+	}
+	return newKey(key), nil
+}
+
+// LoadKey loads an RSA key from a PEM encoded PKCS #1 or PKCS #8 file.
+func LoadKey(path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read RSA key file: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("couldn't decode RSA key file: no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return newKey(key), nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse RSA key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("couldn't parse RSA key: not an RSA private key")
+	}
+	return newKey(key), nil
+}
+
+func newKey(key *rsa.PrivateKey) *Key {
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes())
+	n := base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes())
+
+	// RFC 7638 JWK thumbprint, members in lexicographic order
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, e, n)))
+	kid := base64.RawURLEncoding.EncodeToString(thumbprint[:])
+
+	return &Key{
+		key: key,
+		kid: kid,
+		jwk: map[string]string{
+			"kty": "RSA",
+			"e":   e,
+			"n":   n,
+			"alg": "RS256",
+			"kid": kid,
+		},
+	}
+}
+
+// AuthenticationScheme is an MSAL authentication scheme requesting proof-of-possession
+// access tokens bound to Key and formatting them as signed HTTP requests (SHR) for host.
+type AuthenticationScheme struct {
+	// Host is the host of the resource the token is presented to, set as the `u` claim.
+	Host string
+	// Key the access token is bound to.
+	Key *Key
+}
+
+// TokenRequestParams returns the extra parameters of the token request.
+func (s *AuthenticationScheme) TokenRequestParams() map[string]string {
+	reqCnf, _ := json.Marshal(map[string]string{"kid": s.Key.kid})
+	return map[string]string{
+		"token_type": POP_TOKEN_TYPE,
+		"req_cnf":    base64.RawURLEncoding.EncodeToString(reqCnf),
+	}
+}
+
+// KeyID returns the ID of the key the access token is bound to.
+func (s *AuthenticationScheme) KeyID() string {
+	return s.Key.kid
+}
+
+// FormatAccessToken returns the access token wrapped in a signed HTTP request.
+func (s *AuthenticationScheme) FormatAccessToken(accessToken string) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"typ": POP_TOKEN_TYPE,
+		"alg": "RS256",
+		"kid": s.Key.kid,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"at":    accessToken,
+		"ts":    time.Now().Unix(),
+		"u":     s.Host,
+		"nonce": uuid.NewString(),
+		"cnf": map[string]any{
+			"jwk": s.Key.jwk,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.Key.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("couldn't sign PoP token: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// AccessTokenType returns the token type of proof-of-possession tokens.
+func (s *AuthenticationScheme) AccessTokenType() string {
+	return POP_TOKEN_TYPE
+}
@@ -0,0 +1,105 @@
+// Package testutil provides test fixtures shared by the tests of several packages.
+package testutil
+
+import (
+	"k8xauth/internal/auth"
+	"k8xauth/internal/kubeconfig"
+
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+// PolicyFile writes the policy content to a file and returns its path.
+func PolicyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// SourceTokenFile writes a source token of the subject, signed with a test key, to a file and returns
+// its path.
+func SourceTokenFile(t *testing.T, subject string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{Issuer: "https://issuer.example.com", Subject: subject}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// SetFlags sets the flags of the flag set to the values, restoring their values when the test ends.
+func SetFlags(t *testing.T, fs *pflag.FlagSet, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		flag := fs.Lookup(name)
+		if flag == nil {
+			t.Fatalf("flag --%s not defined", name)
+		}
+		previous, changed := flag.Value.String(), flag.Changed
+		t.Cleanup(func() {
+			flag.Value.Set(previous)
+			flag.Changed = changed
+		})
+		if err := fs.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Target is a fake target returning tokens of the --cluster flag valid for --lifetime, failing with
+// --fail. Its methods are the Flags, Token and Discover functions of a target registered by the tests.
+type Target struct {
+	// Tokens counts the tokens retrieved.
+	Tokens int
+}
+
+// Flags defines the target flags on the flag set.
+func (f *Target) Flags(fs *pflag.FlagSet) {
+	fs.String("cluster", "", "Cluster name (required)")
+	fs.Duration("lifetime", time.Hour, "Token lifetime (optional)")
+	fs.Bool("fail", false, "Fail to retrieve the token (optional)")
+}
+
+// Token returns a token of the source type, cluster and count of the tokens retrieved.
+func (f *Target) Token(flags *pflag.FlagSet, o *auth.Options) (*oauth2.Token, error) {
+	cluster, _ := flags.GetString("cluster")
+	lifetime, _ := flags.GetDuration("lifetime")
+	if fail, _ := flags.GetBool("fail"); fail {
+		return nil, errors.New("access denied")
+	}
+
+	f.Tokens++
+	return &oauth2.Token{
+		AccessToken: fmt.Sprintf("%s/%s/%d", o.AuthType, cluster, f.Tokens),
+		Expiry:      time.Now().Add(lifetime),
+	}, nil
+}
+
+// Discover returns the same cluster for all flags.
+func (f *Target) Discover(flags *pflag.FlagSet, o *auth.Options) (*kubeconfig.Cluster, error) {
+	return &kubeconfig.Cluster{
+		Server:                   "https://api.example.com",
+		CertificateAuthorityData: []byte("ca"),
+	}, nil
+}
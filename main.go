@@ -2,7 +2,9 @@ package main
 
 import (
 	"k8xauth/cmd"
+	_ "k8xauth/cmd/agent"
 	_ "k8xauth/cmd/aks"
+	_ "k8xauth/cmd/controller"
 	_ "k8xauth/cmd/eks"
 	_ "k8xauth/cmd/gke"
 )